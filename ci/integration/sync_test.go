@@ -0,0 +1,83 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cdr.dev/coder-cli/coder-sdk"
+	"cdr.dev/coder-cli/pkg/tcli"
+)
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+	run(t, "sync-coder-cli-tests", func(t *testing.T, ctx context.Context, c *tcli.ContainerRunner) {
+		headlessLogin(ctx, t, c)
+
+		// TODO remove this once we can create a workspace if there aren't any
+		var workspaces []coder.Workspace
+		c.Run(ctx, "coder workspaces ls --output json").Assert(t,
+			tcli.Success(),
+			tcli.StdoutJSONUnmarshal(&workspaces),
+		)
+		// if we don't have any workspaces, "coder sync" will fail
+		if len(workspaces) == 0 {
+			c.Run(ctx, "mkdir -p /tmp/sync && coder sync --init /tmp/sync coder-cli-sync-missing:/tmp/sync").Assert(t,
+				tcli.Error(),
+			)
+			return
+		}
+		workspace := workspaces[0].Name
+
+		c.Run(ctx, "mkdir -p /tmp/sync/nested && echo hello > /tmp/sync/nested/file.txt && echo ignored > /tmp/sync/debug.log && echo '*.log' > /tmp/sync/.coderignore").Assert(t,
+			tcli.Success(),
+		)
+		// The built-in engine is the default, and rsync is an option.
+		for _, flags := range []string{"", "--rsync"} {
+			remote := "/tmp/coder-cli-sync-" + randString(10)
+			c.Run(ctx, fmt.Sprintf("coder sync --init %s /tmp/sync %s:%s", flags, workspace, remote)).Assert(t,
+				tcli.Success(),
+			)
+
+			// The remote shell used by sync runs commands in the workspace.
+			c.Run(ctx, fmt.Sprintf("coder rsh %s cat %s/nested/file.txt", workspace, remote)).Assert(t,
+				tcli.Success(),
+				tcli.StdoutMatches("hello"),
+			)
+			c.Run(ctx, fmt.Sprintf("coder rsh %s test -e %s/debug.log", workspace, remote)).Assert(t,
+				tcli.Error(),
+			)
+			c.Run(ctx, fmt.Sprintf("coder rsh %s rm -r %s", workspace, remote)).Assert(t,
+				tcli.Success(),
+			)
+		}
+
+		// A config file syncs several directories at once.
+		remote := "/tmp/coder-cli-sync-" + randString(10)
+		config := fmt.Sprintf(`workspace: %s
+syncs:
+  - local: sync/nested
+    remote: %s/nested
+  - name: root
+    local: sync
+    remote: %s/root
+    exclude: [nested]
+`, workspace, remote, remote)
+		c.Run(ctx, fmt.Sprintf("mkdir -p /tmp/.coder && echo '%s' > /tmp/.coder/sync.yaml", config)).Assert(t,
+			tcli.Success(),
+		)
+		c.Run(ctx, "cd /tmp && coder sync --init --config").Assert(t,
+			tcli.Success(),
+		)
+		c.Run(ctx, fmt.Sprintf("coder rsh %s cat %s/nested/file.txt", workspace, remote)).Assert(t,
+			tcli.Success(),
+			tcli.StdoutMatches("hello"),
+		)
+		c.Run(ctx, fmt.Sprintf("coder rsh %s test -e %s/root/nested", workspace, remote)).Assert(t,
+			tcli.Error(),
+		)
+		c.Run(ctx, fmt.Sprintf("coder rsh %s rm -r %s", workspace, remote)).Assert(t,
+			tcli.Success(),
+		)
+	})
+}
@@ -1,10 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	// We use slog here since agent runs in the background and we can benefit
 	// from structured logging.
@@ -26,18 +30,23 @@ func agentCmd() *cobra.Command {
 
 	cmd.AddCommand(
 		startCmd(),
+		agentStatusCmd(),
 	)
 	return cmd
 }
 
 func startCmd() *cobra.Command {
 	var (
-		token    string
-		coderURL string
-		logFile  string
+		token        string
+		coderURL     string
+		logFile      string
+		auditLogFile string
+		policyFile   string
+		statusAddr   string
+		gracePeriod  time.Duration
 	)
 	cmd := &cobra.Command{
-		Use:   "start --coder-url=<coder_url> --token=<token> --log-file=<path>",
+		Use:   "start --coder-url=<coder_url> --token=<token> --log-file=<path> --audit-log=<path> --policy-file=<path> --status-addr=<addr> --grace-period=<duration>",
 		Short: "starts the coder agent",
 		Long:  "starts the coder agent",
 		Example: `# start the agent and use CODER_URL and CODER_AGENT_TOKEN env vars
@@ -49,6 +58,22 @@ coder agent start --coder-url https://my-coder.com --token xxxx-xxxx
 # start the agent and write a copy of the log to /tmp/coder-agent.log
 # if the file already exists, it will be truncated
 coder agent start --log-file=/tmp/coder-agent.log
+
+# start the agent and append the connections users open through it to
+# /var/log/coder-agent-audit.log as JSON lines
+coder agent start --audit-log=/var/log/coder-agent-audit.log
+
+# start the agent and never proxy to the cloud metadata endpoint, even if
+# Coder permits it, with /etc/coder/policy.json containing:
+# [{"address": "169.254.169.254", "action": "deny"}]
+coder agent start --policy-file=/etc/coder/policy.json
+
+# start the agent and serve its status on localhost:7077, which can be
+# checked with "coder agent status" or probed at /ready
+coder agent start --status-addr=localhost:7077
+
+# start the agent and give open connections a minute to close when stopped
+coder agent start --grace-period=1m
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
@@ -97,12 +122,34 @@ coder agent start --log-file=/tmp/coder-agent.log
 				}
 			}
 
+			listenOptions := &wsnet.ListenOptions{}
+			if auditLogFile != "" {
+				// Audit trails are appended to so restarts don't erase them.
+				file, err := os.OpenFile(auditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+				if err != nil {
+					return xerrors.Errorf("open audit log: %w", err)
+				}
+				defer file.Close()
+				listenOptions = newAuditLog(log, file).listenOptions()
+			}
+			if policyFile != "" {
+				listenOptions.Policies, err = loadDialPolicies(policyFile)
+				if err != nil {
+					return xerrors.Errorf("load policy file: %w", err)
+				}
+				log.Info(ctx, "loaded dial policies", slog.F("path", policyFile), slog.F("policies", listenOptions.Policies))
+			}
+
 			log.Info(ctx, "starting wsnet listener", slog.F("coder_access_url", u.String()))
-			listener, err := wsnet.Listen(ctx, log, wsnet.ListenEndpoint(u, token), token)
+			listener, err := wsnet.ListenWithOptions(ctx, log, wsnet.ListenEndpoint(u, token), token, listenOptions)
 			if err != nil {
 				return xerrors.Errorf("listen: %w", err)
 			}
+			drained := false
 			defer func() {
+				if drained {
+					return
+				}
 				log.Info(ctx, "closing wsnet listener")
 				err := listener.Close()
 				if err != nil {
@@ -110,11 +157,38 @@ coder agent start --log-file=/tmp/coder-agent.log
 				}
 			}()
 
+			if statusAddr != "" {
+				statusCtx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				err = serveStatus(statusCtx, log, statusAddr, listener)
+				if err != nil {
+					return xerrors.Errorf("serve status: %w", err)
+				}
+			}
+
 			// Block until user sends SIGINT or SIGTERM
-			sigs := make(chan os.Signal, 1)
+			sigs := make(chan os.Signal, 2)
 			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-			<-sigs
-
+			sig := <-sigs
+
+			// Open connections are given the grace period to close, which a
+			// second signal cuts short.
+			log.Info(ctx, "draining wsnet listener", slog.F("signal", sig.String()), slog.F("grace_period", gracePeriod))
+			drainCtx, cancel := context.WithTimeout(ctx, gracePeriod)
+			defer cancel()
+			go func() {
+				select {
+				case <-sigs:
+					log.Warn(ctx, "received second signal, closing connections")
+					cancel()
+				case <-drainCtx.Done():
+				}
+			}()
+			drained = true
+			err = listener.Shutdown(drainCtx, fmt.Sprintf("agent is stopping (%s)", sig))
+			if err != nil {
+				log.Warn(ctx, "closed wsnet listener before connections were drained", slog.Error(err))
+			}
 			return nil
 		},
 	}
@@ -122,6 +196,39 @@ coder agent start --log-file=/tmp/coder-agent.log
 	cmd.Flags().StringVar(&token, "token", "", "coder agent token")
 	cmd.Flags().StringVar(&coderURL, "coder-url", "", "coder access url")
 	cmd.Flags().StringVar(&logFile, "log-file", "", "write a copy of logs to file")
+	cmd.Flags().StringVar(&auditLogFile, "audit-log", "", "append connections opened through the agent to file as JSON lines")
+	cmd.Flags().DurationVar(&gracePeriod, "grace-period", 20*time.Second, "how long open connections are given to close when the agent is stopped")
+	cmd.Flags().StringVar(&statusAddr, "status-addr", "", "serve the agent status over HTTP on this address")
+	cmd.Flags().StringVar(&policyFile, "policy-file", "", "JSON file of dial policies that restrict addresses in addition to Coder's policies")
 
 	return cmd
 }
+
+// loadDialPolicies reads a JSON array of dial policies from a file. Policies
+// are validated, and an empty list is refused, so a mistake in the file can't
+// leave the agent unrestricted.
+func loadDialPolicies(path string) ([]wsnet.DialPolicy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var policies []wsnet.DialPolicy
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&policies)
+	if err != nil {
+		return nil, xerrors.Errorf("decode %q: %w", path, err)
+	}
+	if len(policies) == 0 {
+		return nil, xerrors.Errorf("%q contains no policies", path)
+	}
+	for i, policy := range policies {
+		err = policy.Validate()
+		if err != nil {
+			return nil, xerrors.Errorf("policy %d: %w", i, err)
+		}
+	}
+	return policies, nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"cdr.dev/slog"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// Audit event types.
+const (
+	auditConnOpened = "conn_opened"
+	auditConnDenied = "conn_denied"
+	auditDialFailed = "dial_failed"
+	auditConnClosed = "conn_closed"
+)
+
+// auditEvent is a line of the agent audit log. Bytes are counted from the
+// agent's perspective, so bytes read were sent by the remote user.
+type auditEvent struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	Network      string    `json:"network"`
+	Address      string    `json:"address"`
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+	DurationMS   int64     `json:"duration_ms"`
+	ErrorCode    string    `json:"error_code,omitempty"`
+}
+
+// auditLog writes the connections remote users open through the agent as
+// JSON lines.
+type auditLog struct {
+	log slog.Logger
+	mut sync.Mutex
+	enc *json.Encoder
+}
+
+func newAuditLog(log slog.Logger, w io.Writer) *auditLog {
+	return &auditLog{
+		log: log,
+		enc: json.NewEncoder(w),
+	}
+}
+
+// listenOptions returns options that write connection events to the log.
+func (a *auditLog) listenOptions() *wsnet.ListenOptions {
+	return &wsnet.ListenOptions{
+		OnConnOpened: a.hook(auditConnOpened),
+		OnConnDenied: a.hook(auditConnDenied),
+		OnDialFailed: a.hook(auditDialFailed),
+		OnConnClosed: a.hook(auditConnClosed),
+	}
+}
+
+func (a *auditLog) hook(event string) func(wsnet.ConnStats) {
+	return func(stats wsnet.ConnStats) {
+		a.write(event, stats)
+	}
+}
+
+func (a *auditLog) write(event string, stats wsnet.ConnStats) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	err := a.enc.Encode(&auditEvent{
+		Time:         time.Now().UTC(),
+		Event:        event,
+		Network:      stats.Network,
+		Address:      stats.Address,
+		BytesRead:    stats.BytesRead,
+		BytesWritten: stats.BytesWritten,
+		DurationMS:   stats.Duration().Milliseconds(),
+		ErrorCode:    stats.ErrorCode,
+	})
+	if err != nil {
+		a.log.Warn(context.Background(), "failed to write audit event", slog.F("event", event), slog.Error(err))
+	}
+}
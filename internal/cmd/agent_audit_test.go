@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+func Test_auditLog(t *testing.T) {
+	var (
+		buf     bytes.Buffer
+		now     = time.Now()
+		options = newAuditLog(slogtest.Make(t, nil), &buf).listenOptions()
+	)
+	options.OnConnOpened(wsnet.ConnStats{Network: "tcp", Address: "localhost:8080", OpenedAt: now})
+	options.OnConnDenied(wsnet.ConnStats{Network: "tcp", Address: "localhost:22", OpenedAt: now, ClosedAt: now, ErrorCode: wsnet.CodePermissionErr})
+	options.OnDialFailed(wsnet.ConnStats{Network: "tcp", Address: "localhost:100", OpenedAt: now, ClosedAt: now, ErrorCode: wsnet.CodeDialErr})
+	options.OnConnClosed(wsnet.ConnStats{Network: "tcp", Address: "localhost:8080", BytesRead: 100, BytesWritten: 10, OpenedAt: now.Add(-time.Second), ClosedAt: now})
+
+	var events []auditEvent
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event auditEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		assert.Success(t, "unmarshal event", err)
+		events = append(events, event)
+	}
+	assert.Equal(t, "events", 4, len(events))
+	assert.Equal(t, "opened", auditConnOpened, events[0].Event)
+	assert.Equal(t, "denied", auditConnDenied, events[1].Event)
+	assert.Equal(t, "denied code", wsnet.CodePermissionErr, events[1].ErrorCode)
+	assert.Equal(t, "failed", auditDialFailed, events[2].Event)
+	assert.Equal(t, "closed", auditConnClosed, events[3].Event)
+	assert.Equal(t, "address", "localhost:8080", events[3].Address)
+	assert.Equal(t, "bytes read", uint64(100), events[3].BytesRead)
+	assert.Equal(t, "bytes written", uint64(10), events[3].BytesWritten)
+	assert.Equal(t, "duration", int64(1000), events[3].DurationMS)
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/coder-cli/internal/version"
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// agentStatus is served by the status endpoint of the agent.
+type agentStatus struct {
+	Version string `json:"version"`
+	wsnet.ListenerStatus
+}
+
+// statusHandler serves the status of the agent as JSON on /status, and on
+// /ready responds with 200 when new connections can be accepted and 503
+// otherwise, for readiness probes.
+func statusHandler(status func() wsnet.ListenerStatus) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&agentStatus{
+			Version:        version.Version,
+			ListenerStatus: status(),
+		})
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		s := status()
+		if !s.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = fmt.Fprintf(w, "broker %s\n", s.BrokerState)
+	})
+	return mux
+}
+
+// serveStatus serves the status endpoint on addr until the context is
+// canceled.
+func serveStatus(ctx context.Context, log slog.Logger, addr string, listener *wsnet.Listener) error {
+	// Listen first so the agent fails to start if the address is in use.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler: statusHandler(listener.Status),
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		err := server.Serve(ln)
+		if err != nil && !xerrors.Is(err, http.ErrServerClosed) {
+			log.Error(ctx, "serve status endpoint", slog.Error(err))
+		}
+	}()
+	log.Info(ctx, "serving status endpoint", slog.F("addr", ln.Addr().String()))
+	return nil
+}
+
+func agentStatusCmd() *cobra.Command {
+	var (
+		statusAddr string
+		outputFmt  string
+	)
+	cmd := &cobra.Command{
+		Use:   "status --status-addr=<addr>",
+		Short: "show the status of a running coder agent",
+		Long:  "Show the status of a coder agent started with --status-addr. Exits with an error if the agent isn't connected to Coder.",
+		Example: `# show the status of an agent started with --status-addr=localhost:7077
+coder agent status --status-addr=localhost:7077`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := fetchAgentStatus(cmd.Context(), statusAddr)
+			if err != nil {
+				return err
+			}
+
+			switch outputFmt {
+			case jsonOutput:
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "\t")
+				err = enc.Encode(status)
+				if err != nil {
+					return xerrors.Errorf("write status as JSON: %w", err)
+				}
+			case humanOutput:
+				writeAgentStatus(cmd.OutOrStdout(), status, time.Now())
+			default:
+				return xerrors.Errorf("%q is not a supported value for --output", outputFmt)
+			}
+
+			if !status.Ready() {
+				return xerrors.Errorf("agent is not connected to coder: broker %s", status.BrokerState)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&statusAddr, "status-addr", "", "address the agent serves its status on")
+	cmd.Flags().StringVarP(&outputFmt, "output", "o", humanOutput, "human | json")
+	_ = cmd.MarkFlagRequired("status-addr")
+	return cmd
+}
+
+// fetchAgentStatus queries the status endpoint of an agent.
+func fetchAgentStatus(ctx context.Context, addr string) (*agentStatus, error) {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/status", nil)
+	if err != nil {
+		return nil, xerrors.Errorf("create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("query agent status: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("query agent status: unexpected status %s", resp.Status)
+	}
+
+	var status agentStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return nil, xerrors.Errorf("decode agent status: %w", err)
+	}
+	return &status, nil
+}
+
+// writeAgentStatus writes the status of an agent for humans.
+func writeAgentStatus(w io.Writer, status *agentStatus, now time.Time) {
+	since := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%s ago", now.Sub(t).Round(time.Second))
+	}
+
+	broker := string(status.BrokerState)
+	if status.BrokerError != "" {
+		broker += ": " + status.BrokerError
+	}
+	types := make([]string, 0, len(status.CandidateTypes))
+	for typ, count := range status.CandidateTypes {
+		types = append(types, fmt.Sprintf("%s=%d", typ, count))
+	}
+	sort.Strings(types)
+	candidates := strings.Join(types, ", ")
+	if candidates == "" {
+		candidates = "none"
+	}
+
+	_, _ = fmt.Fprintf(w, "Version:           %s\n", status.Version)
+	_, _ = fmt.Fprintf(w, "Broker:            %s\n", broker)
+	_, _ = fmt.Fprintf(w, "Broker connected:  %s\n", since(status.BrokerConnectedAt))
+	_, _ = fmt.Fprintf(w, "Last negotiation:  %s\n", since(status.LastNegotiation))
+	_, _ = fmt.Fprintf(w, "Peers:             %d\n", status.Peers)
+	_, _ = fmt.Fprintf(w, "Data channels:     %d\n", status.DataChannels)
+	_, _ = fmt.Fprintf(w, "Candidate types:   %s\n", candidates)
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+func Test_agentStatus(t *testing.T) {
+	now := time.Now()
+	status := wsnet.ListenerStatus{
+		BrokerState:       wsnet.BrokerStateConnected,
+		BrokerConnectedAt: now.Add(-time.Minute),
+		LastNegotiation:   now.Add(-time.Second),
+		Peers:             2,
+		DataChannels:      5,
+		CandidateTypes:    map[string]int{"relay": 1, "host": 1},
+	}
+	server := httptest.NewServer(statusHandler(func() wsnet.ListenerStatus {
+		return status
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	resp, err := http.Get(server.URL + "/ready")
+	assert.Success(t, "get ready", err)
+	resp.Body.Close()
+	assert.Equal(t, "ready", http.StatusOK, resp.StatusCode)
+
+	got, err := fetchAgentStatus(context.Background(), addr)
+	assert.Success(t, "fetch status", err)
+	assert.Equal(t, "peers", 2, got.Peers)
+	assert.Equal(t, "candidate types", status.CandidateTypes, got.CandidateTypes)
+
+	var buf bytes.Buffer
+	writeAgentStatus(&buf, got, now)
+	assert.True(t, "broker", strings.Contains(buf.String(), "Broker connected:  1m0s ago"))
+	assert.True(t, "candidate types", strings.Contains(buf.String(), "host=1, relay=1"))
+
+	status.BrokerState = wsnet.BrokerStateReconnecting
+	resp, err = http.Get(server.URL + "/ready")
+	assert.Success(t, "get ready", err)
+	resp.Body.Close()
+	assert.Equal(t, "not ready", http.StatusServiceUnavailable, resp.StatusCode)
+}
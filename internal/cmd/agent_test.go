@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+func Test_loadDialPolicies(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		err := os.WriteFile(path, []byte(content), 0600)
+		assert.Success(t, "write policy file", err)
+		return path
+	}
+
+	policies, err := loadDialPolicies(write(t, `[{"address": "169.254.169.254", "action": "deny"}, {"network": "tcp", "port": 8000, "port_end": 9000}]`))
+	assert.Success(t, "load policies", err)
+	assert.Equal(t, "policies", []wsnet.DialPolicy{
+		{Host: "169.254.169.254", Action: wsnet.PolicyDeny},
+		{Network: "tcp", Port: 8000, PortEnd: 9000},
+	}, policies)
+
+	_, err = loadDialPolicies(write(t, `[]`))
+	assert.ErrorContains(t, "empty policies", err, "no policies")
+
+	_, err = loadDialPolicies(write(t, `[{"host": "169.254.169.254", "action": "deny"}]`))
+	assert.ErrorContains(t, "unknown field", err, "unknown field")
+
+	_, err = loadDialPolicies(write(t, `[{"address": "169.254.169.254", "action": "block"}]`))
+	assert.ErrorContains(t, "invalid action", err, "unknown action")
+
+	_, err = loadDialPolicies(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, "missing file", err)
+}
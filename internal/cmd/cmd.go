@@ -32,9 +32,11 @@ func Make() *cobra.Command {
 		logoutCmd(),
 		providersCmd(),
 		resourceCmd(),
+		rshCmd(),
 		satellitesCmd(),
 		sshCmd(),
 		syncCmd(),
+		syncHelperCmd(),
 		tagsCmd(),
 		tokensCmd(),
 		tunnelCmd(),
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Types of the JSON records written by coder workspaces ping --output json.
+const (
+	pingProbeRecord   = "probe"
+	pingSummaryRecord = "summary"
+)
+
+// pingProbe is the result of a single ping of a workspace.
+type pingProbe struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Workspace string    `json:"workspace"`
+	Seq       int       `json:"seq"`
+	// RTTMS is the round trip time in milliseconds. It's zero if the probe
+	// failed.
+	RTTMS float64 `json:"rtt_ms"`
+	Error string  `json:"error,omitempty"`
+	// CandidateType is the type of the local ICE candidate in use, such as
+	// "host", "srflx" or "relay", or "websocket" if WebRTC couldn't connect.
+	// It's empty if the workspace couldn't be reached.
+	CandidateType string `json:"candidate_type,omitempty"`
+	// Tunneled is set if the connection is relayed through the access URL.
+	Tunneled bool `json:"tunneled"`
+}
+
+// pingSummary is printed when coder workspaces ping exits, like the
+// statistics of ping(8).
+type pingSummary struct {
+	Type        string  `json:"type"`
+	Workspace   string  `json:"workspace"`
+	Sent        int     `json:"sent"`
+	Received    int     `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	// Round trip times are in milliseconds and zero if nothing was received.
+	MinMS    float64 `json:"min_ms"`
+	AvgMS    float64 `json:"avg_ms"`
+	MaxMS    float64 `json:"max_ms"`
+	StddevMS float64 `json:"stddev_ms"`
+}
+
+// pingStats accumulates the round trip times of probes.
+type pingStats struct {
+	sent     int
+	received int
+	min      float64
+	max      float64
+	sum      float64
+	sumSq    float64
+}
+
+// add records a probe.
+func (s *pingStats) add(probe pingProbe) {
+	s.sent++
+	if probe.Error != "" {
+		return
+	}
+	rtt := probe.RTTMS
+	if s.received == 0 || rtt < s.min {
+		s.min = rtt
+	}
+	if rtt > s.max {
+		s.max = rtt
+	}
+	s.received++
+	s.sum += rtt
+	s.sumSq += rtt * rtt
+}
+
+// summary returns the statistics of the probes recorded.
+func (s *pingStats) summary(workspace string) pingSummary {
+	summary := pingSummary{
+		Type:      pingSummaryRecord,
+		Workspace: workspace,
+		Sent:      s.sent,
+		Received:  s.received,
+	}
+	if s.sent > 0 {
+		summary.LossPercent = float64(s.sent-s.received) / float64(s.sent) * 100
+	}
+	if s.received > 0 {
+		n := float64(s.received)
+		summary.MinMS = s.min
+		summary.MaxMS = s.max
+		summary.AvgMS = s.sum / n
+		// Rounding can make the variance slightly negative.
+		summary.StddevMS = math.Sqrt(math.Max(0, s.sumSq/n-summary.AvgMS*summary.AvgMS))
+	}
+	return summary
+}
+
+// write prints the statistics for humans.
+func (s pingSummary) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "\n--- %s ping statistics ---\n", s.Workspace)
+	_, _ = fmt.Fprintf(w, "%d probes sent, %d received, %.1f%% loss\n", s.Sent, s.Received, s.LossPercent)
+	if s.Received == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "rtt min/avg/max/stddev = %.2f/%.2f/%.2f/%.2f ms\n", s.MinMS, s.AvgMS, s.MaxMS, s.StddevMS)
+}
+
+// durationMS returns the duration in fractional milliseconds.
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func Test_pingStats(t *testing.T) {
+	t.Parallel()
+
+	stats := &pingStats{}
+	stats.add(pingProbe{RTTMS: 10})
+	stats.add(pingProbe{Error: "connection timed out"})
+	stats.add(pingProbe{RTTMS: 30})
+	stats.add(pingProbe{RTTMS: 20})
+
+	summary := stats.summary("dev")
+	assert.Equal(t, "type", pingSummaryRecord, summary.Type)
+	assert.Equal(t, "sent", 4, summary.Sent)
+	assert.Equal(t, "received", 3, summary.Received)
+	assert.Equal(t, "loss", 25.0, summary.LossPercent)
+	assert.Equal(t, "min", 10.0, summary.MinMS)
+	assert.Equal(t, "avg", 20.0, summary.AvgMS)
+	assert.Equal(t, "max", 30.0, summary.MaxMS)
+	assert.True(t, "stddev", summary.StddevMS > 8.16 && summary.StddevMS < 8.17)
+
+	var buf bytes.Buffer
+	summary.write(&buf)
+	assert.True(t, "header", bytes.Contains(buf.Bytes(), []byte("--- dev ping statistics ---")))
+	assert.True(t, "counts", bytes.Contains(buf.Bytes(), []byte("4 probes sent, 3 received, 25.0% loss")))
+	assert.True(t, "rtt", bytes.Contains(buf.Bytes(), []byte("rtt min/avg/max/stddev = 10.00/20.00/30.00/8.16 ms")))
+
+	// Nothing was received, so there are no round trip times.
+	stats = &pingStats{}
+	stats.add(pingProbe{Error: "workspace is unreachable (status=OFF)"})
+	summary = stats.summary("dev")
+	assert.Equal(t, "loss", 100.0, summary.LossPercent)
+	assert.Equal(t, "avg", 0.0, summary.AvgMS)
+	buf.Reset()
+	summary.write(&buf)
+	assert.True(t, "no rtt", !bytes.Contains(buf.Bytes(), []byte("rtt")))
+}
+
+func Test_pingProbe_json(t *testing.T) {
+	t.Parallel()
+
+	data, err := json.Marshal(pingProbe{
+		Type:          pingProbeRecord,
+		Workspace:     "dev",
+		Seq:           1,
+		RTTMS:         12.5,
+		CandidateType: "relay",
+		Tunneled:      true,
+	})
+	assert.Success(t, "marshal probe", err)
+	var record map[string]interface{}
+	err = json.Unmarshal(data, &record)
+	assert.Success(t, "unmarshal probe", err)
+	assert.Equal(t, "type", "probe", record["type"])
+	assert.Equal(t, "rtt", 12.5, record["rtt_ms"])
+	assert.Equal(t, "candidate type", "relay", record["candidate_type"])
+	assert.Equal(t, "tunneled", true, record["tunneled"])
+	_, ok := record["error"]
+	assert.True(t, "no error", !ok)
+}
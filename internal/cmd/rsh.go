@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"cdr.dev/wsep"
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+
+	"cdr.dev/coder-cli/coder-sdk"
+	"cdr.dev/coder-cli/internal/coderutil"
+)
+
+// rshCmd runs a command in a workspace with its standard streams connected,
+// like rsh(1). It's the remote shell that coder sync gives rsync, and only
+// needs the workspace executor, so it works without SSH.
+func rshCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rsh <workspace_name> <command> [args...]",
+		Short: "Run a command in a Coder workspace over its standard input and output",
+		Long: `Run a command in a Coder workspace over its standard input and output, for use as the remote shell of tools like rsync.
+Like ssh, the command and its arguments are joined with spaces and run by sh.`,
+		Example:            `rsync -a -e "coder rsh" ./project my-workspace:/home/coder/project`,
+		Hidden:             true,
+		Args:               cobra.MinimumNArgs(2),
+		DisableFlagParsing: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			client, err := newClient(ctx, true)
+			if err != nil {
+				return err
+			}
+			workspace, err := findWorkspace(ctx, client, args[0], coder.Me)
+			if err != nil {
+				return err
+			}
+
+			conn, err := coderutil.DialWorkspaceWsep(ctx, client, workspace)
+			if err != nil {
+				return xerrors.Errorf("dial executor: %w", err)
+			}
+			defer func() { _ = conn.Close(websocket.StatusNormalClosure, "") }() // Best effort.
+
+			process, err := wsep.RemoteExecer(conn).Start(ctx, wsep.Command{
+				Command: "sh",
+				Args:    []string{"-c", strings.Join(args[1:], " ")},
+				Stdin:   true,
+			})
+			if err != nil {
+				return xerrors.Errorf("exec remote process: %w", err)
+			}
+			defer process.Close()
+
+			go func() {
+				stdin := process.Stdin()
+				defer stdin.Close()
+				_, _ = io.Copy(stdin, cmd.InOrStdin())
+			}()
+			// Output is copied in full before exiting, because the protocol of
+			// the tool running the command is likely on stdout.
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_, _ = io.Copy(cmd.OutOrStdout(), process.Stdout())
+			}()
+			go func() {
+				defer wg.Done()
+				_, _ = io.Copy(cmd.ErrOrStderr(), process.Stderr())
+			}()
+
+			err = process.Wait()
+			wg.Wait()
+			var exitErr wsep.ExitError
+			if xerrors.As(err, &exitErr) {
+				os.Exit(exitErr.Code)
+				return xerrors.New("unreachable")
+			}
+			if err != nil {
+				return xerrors.Errorf("execution failure: %w", err)
+			}
+			return nil
+		},
+	}
+}
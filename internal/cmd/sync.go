@@ -18,14 +18,86 @@ import (
 )
 
 func syncCmd() *cobra.Command {
-	var init bool
+	var (
+		init       bool
+		exclude    []string
+		include    []string
+		useRsync   bool
+		mode       string
+		configPath string
+	)
 	cmd := &cobra.Command{
 		Use:   "sync [local directory] [<workspace name>:<remote directory>]",
-		Short: "Establish a one way directory sync to a Coder workspace",
-		Args:  xcobra.ExactArgs(2),
-		RunE:  makeRunSync(&init),
+		Short: "Establish a directory sync to a Coder workspace",
+		Long: `Establish a directory sync to a Coder workspace.
+Paths ignored by .gitignore and .coderignore files are not synced, and neither is .git.
+Files are transferred by a built-in engine that only sends the parts of files that changed, using a helper it installs in the workspace. Use --rsync to transfer them with rsync instead, which must be installed locally and in the workspace. The helper is this executable when the workspace can run it, and the workspace's coder otherwise; if neither is compatible, one-way syncs use rsync.
+By default, the sync is one way: the workspace directory is made to match the local one. With --mode two-way, changes made in the workspace are synced back too. The first two-way sync of a directory merges both sides without removing anything. When a file changes on both sides, the local version is kept and the workspace's is saved next to it with a .conflict suffix.
+With --config, the directories of a sync config file are synced at once, sharing the connections to the workspace. The file is .coder/sync.yaml by default, and local directories are relative to the directory that contains .coder:
+
+  workspace: my-workspace
+  syncs:
+    - local: frontend
+      remote: /home/coder/app/frontend
+      exclude: ["node_modules"]
+    - name: api
+      local: services/api
+      remote: /home/coder/app/api
+      mode: two-way`,
+		Example: `coder sync ~/Projects/app my-workspace:/home/coder/app
+
+# sync build output, but not logs
+coder sync --include dist --exclude '*.log' ~/Projects/app my-workspace:/home/coder/app
+
+# sync changes made in the workspace back
+coder sync --mode two-way ~/Projects/app my-workspace:/home/coder/app
+
+# sync the directories of .coder/sync.yaml
+coder sync --config`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if configPath != "" {
+				return xcobra.ExactArgs(0)(cmd, args)
+			}
+			return xcobra.ExactArgs(2)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if configPath != "" {
+				return runSyncConfig(cmd, configPath, init)
+			}
+			return makeRunSync(&init, &exclude, &include, &useRsync, &mode)(cmd, args)
+		},
 	}
 	cmd.Flags().BoolVar(&init, "init", false, "do initial transfer and exit")
+	cmd.Flags().StringArrayVar(&exclude, "exclude", nil, "don't sync paths matching the pattern, using .gitignore syntax")
+	cmd.Flags().StringArrayVar(&include, "include", nil, "sync paths matching the pattern even if they're ignored, using .gitignore syntax")
+	cmd.Flags().BoolVar(&useRsync, "rsync", false, "transfer files with rsync instead of the built-in engine")
+	cmd.Flags().StringVar(&mode, "mode", string(sync.ModeOneWay), "direction of the sync [one-way | two-way]")
+	cmd.Flags().StringVar(&configPath, "config", "", "sync the directories of a config file instead, given as --config=<file>")
+	cmd.Flags().Lookup("config").NoOptDefVal = sync.ConfigPath
+	return cmd
+}
+
+// syncHelperCmd serves the requests of coder sync in a workspace. It's run
+// by the sync engine, which copies this executable to the workspace if
+// needed.
+func syncHelperCmd() *cobra.Command {
+	var watch bool
+	cmd := &cobra.Command{
+		Use:    "sync-helper <directory>...",
+		Short:  "Serve the requests of coder sync for directories of this workspace",
+		Hidden: true,
+		Args:   xcobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if watch {
+				return sync.ServeWatch(args, cmd.InOrStdin(), cmd.OutOrStdout())
+			}
+			if len(args) > 1 {
+				return xerrors.New("requests are served for one directory, and name the others")
+			}
+			return sync.ServeHelper(args[0], cmd.InOrStdin(), cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().BoolVar(&watch, "watch", false, "send the paths that change in the directories instead of serving requests")
 	return cmd
 }
 
@@ -46,7 +118,7 @@ func rsyncVersion() string {
 	return versionString[1]
 }
 
-func makeRunSync(init *bool) func(cmd *cobra.Command, args []string) error {
+func makeRunSync(init *bool, exclude, include *[]string, useRsync *bool, mode *string) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		var (
 			ctx    = cmd.Context()
@@ -54,6 +126,14 @@ func makeRunSync(init *bool) func(cmd *cobra.Command, args []string) error {
 			remote = args[1]
 		)
 
+		syncMode, err := sync.ParseMode(*mode)
+		if err != nil {
+			return err
+		}
+		if syncMode == sync.ModeTwoWay && *useRsync {
+			return xerrors.New("two-way syncs can't use rsync")
+		}
+
 		client, err := newClient(ctx, true)
 		if err != nil {
 			return err
@@ -91,6 +171,10 @@ func makeRunSync(init *bool) func(cmd *cobra.Command, args []string) error {
 
 		s := sync.Sync{
 			Init:                *init,
+			Exclude:             *exclude,
+			Include:             *include,
+			Rsync:               *useRsync,
+			Mode:                syncMode,
 			Workspace:           *workspace,
 			RemoteDir:           remoteDir,
 			LocalDir:            absLocal,
@@ -101,13 +185,15 @@ func makeRunSync(init *bool) func(cmd *cobra.Command, args []string) error {
 			IsInteractiveOutput: showInteractiveOutput,
 		}
 
-		localVersion := rsyncVersion()
-		remoteVersion, rsyncErr := s.Version()
+		if s.Rsync {
+			localVersion := rsyncVersion()
+			remoteVersion, rsyncErr := s.Version()
 
-		if rsyncErr != nil {
-			clog.LogInfo("unable to determine remote rsync version: proceeding cautiously")
-		} else if localVersion != remoteVersion {
-			return xerrors.Errorf("rsync protocol mismatch: local = %s, remote = %s", localVersion, remoteVersion)
+			if rsyncErr != nil {
+				clog.LogInfo("unable to determine remote rsync version: proceeding cautiously")
+			} else if localVersion != remoteVersion {
+				return xerrors.Errorf("rsync protocol mismatch: local = %s, remote = %s", localVersion, remoteVersion)
+			}
 		}
 
 		for err == nil || err == sync.ErrRestartSync {
@@ -119,3 +205,41 @@ func makeRunSync(init *bool) func(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 }
+
+// runSyncConfig runs the syncs of a config file in one session.
+func runSyncConfig(cmd *cobra.Command, configPath string, init bool) error {
+	ctx := cmd.Context()
+	for _, name := range []string{"exclude", "include", "mode", "rsync"} {
+		if cmd.Flags().Changed(name) {
+			return xerrors.Errorf("--%s can't be used with --config: set it for each directory of the config file", name)
+		}
+	}
+
+	config, err := sync.ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if config.Workspace == "" {
+		return xerrors.Errorf("%s doesn't name a workspace", configPath)
+	}
+
+	client, err := newClient(ctx, true)
+	if err != nil {
+		return err
+	}
+	workspace, err := findWorkspace(ctx, client, config.Workspace, coder.Me)
+	if err != nil {
+		return err
+	}
+
+	s := sync.Session{
+		Config:              config,
+		Init:                init,
+		Workspace:           *workspace,
+		Client:              client,
+		OutW:                cmd.OutOrStdout(),
+		ErrW:                cmd.ErrOrStderr(),
+		IsInteractiveOutput: showInteractiveOutput,
+	}
+	return s.Run()
+}
@@ -7,7 +7,10 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"cdr.dev/slog"
@@ -21,18 +24,62 @@ import (
 	"cdr.dev/coder-cli/coder-sdk"
 	"cdr.dev/coder-cli/internal/x/xcobra"
 	"cdr.dev/coder-cli/pkg/clog"
+	"cdr.dev/coder-cli/pkg/tablewriter"
 	"cdr.dev/coder-cli/wsnet"
 )
 
 func tunnelCmd() *cobra.Command {
+	var (
+		udp            bool
+		udpIdleTimeout time.Duration
+		reverse        []string
+		socks5Addr     string
+		httpProxyAddr  string
+		unixLocal      string
+		unixRemote     string
+	)
 	cmd := &cobra.Command{
-		Use:   "tunnel [workspace_name] [workspace_port] [localhost_port]",
-		Args:  xcobra.ExactArgs(3),
-		Short: "proxies a port on the workspace to localhost",
-		Long:  "proxies a port on the workspace to localhost",
+		Use:   "tunnel [workspace_name] [workspace_port[:localhost_port][/tcp|/udp]...]",
+		Args:  xcobra.MinimumNArgs(1),
+		Short: "proxies ports on the workspace to localhost",
+		Long: `proxies ports on the workspace to localhost
+
+Each mapping forwards a workspace port to a local port. If the local port is
+omitted it defaults to the workspace port, and if it is already in use a free
+port is chosen instead. All mappings share a single connection to the workspace.
+
+For compatibility, two plain ports are treated as a single workspace port and
+localhost port pair, and a warning is printed if they differ. Use the
+"workspace_port:localhost_port" form instead.
+
+Reverse mappings bind a port inside the workspace and relay connections made to
+it back to a port on localhost.
+
+Traffic statistics for each workspace address are printed on exit, and when
+Ctrl-T is pressed on platforms that support SIGINFO.`,
 		Example: `# run a tcp tunnel from the workspace on port 3000 to localhost:3000
 
 coder tunnel my-dev 3000 3000
+
+# forward several ports over one connection, with 5432 on the workspace
+# available on localhost:15432
+coder tunnel my-dev 3000:3000 5432:15432 8080
+
+# relay udp datagrams from localhost:5353 to port 53 on the workspace
+coder tunnel my-dev 53:5353 --udp
+coder tunnel my-dev 53:5353/udp 8080
+
+# make localhost:27000 available to the workspace on port 27000
+coder tunnel my-dev --reverse 27000
+
+# run a SOCKS5 proxy on localhost:1080 that connects through the workspace
+coder tunnel my-dev --socks5 127.0.0.1:1080
+
+# run an HTTP proxy on localhost:8888 for tools that only support HTTP_PROXY
+coder tunnel my-dev --http-proxy 127.0.0.1:8888
+
+# make the workspace's docker socket available at ./docker.sock
+coder tunnel my-dev --unix-local ./docker.sock --unix-remote /var/run/docker.sock
 `,
 		Hidden: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -43,17 +90,51 @@ coder tunnel my-dev 3000 3000
 				log.Info(ctx, "debug logging enabled")
 			}
 
-			remotePort, err := strconv.ParseUint(args[1], 10, 16)
-			if err != nil {
-				return xerrors.Errorf("parse remote port: %w", err)
+			network := "tcp"
+			if udp {
+				network = "udp"
 			}
 
-			var localPort uint64
-			if args[2] != "stdio" {
-				localPort, err = strconv.ParseUint(args[2], 10, 16)
+			stdio := len(args) == 3 && args[2] == "stdio"
+			if udp && stdio {
+				return xerrors.New("stdio is not supported with --udp")
+			}
+			forwards, err := parsePortForwards(args[1:], network)
+			if err != nil {
+				return err
+			}
+			reverseForwards := make([]portForward, 0, len(reverse))
+			for _, raw := range reverse {
+				forward, err := parsePortForward(raw, "tcp")
+				if err != nil {
+					return err
+				}
+				if forward.Network != "tcp" {
+					return xerrors.Errorf("reverse mapping %q must use tcp", raw)
+				}
+				reverseForwards = append(reverseForwards, forward)
+			}
+			if (unixLocal == "") != (unixRemote == "") {
+				return xerrors.New("--unix-local and --unix-remote must be used together")
+			}
+			// The proxies aren't authenticated, so they only listen on every
+			// interface when asked to.
+			for _, addr := range []*string{&socks5Addr, &httpProxyAddr} {
+				if *addr == "" {
+					continue
+				}
+				listenAddr, err := proxyListenAddr(*addr)
 				if err != nil {
-					return xerrors.Errorf("parse local port: %w", err)
+					return err
 				}
+				*addr = listenAddr
+			}
+			hasProxy := socks5Addr != "" || httpProxyAddr != ""
+			if len(forwards) == 0 && len(reverseForwards) == 0 && !hasProxy && unixRemote == "" {
+				return xerrors.New("at least one port mapping, --reverse mapping, --unix-remote socket or proxy is required")
+			}
+			if stdio && (len(reverseForwards) > 0 || hasProxy || unixRemote != "") {
+				return xerrors.New("stdio is not supported with --reverse, --unix-remote or proxies")
 			}
 
 			sdk, err := newClient(ctx, false)
@@ -77,7 +158,7 @@ coder tunnel my-dev 3000 3000
 				// If we're attempting to forward our remote SSH port,
 				// we want to communicate with the OpenSSH protocol so
 				// SSH clients can properly display output to our users.
-				if remotePort == 12213 {
+				if stdio && forwards[0].RemotePort == 12213 {
 					rawKey, err := sdk.SSHKey(ctx)
 					if err != nil {
 						return xerrors.Errorf("get ssh key: %w", err)
@@ -99,14 +180,19 @@ coder tunnel my-dev 3000 3000
 			log.Debug(ctx, "got ICE servers", slog.F("ice", iceServers))
 
 			c := &tunnneler{
-				log:        log,
-				brokerAddr: &baseURL,
-				token:      sdk.Token(),
-				workspace:  workspace,
-				iceServers: iceServers,
-				stdio:      args[2] == "stdio",
-				localPort:  uint16(localPort),
-				remotePort: uint16(remotePort),
+				log:            log,
+				brokerAddr:     &baseURL,
+				token:          sdk.Token(),
+				workspace:      workspace,
+				iceServers:     iceServers,
+				stdio:          stdio,
+				forwards:       forwards,
+				reverse:        reverseForwards,
+				socks5Addr:     socks5Addr,
+				httpProxyAddr:  httpProxyAddr,
+				unixLocal:      unixLocal,
+				unixRemote:     unixRemote,
+				udpIdleTimeout: udpIdleTimeout,
 			}
 
 			err = c.start(ctx)
@@ -118,24 +204,142 @@ coder tunnel my-dev 3000 3000
 		},
 	}
 
+	cmd.Flags().BoolVar(&udp, "udp", false, "relay udp datagrams instead of tcp connections for mappings without a protocol")
+	cmd.Flags().DurationVar(&udpIdleTimeout, "udp-idle-timeout", time.Minute, "close udp sessions that have been idle for this long")
+	cmd.Flags().StringVar(&socks5Addr, "socks5", "", "run a SOCKS5 proxy on this local address that connects through the workspace, on 127.0.0.1 if no host is given")
+	cmd.Flags().StringVar(&httpProxyAddr, "http-proxy", "", "run an HTTP proxy on this local address that connects through the workspace, on 127.0.0.1 if no host is given")
+	cmd.Flags().StringVar(&unixLocal, "unix-local", "", "path of the local unix socket to forward to --unix-remote")
+	cmd.Flags().StringVar(&unixRemote, "unix-remote", "", "path of a unix socket inside the workspace to forward to --unix-local")
+	cmd.Flags().StringSliceVar(&reverse, "reverse", nil, "bind a port inside the workspace and relay connections to localhost (workspace_port[:localhost_port])")
 	return cmd
 }
 
+// portForward is a single workspace port forwarded to a local port.
+type portForward struct {
+	Network    string
+	RemotePort uint16
+	// LocalPort is the requested local port. Zero picks any free port.
+	LocalPort uint16
+}
+
+// parsePortForwards parses port mappings in the form
+// "workspace_port[:localhost_port][/tcp|/udp]". Mappings without a protocol
+// use the default network.
+//
+// Two plain ports are treated as the legacy "workspace_port localhost_port"
+// form, where the localhost port may also be "stdio". Since they could be meant
+// as two mappings, a warning is logged when the ports differ.
+func parsePortForwards(args []string, defaultNetwork string) ([]portForward, error) {
+	if len(args) == 2 && !strings.ContainsAny(args[0]+args[1], ":/") {
+		remotePort, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			return nil, xerrors.Errorf("parse remote port: %w", err)
+		}
+		var localPort uint64
+		if args[1] != "stdio" {
+			localPort, err = strconv.ParseUint(args[1], 10, 16)
+			if err != nil {
+				return nil, xerrors.Errorf("parse local port: %w", err)
+			}
+			if localPort != remotePort {
+				clog.LogWarn(
+					fmt.Sprintf("forwarding workspace port %d to localhost:%d", remotePort, localPort),
+					"Two plain ports are read as a workspace port and a localhost port.",
+					clog.Tipf("use \"%d:%d\" for this mapping, or \"%d %d:%d\" to forward both ports", remotePort, localPort, remotePort, localPort, localPort),
+				)
+			}
+		}
+		return []portForward{{
+			Network:    defaultNetwork,
+			RemotePort: uint16(remotePort),
+			LocalPort:  uint16(localPort),
+		}}, nil
+	}
+
+	forwards := make([]portForward, 0, len(args))
+	for _, arg := range args {
+		forward, err := parsePortForward(arg, defaultNetwork)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, forward)
+	}
+	return forwards, nil
+}
+
+func parsePortForward(raw, defaultNetwork string) (portForward, error) {
+	forward := portForward{
+		Network: defaultNetwork,
+	}
+
+	ports := raw
+	if i := strings.LastIndex(raw, "/"); i != -1 {
+		ports = raw[:i]
+		forward.Network = raw[i+1:]
+		if forward.Network != "tcp" && forward.Network != "udp" {
+			return portForward{}, xerrors.Errorf("invalid protocol %q in mapping %q: must be tcp or udp", forward.Network, raw)
+		}
+	}
+
+	parts := strings.SplitN(ports, ":", 2)
+	remotePort, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || remotePort == 0 {
+		return portForward{}, xerrors.Errorf("invalid workspace port in mapping %q", raw)
+	}
+	forward.RemotePort = uint16(remotePort)
+	forward.LocalPort = uint16(remotePort)
+	if len(parts) == 2 {
+		localPort, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return portForward{}, xerrors.Errorf("invalid localhost port in mapping %q", raw)
+		}
+		forward.LocalPort = uint16(localPort)
+	}
+	return forward, nil
+}
+
+// proxyListenAddr returns the address a proxy listens on, which is on
+// 127.0.0.1 if addr has no host.
+func proxyListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", xerrors.Errorf("invalid proxy address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// activeForward is a row in the table of active forwards printed to the user.
+type activeForward struct {
+	Direction        string `table:"Direction"`
+	Protocol         string `table:"Protocol"`
+	WorkspaceAddress string `table:"Workspace Address"`
+	LocalAddress     string `table:"Local Address"`
+}
+
 type tunnneler struct {
-	log        slog.Logger
-	brokerAddr *url.URL
-	token      string
-	workspace  *coder.Workspace
-	iceServers []webrtc.ICEServer
-	remotePort uint16
-	localPort  uint16
-	stdio      bool
+	log            slog.Logger
+	brokerAddr     *url.URL
+	token          string
+	workspace      *coder.Workspace
+	iceServers     []webrtc.ICEServer
+	forwards       []portForward
+	reverse        []portForward
+	socks5Addr     string
+	httpProxyAddr  string
+	unixLocal      string
+	unixRemote     string
+	stdio          bool
+	udpIdleTimeout time.Duration
 }
 
 func (c *tunnneler) start(ctx context.Context) error {
 	c.log.Debug(ctx, "Connecting to workspace...")
 
 	dialLog := c.log.Named("wsnet")
+	stats := newTunnelStats()
 	wd, err := wsnet.DialWebsocket(
 		ctx,
 		wsnet.ConnectEndpoint(c.brokerAddr, c.workspace.ID, c.token),
@@ -145,16 +349,22 @@ func (c *tunnneler) start(ctx context.Context) error {
 			TURNRemoteProxyURL: c.brokerAddr,
 			TURNLocalProxyURL:  c.brokerAddr,
 			ICEServers:         c.iceServers,
+			OnConnClosed:       stats.connClosed,
+			Multiplex:          true,
+			WebsocketFallback:  true,
+			OnGoAway: func(goAway wsnet.GoAway) {
+				fields := []slog.Field{slog.F("reason", goAway.Reason)}
+				if !goAway.Deadline.IsZero() {
+					fields = append(fields, slog.F("open_connections_close_in", time.Until(goAway.Deadline).Round(time.Second)))
+				}
+				c.log.Warn(ctx, "workspace agent is shutting down, new connections will be refused", fields...)
+			},
 		},
 		nil,
 	)
 	if err != nil {
 		return xerrors.Errorf("creating workspace dialer: %w", err)
 	}
-	nc, err := wd.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", c.remotePort))
-	if err != nil {
-		return err
-	}
 	c.log.Debug(ctx, "Connected to workspace!")
 
 	sdk, err := newClient(ctx, false)
@@ -180,6 +390,10 @@ func (c *tunnneler) start(ctx context.Context) error {
 
 	// proxy via stdio
 	if c.stdio {
+		nc, err := wd.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", c.forwards[0].RemotePort))
+		if err != nil {
+			return err
+		}
 		go func() {
 			_, _ = io.Copy(nc, os.Stdin)
 		}()
@@ -189,28 +403,229 @@ func (c *tunnneler) start(ctx context.Context) error {
 		}
 		return nil
 	}
-	// This was used to test if the port was open, and proxy over stdio
-	// if the user specified that.
-	_ = nc.Close()
 
-	// proxy via tcp listener
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", c.localPort))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		errCh  = make(chan error, len(c.forwards)+len(c.reverse)+3)
+		active = make([]activeForward, 0, len(c.forwards)+len(c.reverse))
+	)
+	for _, forward := range c.forwards {
+		forward := forward
+		remoteAddr := fmt.Sprintf("localhost:%d", forward.RemotePort)
+
+		if forward.Network == "udp" {
+			pc, err := c.listenPacket(ctx, forward.LocalPort)
+			if err != nil {
+				return err
+			}
+			defer pc.Close()
+			active = append(active, activeForward{
+				Direction:        "forward",
+				Protocol:         forward.Network,
+				WorkspaceAddress: remoteAddr,
+				LocalAddress:     pc.LocalAddr().String(),
+			})
+			go func() {
+				errCh <- c.relayUDP(ctx, wd, pc, remoteAddr)
+			}()
+			continue
+		}
+
+		listener, err := c.listen(ctx, forward.LocalPort)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		active = append(active, activeForward{
+			Direction:        "forward",
+			Protocol:         forward.Network,
+			WorkspaceAddress: remoteAddr,
+			LocalAddress:     listener.Addr().String(),
+		})
+		go func() {
+			errCh <- c.forwardConns(ctx, wd, listener, "tcp", remoteAddr)
+		}()
+	}
+	if c.unixRemote != "" {
+		listener, err := c.listenUnix(ctx, c.unixLocal)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		active = append(active, activeForward{
+			Direction:        "forward",
+			Protocol:         "unix",
+			WorkspaceAddress: c.unixRemote,
+			LocalAddress:     listener.Addr().String(),
+		})
+		go func() {
+			errCh <- c.forwardConns(ctx, wd, listener, "unix", c.unixRemote)
+		}()
+	}
+	for _, forward := range c.reverse {
+		localAddr := fmt.Sprintf("localhost:%d", forward.LocalPort)
+		listener, err := wd.Listen(ctx, forward.Network, fmt.Sprintf("localhost:%d", forward.RemotePort))
+		if err != nil {
+			return xerrors.Errorf("listen on workspace port %d: %w", forward.RemotePort, err)
+		}
+		defer listener.Close()
+		active = append(active, activeForward{
+			Direction:        "reverse",
+			Protocol:         forward.Network,
+			WorkspaceAddress: listener.Addr().String(),
+			LocalAddress:     localAddr,
+		})
+		go func() {
+			errCh <- c.forwardReverse(ctx, listener, localAddr)
+		}()
+	}
+
+	if c.socks5Addr != "" {
+		listener, err := net.Listen("tcp", c.socks5Addr)
+		if err != nil {
+			return xerrors.Errorf("listen for socks5: %w", err)
+		}
+		defer listener.Close()
+		active = append(active, activeForward{
+			Direction:        "socks5",
+			Protocol:         "tcp",
+			WorkspaceAddress: "*",
+			LocalAddress:     listener.Addr().String(),
+		})
+		socks := &socks5Server{
+			log:  c.log,
+			dial: wd.DialContext,
+		}
+		go func() {
+			errCh <- socks.serve(ctx, listener)
+		}()
+	}
+
+	if c.httpProxyAddr != "" {
+		listener, err := net.Listen("tcp", c.httpProxyAddr)
+		if err != nil {
+			return xerrors.Errorf("listen for http proxy: %w", err)
+		}
+		defer listener.Close()
+		active = append(active, activeForward{
+			Direction:        "http-proxy",
+			Protocol:         "tcp",
+			WorkspaceAddress: "*",
+			LocalAddress:     listener.Addr().String(),
+		})
+		proxy := newHTTPProxy(c.log, wd.DialContext)
+		go func() {
+			errCh <- proxy.serve(ctx, listener)
+		}()
+	}
+
+	err = tablewriter.WriteTable(os.Stdout, len(active), func(i int) interface{} {
+		return active[i]
+	})
+	if err != nil {
+		return xerrors.Errorf("write table: %w", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, statsSignals...)...)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case err := <-errCh:
+			c.writeStats(ctx, stats, wd)
+			return err
+		case sig := <-sigCh:
+			c.writeStats(ctx, stats, wd)
+			if sig == os.Interrupt || sig == syscall.SIGTERM {
+				return nil
+			}
+		}
+	}
+}
+
+// writeStats prints the traffic statistics of the dialer to stderr.
+func (c *tunnneler) writeStats(ctx context.Context, stats *tunnelStats, wd *wsnet.Dialer) {
+	_, _ = fmt.Fprintln(os.Stderr)
+	err := stats.write(os.Stderr, wd.Stats())
+	if err != nil {
+		c.log.Warn(ctx, "write traffic statistics", slog.Error(err))
+	}
+}
+
+// listen listens on the local tcp port provided, choosing a free port
+// instead if it cannot be bound.
+func (c *tunnneler) listen(ctx context.Context, port uint16) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err == nil || port == 0 {
+		return listener, err
+	}
+	c.log.Warn(ctx, "local port unavailable, choosing a free port", slog.F("port", port), slog.Error(err))
+	listener, err = net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, xerrors.Errorf("listen: %w", err)
+	}
+	return listener, nil
+}
+
+// listenPacket listens on the local udp port provided, choosing a free port
+// instead if it cannot be bound.
+func (c *tunnneler) listenPacket(ctx context.Context, port uint16) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", fmt.Sprintf("localhost:%d", port))
+	if err == nil || port == 0 {
+		return pc, err
+	}
+	c.log.Warn(ctx, "local port unavailable, choosing a free port", slog.F("port", port), slog.Error(err))
+	pc, err = net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		return nil, xerrors.Errorf("listen: %w", err)
+	}
+	return pc, nil
+}
+
+// listenUnix listens on the local unix socket path provided. A stale socket
+// left behind by a previous tunnel is removed first.
+func (c *tunnneler) listenUnix(ctx context.Context, socketPath string) (net.Listener, error) {
+	info, err := os.Lstat(socketPath)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", socketPath)
+		if err == nil {
+			_ = conn.Close()
+			return nil, xerrors.Errorf("unix socket %q is already in use", socketPath)
+		}
+		c.log.Debug(ctx, "removing stale unix socket", slog.F("path", socketPath))
+		err = os.Remove(socketPath)
+		if err != nil {
+			return nil, xerrors.Errorf("remove stale unix socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		return xerrors.Errorf("listen: %w", err)
+		return nil, xerrors.Errorf("listen: %w", err)
 	}
+	return listener, nil
+}
 
+// forwardConns proxies connections accepted by the listener to the remote
+// address on the workspace.
+func (c *tunnneler) forwardConns(ctx context.Context, wd *wsnet.Dialer, listener net.Listener, network, remoteAddr string) error {
 	for {
 		lc, err := listener.Accept()
 		if err != nil {
 			return xerrors.Errorf("accept: %w", err)
 		}
-		nc, err := wd.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", c.remotePort))
+		nc, err := wd.DialContext(ctx, network, remoteAddr)
 		if err != nil {
-			return err
+			c.log.Warn(ctx, "dial workspace", slog.F("remote_addr", remoteAddr), slog.Error(err))
+			_ = lc.Close()
+			continue
 		}
 		go func() {
 			defer func() {
 				_ = lc.Close()
+				_ = nc.Close()
 			}()
 
 			go func() {
@@ -221,6 +636,34 @@ func (c *tunnneler) start(ctx context.Context) error {
 	}
 }
 
+// forwardReverse proxies connections accepted inside the workspace to the
+// local address.
+func (c *tunnneler) forwardReverse(ctx context.Context, listener net.Listener, localAddr string) error {
+	for {
+		nc, err := listener.Accept()
+		if err != nil {
+			return xerrors.Errorf("accept: %w", err)
+		}
+		lc, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			c.log.Warn(ctx, "dial local address", slog.F("local_addr", localAddr), slog.Error(err))
+			_ = nc.Close()
+			continue
+		}
+		go func() {
+			defer func() {
+				_ = nc.Close()
+				_ = lc.Close()
+			}()
+
+			go func() {
+				_, _ = io.Copy(nc, lc)
+			}()
+			_, _ = io.Copy(lc, nc)
+		}()
+	}
+}
+
 // Used to treat stdio like a connection for proxying SSH.
 type stdioConn struct{}
 
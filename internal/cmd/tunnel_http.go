@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"cdr.dev/slog"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// hopHeaders are removed from proxied requests and responses.
+// See https://datatracker.ietf.org/doc/html/rfc7230#section-6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpProxyHeaderTimeout is how long a client of the HTTP proxy has to send
+// the headers of a request.
+const httpProxyHeaderTimeout = 10 * time.Second
+
+// httpProxy is an HTTP proxy that supports CONNECT tunnels and absolute-URI
+// forward proxying, with every connection dialed through a workspace.
+type httpProxy struct {
+	log       slog.Logger
+	dial      dialFunc
+	transport *http.Transport
+}
+
+func newHTTPProxy(log slog.Logger, dial dialFunc) *httpProxy {
+	return &httpProxy{
+		log:  log,
+		dial: dial,
+		transport: &http.Transport{
+			// Proxy is intentionally left nil so the workspace dialer is
+			// always used.
+			DialContext:         dial,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
+
+// serve serves proxy requests on the listener until it's closed.
+func (p *httpProxy) serve(ctx context.Context, listener net.Listener) error {
+	srv := &http.Server{
+		Handler: p,
+		// Hijacked CONNECT tunnels aren't affected by the timeout, it only
+		// stops clients from holding connections open without a request.
+		ReadHeaderTimeout: httpProxyHeaderTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	return srv.Serve(listener)
+}
+
+// ServeHTTP implements http.Handler.
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy server, requests must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+	p.forward(w, r)
+}
+
+// connect tunnels the client connection to the requested host.
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	ctx := slog.With(r.Context(), slog.F("addr", r.Host))
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	nc, err := p.dial(ctx, "tcp", r.Host)
+	if err != nil {
+		p.log.Debug(ctx, "http proxy dial failed", slog.Error(err))
+		http.Error(w, err.Error(), httpProxyStatus(err))
+		return
+	}
+	defer nc.Close()
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		p.log.Debug(ctx, "hijack connection", slog.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, nc)
+		_ = conn.Close()
+	}()
+	// The client may have sent data after the request that was already
+	// buffered by the server.
+	_, _ = io.Copy(nc, buf)
+}
+
+// forward proxies a plain HTTP request to the requested URL.
+func (p *httpProxy) forward(w http.ResponseWriter, r *http.Request) {
+	ctx := slog.With(r.Context(), slog.F("url", r.URL.String()))
+
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+
+	res, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		p.log.Debug(ctx, "http proxy request failed", slog.Error(err))
+		http.Error(w, err.Error(), httpProxyStatus(err))
+		return
+	}
+	defer res.Body.Close()
+
+	removeHopHeaders(res.Header)
+	for key, values := range res.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+func removeHopHeaders(header http.Header) {
+	// Headers listed in Connection are also hop-by-hop.
+	for _, value := range header.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(key))
+		}
+	}
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
+
+// httpProxyStatus maps an error from the workspace dialer to a status code.
+func httpProxyStatus(err error) int {
+	var dialErr *wsnet.DialError
+	if !errors.As(err, &dialErr) {
+		return http.StatusBadGateway
+	}
+	switch dialErr.Code {
+	case wsnet.CodePermissionErr:
+		return http.StatusForbidden
+	case wsnet.CodeBadAddressErr:
+		return http.StatusBadRequest
+	case wsnet.CodeDialErr:
+		if strings.Contains(dialErr.Error(), "i/o timeout") {
+			return http.StatusGatewayTimeout
+		}
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+func Test_httpProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	// start runs a proxy with the given dialer and returns its URL.
+	start := func(t *testing.T, dial dialFunc) *url.URL {
+		srv := httptest.NewServer(newHTTPProxy(slogtest.Make(t, nil), dial))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		assert.Success(t, "parse proxy url", err)
+		return u
+	}
+	var netDialer net.Dialer
+
+	t.Run("Forward", func(t *testing.T) {
+		var gotAddr string
+		proxyURL := start(t, func(ctx context.Context, network, address string) (net.Conn, error) {
+			gotAddr = address
+			return netDialer.DialContext(ctx, network, address)
+		})
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		res, err := client.Get(upstream.URL)
+		assert.Success(t, "get through proxy", err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		assert.Success(t, "read body", err)
+		assert.Equal(t, "body", "hello", string(body))
+		assert.Equal(t, "dialed address", upstream.Listener.Addr().String(), gotAddr)
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		proxyURL := start(t, netDialer.DialContext)
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		assert.Success(t, "dial proxy", err)
+		defer conn.Close()
+
+		addr := upstream.Listener.Addr().String()
+		_, err = conn.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+		assert.Success(t, "write connect", err)
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		assert.Success(t, "read connect response", err)
+		assert.Equal(t, "connect status", http.StatusOK, res.StatusCode)
+
+		req, err := http.NewRequest(http.MethodGet, upstream.URL, nil)
+		assert.Success(t, "create request", err)
+		err = req.Write(conn)
+		assert.Success(t, "write tunneled request", err)
+		res, err = http.ReadResponse(br, req)
+		assert.Success(t, "read tunneled response", err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		assert.Success(t, "read body", err)
+		assert.Equal(t, "body", "hello", string(body))
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		cases := []struct {
+			err    error
+			status int
+		}{
+			{
+				err:    &wsnet.DialError{Code: wsnet.CodePermissionErr, Err: errors.New("connections are not permitted")},
+				status: http.StatusForbidden,
+			},
+			{
+				err:    &wsnet.DialError{Code: wsnet.CodeDialErr, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connect: connection refused")}},
+				status: http.StatusBadGateway,
+			},
+			{
+				err:    &wsnet.DialError{Code: wsnet.CodeDialErr, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}},
+				status: http.StatusGatewayTimeout,
+			},
+		}
+		for _, c := range cases {
+			c := c
+			proxyURL := start(t, func(context.Context, string, string) (net.Conn, error) {
+				return nil, c.err
+			})
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			res, err := client.Get(upstream.URL)
+			assert.Success(t, "get through proxy", err)
+			_ = res.Body.Close()
+			assert.Equal(t, c.err.Error(), c.status, res.StatusCode)
+		}
+	})
+}
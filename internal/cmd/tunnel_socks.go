@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"cdr.dev/slog"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// SOCKS5 protocol constants. See RFC 1928.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUnacceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyNetworkUnreachable  = 0x03
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyConnectionRefused   = 0x05
+	socks5ReplyTTLExpired          = 0x06
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddrNotSupported    = 0x08
+)
+
+// dialFunc dials an address through the workspace.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// socks5Server is a minimal SOCKS5 server that sends unauthenticated CONNECT
+// requests through a workspace dialer.
+type socks5Server struct {
+	log  slog.Logger
+	dial dialFunc
+}
+
+// serve accepts SOCKS5 clients on the listener until it's closed.
+func (s *socks5Server) serve(ctx context.Context, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return xerrors.Errorf("accept: %w", err)
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *socks5Server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	addr, err := s.handshake(conn)
+	if err != nil {
+		s.log.Debug(ctx, "socks5 handshake failed", slog.F("client", conn.RemoteAddr().String()), slog.Error(err))
+		return
+	}
+
+	ctx = slog.With(ctx, slog.F("addr", addr))
+	nc, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		s.log.Debug(ctx, "socks5 dial failed", slog.Error(err))
+		_ = writeSOCKS5Reply(conn, socks5ReplyCode(err))
+		return
+	}
+	defer nc.Close()
+
+	err = writeSOCKS5Reply(conn, socks5ReplySucceeded)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, nc)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(nc, conn)
+}
+
+// handshake negotiates authentication and reads the CONNECT request,
+// returning the requested address.
+func (s *socks5Server) handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", xerrors.Errorf("read greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", xerrors.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", xerrors.Errorf("read auth methods: %w", err)
+	}
+	method := byte(socks5AuthUnacceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+			break
+		}
+	}
+	_, err = conn.Write([]byte{socks5Version, method})
+	if err != nil {
+		return "", xerrors.Errorf("write auth method: %w", err)
+	}
+	if method == socks5AuthUnacceptable {
+		return "", xerrors.New("client requires authentication")
+	}
+
+	request := make([]byte, 4)
+	_, err = io.ReadFull(conn, request)
+	if err != nil {
+		return "", xerrors.Errorf("read request: %w", err)
+	}
+	if request[0] != socks5Version {
+		return "", xerrors.Errorf("unsupported socks version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(conn, ip)
+		if err != nil {
+			return "", xerrors.Errorf("read ip: %w", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(conn, length)
+		if err != nil {
+			return "", xerrors.Errorf("read domain length: %w", err)
+		}
+		domain := make([]byte, length[0])
+		_, err = io.ReadFull(conn, domain)
+		if err != nil {
+			return "", xerrors.Errorf("read domain: %w", err)
+		}
+		host = string(domain)
+	default:
+		_ = writeSOCKS5Reply(conn, socks5ReplyAddrNotSupported)
+		return "", xerrors.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(conn, port)
+	if err != nil {
+		return "", xerrors.Errorf("read port: %w", err)
+	}
+
+	if request[1] != socks5CmdConnect {
+		_ = writeSOCKS5Reply(conn, socks5ReplyCommandNotSupported)
+		return "", xerrors.Errorf("unsupported command %d", request[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKS5Reply writes a reply with an empty bound address, since the
+// address bound inside the workspace isn't known.
+func writeSOCKS5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return fmt.Errorf("write reply: %w", err)
+	}
+	return nil
+}
+
+// socks5ReplyCode maps an error from the workspace dialer to a SOCKS5 reply.
+func socks5ReplyCode(err error) byte {
+	var dialErr *wsnet.DialError
+	if !errors.As(err, &dialErr) {
+		return socks5ReplyGeneralFailure
+	}
+	switch dialErr.Code {
+	case wsnet.CodePermissionErr:
+		return socks5ReplyNotAllowed
+	case wsnet.CodeBadAddressErr:
+		return socks5ReplyAddrNotSupported
+	case wsnet.CodeDialErr:
+		// The error only crosses the connection as a message, so the cause
+		// can't be inspected with errors.Is.
+		msg := dialErr.Error()
+		switch {
+		case strings.Contains(msg, "connection refused"):
+			return socks5ReplyConnectionRefused
+		case strings.Contains(msg, "network is unreachable"):
+			return socks5ReplyNetworkUnreachable
+		case strings.Contains(msg, "i/o timeout"):
+			return socks5ReplyTTLExpired
+		}
+		return socks5ReplyHostUnreachable
+	}
+	return socks5ReplyGeneralFailure
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+func Test_socks5Server(t *testing.T) {
+	// connect performs a SOCKS5 CONNECT to example.com:443 and returns the
+	// reply code.
+	connect := func(t *testing.T, dial dialFunc) (byte, net.Conn) {
+		client, server := net.Pipe()
+		s := &socks5Server{
+			log:  slogtest.Make(t, nil),
+			dial: dial,
+		}
+		go s.handle(context.Background(), server)
+
+		_, err := client.Write([]byte{socks5Version, 1, socks5AuthNone})
+		assert.Success(t, "write greeting", err)
+		method := make([]byte, 2)
+		_, err = io.ReadFull(client, method)
+		assert.Success(t, "read method", err)
+		assert.Equal(t, "auth method", []byte{socks5Version, socks5AuthNone}, method)
+
+		domain := "example.com"
+		req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, byte(len(domain))}
+		req = append(req, domain...)
+		req = append(req, 0x01, 0xbb)
+		_, err = client.Write(req)
+		assert.Success(t, "write request", err)
+
+		reply := make([]byte, 10)
+		_, err = io.ReadFull(client, reply)
+		assert.Success(t, "read reply", err)
+		return reply[1], client
+	}
+
+	t.Run("Connect", func(t *testing.T) {
+		remote, workspace := net.Pipe()
+		var gotAddr string
+		code, client := connect(t, func(_ context.Context, network, address string) (net.Conn, error) {
+			gotAddr = address
+			return workspace, nil
+		})
+		defer client.Close()
+		assert.Equal(t, "reply code", byte(socks5ReplySucceeded), code)
+		assert.Equal(t, "dialed address", "example.com:443", gotAddr)
+
+		go func() {
+			_, _ = remote.Write([]byte("hello"))
+		}()
+		rec := make([]byte, 5)
+		_, err := io.ReadFull(client, rec)
+		assert.Success(t, "read proxied data", err)
+		assert.Equal(t, "proxied data", "hello", string(rec))
+	})
+
+	t.Run("ReplyCodes", func(t *testing.T) {
+		cases := []struct {
+			err  error
+			code byte
+		}{
+			{
+				err:  &wsnet.DialError{Code: wsnet.CodePermissionErr, Err: errors.New("connections are not permitted")},
+				code: socks5ReplyNotAllowed,
+			},
+			{
+				err:  &wsnet.DialError{Code: wsnet.CodeDialErr, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connect: connection refused")}},
+				code: socks5ReplyConnectionRefused,
+			},
+			{
+				err:  &wsnet.DialError{Code: wsnet.CodeDialErr, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("lookup example.com: no such host")}},
+				code: socks5ReplyHostUnreachable,
+			},
+			{
+				err:  errors.New("wait for open: context canceled"),
+				code: socks5ReplyGeneralFailure,
+			},
+		}
+		for _, c := range cases {
+			c := c
+			code, client := connect(t, func(context.Context, string, string) (net.Conn, error) {
+				return nil, c.err
+			})
+			_ = client.Close()
+			assert.Equal(t, c.err.Error(), c.code, code)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"cdr.dev/coder-cli/pkg/tablewriter"
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// trafficRow is a row in the table of traffic statistics printed to the user.
+type trafficRow struct {
+	Protocol         string `table:"Protocol"`
+	WorkspaceAddress string `table:"Workspace Address"`
+	Open             int    `table:"Open"`
+	Total            uint64 `table:"Total"`
+	Failed           uint64 `table:"Failed"`
+	BytesIn          string `table:"Received"`
+	BytesOut         string `table:"Sent"`
+	Duration         string `table:"Connected For"`
+
+	bytesIn  uint64        `table:"-"`
+	bytesOut uint64        `table:"-"`
+	duration time.Duration `table:"-"`
+}
+
+// tunnelStats accumulates the traffic of closed connections by workspace
+// address, so it can be combined with the open connections of the dialer.
+type tunnelStats struct {
+	mut    sync.Mutex
+	closed map[string]*trafficRow
+}
+
+func newTunnelStats() *tunnelStats {
+	return &tunnelStats{
+		closed: make(map[string]*trafficRow),
+	}
+}
+
+// connClosed is passed to wsnet.DialOptions.OnConnClosed.
+func (s *tunnelStats) connClosed(stats wsnet.ConnStats) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	row := s.closed[stats.Network+" "+stats.Address]
+	if row == nil {
+		row = &trafficRow{
+			Protocol:         stats.Network,
+			WorkspaceAddress: stats.Address,
+		}
+		s.closed[stats.Network+" "+stats.Address] = row
+	}
+	row.Total++
+	if stats.ErrorCode != "" {
+		row.Failed++
+		return
+	}
+	row.bytesIn += stats.BytesRead
+	row.bytesOut += stats.BytesWritten
+	row.duration += stats.Duration()
+}
+
+// rows combines the closed connections with the open connections provided.
+// Rows are sorted by the bytes transferred, so the busiest address comes first.
+func (s *tunnelStats) rows(open []wsnet.ConnStats) []trafficRow {
+	s.mut.Lock()
+	rows := make(map[string]*trafficRow, len(s.closed))
+	for key, row := range s.closed {
+		row := *row
+		rows[key] = &row
+	}
+	s.mut.Unlock()
+
+	for _, stats := range open {
+		key := stats.Network + " " + stats.Address
+		row := rows[key]
+		if row == nil {
+			row = &trafficRow{
+				Protocol:         stats.Network,
+				WorkspaceAddress: stats.Address,
+			}
+			rows[key] = row
+		}
+		row.Open++
+		row.Total++
+		row.bytesIn += stats.BytesRead
+		row.bytesOut += stats.BytesWritten
+		row.duration += stats.Duration()
+	}
+
+	sorted := make([]trafficRow, 0, len(rows))
+	for _, row := range rows {
+		row.BytesIn = formatBytes(row.bytesIn)
+		row.BytesOut = formatBytes(row.bytesOut)
+		row.Duration = row.duration.Round(time.Second).String()
+		sorted = append(sorted, *row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].bytesIn+sorted[i].bytesOut, sorted[j].bytesIn+sorted[j].bytesOut
+		if a != b {
+			return a > b
+		}
+		return sorted[i].WorkspaceAddress < sorted[j].WorkspaceAddress
+	})
+	return sorted
+}
+
+// write prints the traffic of each workspace address and the totals.
+func (s *tunnelStats) write(w io.Writer, stats wsnet.Stats) error {
+	rows := s.rows(stats.Conns)
+	err := tablewriter.WriteTable(w, len(rows), func(i int) interface{} {
+		return rows[i]
+	})
+	if err != nil {
+		return err
+	}
+
+	var failed uint64
+	for _, count := range stats.DialErrors {
+		failed += count
+	}
+	_, err = fmt.Fprintf(w, "\n%d connections, %d open, %d failed, %s received, %s sent\n",
+		stats.ConnsOpened, len(stats.Conns), failed, formatBytes(stats.BytesRead), formatBytes(stats.BytesWritten))
+	if err != nil {
+		return err
+	}
+	for _, code := range []string{wsnet.CodePermissionErr, wsnet.CodeBadAddressErr, wsnet.CodeDialErr, wsnet.CodeGoingAwayErr} {
+		if stats.DialErrors[code] == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(w, "  %s: %d\n", code, stats.DialErrors[code])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,13 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// statsSignals print traffic statistics for coder tunnel. SIGINFO is sent
+// by the terminal when Ctrl-T is pressed.
+var statsSignals = []os.Signal{syscall.SIGINFO}
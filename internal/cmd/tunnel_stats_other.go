@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package cmd
+
+import "os"
+
+// statsSignals print traffic statistics for coder tunnel. This platform has
+// no SIGINFO, so statistics are only printed on exit.
+var statsSignals []os.Signal
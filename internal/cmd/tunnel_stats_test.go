@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+func Test_tunnelStats(t *testing.T) {
+	now := time.Now()
+	stats := newTunnelStats()
+	stats.connClosed(wsnet.ConnStats{Network: "tcp", Address: "localhost:8080", BytesRead: 100, BytesWritten: 10, OpenedAt: now.Add(-time.Second), ClosedAt: now})
+	stats.connClosed(wsnet.ConnStats{Network: "tcp", Address: "localhost:8080", OpenedAt: now, ClosedAt: now, ErrorCode: wsnet.CodeDialErr})
+	stats.connClosed(wsnet.ConnStats{Network: "tcp", Address: "localhost:5432", BytesRead: 5, OpenedAt: now, ClosedAt: now})
+
+	rows := stats.rows([]wsnet.ConnStats{
+		{Network: "tcp", Address: "localhost:5432", BytesRead: 4096, OpenedAt: now},
+	})
+	assert.Equal(t, "rows", 2, len(rows))
+	assert.Equal(t, "busiest address", "localhost:5432", rows[0].WorkspaceAddress)
+	assert.Equal(t, "open", 1, rows[0].Open)
+	assert.Equal(t, "total", uint64(2), rows[0].Total)
+	assert.Equal(t, "received", "4.0 KiB", rows[0].BytesIn)
+	assert.Equal(t, "failed", uint64(1), rows[1].Failed)
+	assert.Equal(t, "received", "100 B", rows[1].BytesIn)
+
+	var buf bytes.Buffer
+	err := stats.write(&buf, wsnet.Stats{
+		ConnsOpened: 3,
+		DialErrors:  map[string]uint64{wsnet.CodeDialErr: 1, wsnet.CodeGoingAwayErr: 2},
+	})
+	assert.Success(t, "write stats", err)
+	assert.True(t, "summary", bytes.Contains(buf.Bytes(), []byte("3 connections, 0 open, 3 failed")))
+	assert.True(t, "dial errors", bytes.Contains(buf.Bytes(), []byte("dial_error: 1")))
+	assert.True(t, "going away errors", bytes.Contains(buf.Bytes(), []byte("going_away_error: 2")))
+}
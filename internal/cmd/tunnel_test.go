@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/coder-cli/pkg/clog"
+)
+
+func Test_parsePortForwards(t *testing.T) {
+	cases := []struct {
+		args     []string
+		network  string
+		expected []portForward
+		err      bool
+		// warn sets whether the legacy pair form is warned about.
+		warn bool
+	}{
+		{
+			args:     []string{"3000", "3000"},
+			network:  "tcp",
+			expected: []portForward{{Network: "tcp", RemotePort: 3000, LocalPort: 3000}},
+		},
+		{
+			args:     []string{"3000", "8080"},
+			network:  "tcp",
+			expected: []portForward{{Network: "tcp", RemotePort: 3000, LocalPort: 8080}},
+			warn:     true,
+		},
+		{
+			args:     []string{"12213", "stdio"},
+			network:  "tcp",
+			expected: []portForward{{Network: "tcp", RemotePort: 12213, LocalPort: 0}},
+		},
+		{
+			args:     []string{"53", "5353"},
+			network:  "udp",
+			expected: []portForward{{Network: "udp", RemotePort: 53, LocalPort: 5353}},
+			warn:     true,
+		},
+		{
+			args:    []string{"3000:3000", "5432:15432", "8080"},
+			network: "tcp",
+			expected: []portForward{
+				{Network: "tcp", RemotePort: 3000, LocalPort: 3000},
+				{Network: "tcp", RemotePort: 5432, LocalPort: 15432},
+				{Network: "tcp", RemotePort: 8080, LocalPort: 8080},
+			},
+		},
+		{
+			args:    []string{"53:5353/udp", "8080/tcp", "9000"},
+			network: "tcp",
+			expected: []portForward{
+				{Network: "udp", RemotePort: 53, LocalPort: 5353},
+				{Network: "tcp", RemotePort: 8080, LocalPort: 8080},
+				{Network: "tcp", RemotePort: 9000, LocalPort: 9000},
+			},
+		},
+		{
+			args:    []string{"8080"},
+			network: "tcp",
+			expected: []portForward{
+				{Network: "tcp", RemotePort: 8080, LocalPort: 8080},
+			},
+		},
+		{args: []string{"asdf", "3000"}, network: "tcp", err: true},
+		{args: []string{"3000:asdf"}, network: "tcp", err: true},
+		{args: []string{"0:3000"}, network: "tcp", err: true},
+		{args: []string{"70000:3000"}, network: "tcp", err: true},
+		{args: []string{"3000/sctp"}, network: "tcp", err: true},
+	}
+
+	var logs bytes.Buffer
+	clog.SetOutput(&logs)
+	defer clog.SetOutput(os.Stderr)
+	for i, c := range cases {
+		amsg := fmt.Sprintf("case %v %q: ", i, c.args)
+		logs.Reset()
+		forwards, err := parsePortForwards(c.args, c.network)
+		if c.err {
+			assert.Error(t, amsg+"parsed invalid mapping", err)
+			continue
+		}
+		assert.Success(t, amsg+"parse mappings", err)
+		assert.Equal(t, amsg+"mappings equal", c.expected, forwards)
+		assert.Equal(t, amsg+"warned", c.warn, strings.Contains(logs.String(), "warning"))
+	}
+}
+
+func Test_proxyListenAddr(t *testing.T) {
+	cases := []struct {
+		addr     string
+		expected string
+		err      bool
+	}{
+		{addr: ":8888", expected: "127.0.0.1:8888"},
+		{addr: "127.0.0.1:1080", expected: "127.0.0.1:1080"},
+		{addr: "0.0.0.0:1080", expected: "0.0.0.0:1080"},
+		{addr: "[::1]:1080", expected: "[::1]:1080"},
+		{addr: "8888", err: true},
+	}
+
+	for i, c := range cases {
+		amsg := fmt.Sprintf("case %v %q: ", i, c.addr)
+		addr, err := proxyListenAddr(c.addr)
+		if c.err {
+			assert.Error(t, amsg+"parsed invalid address", err)
+			continue
+		}
+		assert.Success(t, amsg+"parse address", err)
+		assert.Equal(t, amsg+"address", c.expected, addr)
+	}
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cdr.dev/slog"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// maxDatagramSize is the largest UDP payload we'll read from either side of
+// the relay.
+const maxDatagramSize = 64 * 1024
+
+// maxRelayedDatagramSize is the largest datagram that fits in a single message
+// on a wsnet data channel. Larger datagrams from clients are dropped.
+const maxRelayedDatagramSize = 32 * 1024
+
+// udpQueueSize is how many datagrams from a client are queued while its data
+// channel is dialed or written to. Datagrams past it are dropped.
+const udpQueueSize = 64
+
+// udpSession relays datagrams between a single local client address and a
+// data channel to the workspace.
+type udpSession struct {
+	addr net.Addr
+	// ctx is canceled when the session is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// datagrams are the datagrams from the client to write to the data
+	// channel, which is dialed in the background so the relay keeps reading
+	// for other clients.
+	datagrams chan []byte
+	// lastActive is a unix nano timestamp of the last datagram sent or
+	// received through the session.
+	lastActive int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// udpRelay forwards datagrams received on a local packet listener to the
+// workspace. Since UDP is connectionless, a session with its own data channel
+// is tracked for each client address and closed after it has been idle.
+type udpRelay struct {
+	log         slog.Logger
+	dial        dialFunc
+	pc          net.PacketConn
+	remoteAddr  string
+	idleTimeout time.Duration
+
+	sessionsMut sync.Mutex
+	sessions    map[string]*udpSession
+}
+
+// relayUDP relays datagrams received on the packet conn to the remote address
+// on the workspace until the context is canceled.
+func (c *tunnneler) relayUDP(ctx context.Context, wd *wsnet.Dialer, pc net.PacketConn, remoteAddr string) error {
+	r := &udpRelay{
+		log:         c.log,
+		dial:        wd.DialContext,
+		pc:          pc,
+		remoteAddr:  remoteAddr,
+		idleTimeout: c.udpIdleTimeout,
+		sessions:    make(map[string]*udpSession),
+	}
+	return r.serve(ctx)
+}
+
+func (r *udpRelay) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer r.closeAll()
+	go r.reapIdle(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = r.pc.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return xerrors.Errorf("read datagram: %w", err)
+		}
+
+		if n > maxRelayedDatagramSize {
+			r.log.Debug(ctx, "dropping datagram too large to relay", slog.F("client", addr.String()), slog.F("size", n))
+			continue
+		}
+		sess := r.session(ctx, addr)
+		sess.touch()
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		select {
+		case sess.datagrams <- datagram:
+		default:
+			r.log.Debug(ctx, "udp session is backed up, dropping datagram", slog.F("client", addr.String()))
+		}
+	}
+}
+
+// session returns the session for the client address provided, starting a new
+// one if it doesn't exist.
+func (r *udpRelay) session(ctx context.Context, addr net.Addr) *udpSession {
+	key := addr.String()
+	r.sessionsMut.Lock()
+	defer r.sessionsMut.Unlock()
+	sess, ok := r.sessions[key]
+	if ok {
+		return sess
+	}
+
+	sess = &udpSession{
+		addr:      addr,
+		datagrams: make(chan []byte, udpQueueSize),
+	}
+	sess.ctx, sess.cancel = context.WithCancel(ctx)
+	sess.touch()
+	r.sessions[key] = sess
+	go r.relaySession(key, sess)
+	return sess
+}
+
+// relaySession dials the data channel of the session and relays datagrams
+// through it until the session is closed.
+func (r *udpRelay) relaySession(key string, sess *udpSession) {
+	ctx := sess.ctx
+	defer r.closeSession(key, sess)
+	conn, err := r.dial(ctx, "udp", r.remoteAddr)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.log.Warn(ctx, "open udp session", slog.F("client", key), slog.Error(err))
+		}
+		return
+	}
+	defer conn.Close()
+	r.log.Debug(ctx, "opened udp session", slog.F("client", key))
+
+	go func() {
+		defer r.closeSession(key, sess)
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			sess.touch()
+			_, err = r.pc.WriteTo(buf[:n], sess.addr)
+			if err != nil {
+				r.log.Debug(ctx, "write datagram to client", slog.F("client", key), slog.Error(err))
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case datagram := <-sess.datagrams:
+			_, err = conn.Write(datagram)
+			if err != nil {
+				r.log.Debug(ctx, "write datagram to workspace", slog.F("client", key), slog.Error(err))
+				return
+			}
+		}
+	}
+}
+
+// reapIdle closes sessions that haven't sent or received a datagram within
+// the idle timeout.
+func (r *udpRelay) reapIdle(ctx context.Context) {
+	interval := r.idleTimeout / 2
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.sessionsMut.Lock()
+		idle := make(map[string]*udpSession)
+		for key, sess := range r.sessions {
+			if sess.idleSince() >= r.idleTimeout {
+				idle[key] = sess
+			}
+		}
+		r.sessionsMut.Unlock()
+		for key, sess := range idle {
+			r.log.Debug(ctx, "closing idle udp session", slog.F("client", key))
+			r.closeSession(key, sess)
+		}
+	}
+}
+
+// closeSession closes the session provided and stops tracking it if it's still
+// the session for the client address.
+func (r *udpRelay) closeSession(key string, sess *udpSession) {
+	r.sessionsMut.Lock()
+	if r.sessions[key] == sess {
+		delete(r.sessions, key)
+	}
+	r.sessionsMut.Unlock()
+	sess.cancel()
+}
+
+func (r *udpRelay) closeAll() {
+	r.sessionsMut.Lock()
+	defer r.sessionsMut.Unlock()
+	for key, sess := range r.sessions {
+		sess.cancel()
+		delete(r.sessions, key)
+	}
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cdr.dev/slog"
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+// messageLimitConn fails writes larger than a wsnet data channel message, like
+// the data channels the relay dials.
+type messageLimitConn struct {
+	net.Conn
+}
+
+func (c messageLimitConn) Write(b []byte) (int, error) {
+	if len(b) > maxRelayedDatagramSize {
+		return 0, errors.New("outbound packet larger than maximum message size")
+	}
+	return c.Conn.Write(b)
+}
+
+func Test_udpRelay(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Success(t, "listen", err)
+
+	// The first client's data channel takes until release is closed to dial.
+	var (
+		dials   int32
+		dialed  = make(chan struct{}, 2)
+		release = make(chan struct{})
+	)
+	r := &udpRelay{
+		// Sessions may log after the test finishes.
+		log: slog.Make(),
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- struct{}{}
+			if atomic.AddInt32(&dials, 1) == 1 {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			conn, workspace := net.Pipe()
+			go func() {
+				buf := make([]byte, maxDatagramSize)
+				for {
+					n, err := workspace.Read(buf)
+					if err != nil {
+						return
+					}
+					_, err = workspace.Write(buf[:n])
+					if err != nil {
+						return
+					}
+				}
+			}()
+			return messageLimitConn{conn}, nil
+		},
+		pc:         pc,
+		remoteAddr: "localhost:53",
+		sessions:   make(map[string]*udpSession),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = r.serve(ctx)
+	}()
+
+	client := func(t *testing.T) net.Conn {
+		conn, err := net.Dial("udp", pc.LocalAddr().String())
+		assert.Success(t, "dial relay", err)
+		return conn
+	}
+	read := func(t *testing.T, conn net.Conn) string {
+		err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.Success(t, "set deadline", err)
+		buf := make([]byte, maxDatagramSize)
+		n, err := conn.Read(buf)
+		assert.Success(t, "read datagram", err)
+		return string(buf[:n])
+	}
+
+	slow := client(t)
+	defer slow.Close()
+	_, err = slow.Write([]byte("first"))
+	assert.Success(t, "write datagram", err)
+	_, err = slow.Write([]byte("second"))
+	assert.Success(t, "write datagram", err)
+	<-dialed
+
+	// Other clients are relayed while a data channel is dialed.
+	fast := client(t)
+	defer fast.Close()
+	_, err = fast.Write([]byte("fast"))
+	assert.Success(t, "write datagram", err)
+	assert.Equal(t, "echoed datagram", "fast", read(t, fast))
+
+	// Datagrams too large for a data channel don't end the session.
+	_, err = fast.Write(make([]byte, maxRelayedDatagramSize+1))
+	assert.Success(t, "write large datagram", err)
+	_, err = fast.Write([]byte("after"))
+	assert.Success(t, "write datagram", err)
+	assert.Equal(t, "echoed datagram", "after", read(t, fast))
+
+	// Datagrams sent during the dial are queued.
+	close(release)
+	assert.Equal(t, "echoed datagram", "first", read(t, slow))
+	assert.Equal(t, "echoed datagram", "second", read(t, slow))
+}
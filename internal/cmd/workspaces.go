@@ -9,7 +9,9 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"nhooyr.io/websocket"
@@ -138,18 +140,35 @@ func lsWorkspacesCommand() *cobra.Command {
 
 func pingWorkspaceCommand() *cobra.Command {
 	var (
-		schemes []string
-		count   int
+		schemes    []string
+		count      int
+		throughput bool
+		loss       bool
+		duration   time.Duration
+		outputFmt  string
 	)
 
 	cmd := &cobra.Command{
-		Use:     "ping <workspace_name>",
-		Short:   "ping Coder workspaces by name",
-		Long:    "ping Coder workspaces by name",
-		Example: `coder workspaces ping front-end-workspace`,
-		Args:    xcobra.ExactArgs(1),
+		Use:   "ping <workspace_name>",
+		Short: "ping Coder workspaces by name",
+		Long:  "Ping Coder workspaces by name. Statistics are printed on exit, like ping(8). With --output json, a JSON record is written per probe, followed by the statistics.",
+		Example: `coder workspaces ping front-end-workspace
+coder workspaces ping front-end-workspace --throughput --loss
+
+# record 60 probes as JSON lines
+coder workspaces ping front-end-workspace --count 60 --output json >> ping.jsonl`,
+		Args: xcobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
+			switch outputFmt {
+			case humanOutput, jsonOutput:
+			default:
+				return xerrors.Errorf("%q is not a supported value for --output", outputFmt)
+			}
+			if outputFmt == jsonOutput && (throughput || loss) {
+				return xerrors.New("--output json is not supported with --throughput or --loss")
+			}
+
 			client, err := newClient(ctx, true)
 			if err != nil {
 				return err
@@ -172,30 +191,68 @@ func pingWorkspaceCommand() *cobra.Command {
 				client:     client,
 				workspace:  workspace,
 				iceSchemes: iceSchemes,
+				out:        cmd.OutOrStdout(),
+			}
+			if outputFmt == jsonOutput {
+				// Keep stdout parseable.
+				pinger.out = cmd.ErrOrStderr()
+			}
+			if throughput || loss {
+				return pinger.measure(ctx, throughput, loss, duration)
 			}
 
-			seq := 0
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigCh)
+
+			stats := &pingStats{}
+			enc := json.NewEncoder(cmd.OutOrStdout())
 			ticker := time.NewTicker(time.Second)
-			for {
+			defer ticker.Stop()
+		loop:
+			for count <= 0 || stats.sent < count {
 				select {
 				case <-ticker.C:
-					err := pinger.ping(ctx)
+				case <-sigCh:
+					break loop
+				case <-ctx.Done():
+					break loop
+				}
+				probe, err := pinger.ping(ctx)
+				if err != nil {
+					return err
+				}
+				stats.add(probe)
+				if outputFmt == jsonOutput {
+					err = enc.Encode(probe)
 					if err != nil {
-						return err
+						return xerrors.Errorf("write probe as JSON: %w", err)
 					}
-					seq++
-					if count > 0 && seq >= count {
-						os.Exit(0)
-					}
-				case <-ctx.Done():
-					return nil
 				}
 			}
+
+			summary := stats.summary(workspace.Name)
+			if outputFmt == jsonOutput {
+				err = enc.Encode(summary)
+				if err != nil {
+					return xerrors.Errorf("write statistics as JSON: %w", err)
+				}
+			} else {
+				summary.write(cmd.OutOrStdout())
+			}
+			if summary.Sent > 0 && summary.Received == 0 {
+				return xerrors.Errorf("no response from workspace %q", workspace.Name)
+			}
+			return nil
 		},
 	}
 
 	cmd.Flags().StringSliceVarP(&schemes, "scheme", "s", []string{"stun", "stuns", "turn", "turns"}, "customize schemes to filter ice servers")
-	cmd.Flags().IntVarP(&count, "count", "c", 0, "stop after <count> replies")
+	cmd.Flags().IntVarP(&count, "count", "c", 0, "stop after <count> probes")
+	cmd.Flags().BoolVar(&throughput, "throughput", false, "measure upload and download throughput over direct and relayed connections")
+	cmd.Flags().BoolVar(&loss, "loss", false, "measure packet loss and jitter over direct and relayed connections")
+	cmd.Flags().DurationVar(&duration, "duration", 5*time.Second, "duration of each throughput and loss measurement")
+	cmd.Flags().StringVarP(&outputFmt, "output", "o", humanOutput, "human | json")
 	return cmd
 }
 
@@ -204,132 +261,312 @@ type wsPinger struct {
 	workspace  *coder.Workspace
 	dialer     *wsnet.Dialer
 	iceSchemes map[ice.SchemeType]interface{}
-	tunneled   bool
+	// out is where progress is written for humans.
+	out io.Writer
+	// candidateType is the type of the local ICE candidate of the dialer, or
+	// "websocket" if it fell back to one.
+	candidateType string
+	tunneled      bool
+	seq           int
 }
 
-func (*wsPinger) logFail(msg string) {
-	fmt.Printf("%s: %s\n", color.New(color.Bold, color.FgRed).Sprint("——"), msg)
+func (w *wsPinger) logFail(msg string) {
+	_, _ = fmt.Fprintf(w.out, "%s: %s\n", color.New(color.Bold, color.FgRed).Sprint("——"), msg)
 }
 
-func (*wsPinger) logSuccess(timeStr, msg string) {
-	fmt.Printf("%s: %s\n", color.New(color.Bold, color.FgGreen).Sprint(timeStr), msg)
+func (w *wsPinger) logSuccess(timeStr, msg string) {
+	_, _ = fmt.Fprintf(w.out, "%s: %s\n", color.New(color.Bold, color.FgGreen).Sprint(timeStr), msg)
 }
 
-// Only return fatal errors.
-func (w *wsPinger) ping(ctx context.Context) error {
-	ctx, cancelFunc := context.WithTimeout(ctx, time.Second*15)
-	defer cancelFunc()
+// ping sends a probe to the workspace, connecting first if there's no
+// connection. Failed probes are returned with an error message. Only return
+// fatal errors.
+func (w *wsPinger) ping(ctx context.Context) (pingProbe, error) {
 	url := w.client.BaseURL()
+	w.seq++
+	probe := pingProbe{
+		Type:      pingProbeRecord,
+		Time:      time.Now(),
+		Workspace: w.workspace.Name,
+		Seq:       w.seq,
+	}
+	fail := func(msg string) (pingProbe, error) {
+		w.logFail(msg)
+		probe.Error = msg
+		return probe, nil
+	}
 
 	// If the dialer is nil we create a new!
-	// nolint:nestif
 	if w.dialer == nil {
+		// Leave time to fall back to a websocket if WebRTC can't connect.
+		ctx, cancelFunc := context.WithTimeout(ctx, time.Second*30)
+		defer cancelFunc()
 		servers, err := w.client.ICEServers(ctx)
 		if err != nil {
-			w.logFail(fmt.Sprintf("list ice servers: %s", err.Error()))
-			return nil
+			return fail(fmt.Sprintf("list ice servers: %s", err.Error()))
 		}
-		filteredServers := make([]webrtc.ICEServer, 0, len(servers))
-		for _, server := range servers {
-			good := true
-			for _, rawURL := range server.URLs {
-				url, err := ice.ParseURL(rawURL)
-				if err != nil {
-					return fmt.Errorf("parse url %q: %w", rawURL, err)
-				}
-				if _, ok := w.iceSchemes[url.Scheme]; !ok {
-					good = false
-				}
-			}
-			if good {
-				filteredServers = append(filteredServers, server)
-			}
+		filteredServers, err := filterICEServers(servers, w.iceSchemes)
+		if err != nil {
+			return probe, err
 		}
 		if len(filteredServers) == 0 {
 			schemes := make([]string, 0)
 			for scheme := range w.iceSchemes {
 				schemes = append(schemes, scheme.String())
 			}
-			return fmt.Errorf("no ice servers match the schemes provided: %s", strings.Join(schemes, ","))
+			return probe, fmt.Errorf("no ice servers match the schemes provided: %s", strings.Join(schemes, ","))
 		}
-		workspace, err := w.client.WorkspaceByID(ctx, w.workspace.ID)
+		failure, err := w.connect(ctx, filteredServers, true)
 		if err != nil {
-			return err
+			return probe, err
 		}
-		if workspace.LatestStat.ContainerStatus != coder.WorkspaceOn {
-			w.logFail(fmt.Sprintf("workspace is unreachable (status=%s)", workspace.LatestStat.ContainerStatus))
-			return nil
+		if failure != "" {
+			return fail(failure)
 		}
-		connectStart := time.Now()
-		w.dialer, err = wsnet.DialWebsocket(ctx, wsnet.ConnectEndpoint(&url, w.workspace.ID, w.client.Token()), &wsnet.DialOptions{
-			ICEServers:         filteredServers,
-			TURNProxyAuthToken: w.client.Token(),
-			TURNRemoteProxyURL: &url,
-			TURNLocalProxyURL:  &url,
-		}, &websocket.DialOptions{})
-		if err != nil {
-			w.logFail(fmt.Sprintf("dial workspace: %s", err.Error()))
-			return nil
-		}
-		connectMS := float64(time.Since(connectStart).Microseconds()) / 1000
+	}
+	probe.CandidateType = w.candidateType
+	probe.Tunneled = w.tunneled
 
-		candidates, err := w.dialer.Candidates()
-		if err != nil {
-			return err
+	ctx, cancelFunc := context.WithTimeout(ctx, time.Second*15)
+	defer cancelFunc()
+	pingStart := time.Now()
+	err := w.dialer.Ping(ctx)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			w.dialer = nil
+			return fail("connection timed out")
 		}
-		isRelaying := candidates.Local.Typ == webrtc.ICECandidateTypeRelay
-		w.tunneled = false
-		candidateURLs := []string{}
-
-		for _, server := range filteredServers {
-			if server.Username == wsnet.TURNProxyICECandidate().Username {
-				candidateURLs = append(candidateURLs, fmt.Sprintf("turn:%s", url.Host))
-				if !isRelaying {
-					continue
-				}
-				w.tunneled = true
-				continue
-			}
-
-			candidateURLs = append(candidateURLs, server.URLs...)
+		if errors.Is(err, webrtc.ErrConnectionClosed) {
+			w.dialer = nil
+			return fail("webrtc connection is closed")
 		}
+		return probe, fmt.Errorf("ping workspace: %w", err)
+	}
+	rtt := time.Since(pingStart)
+	probe.RTTMS = durationMS(rtt)
+	connectionText := "you ↔ workspace"
+	if w.tunneled {
+		connectionText = fmt.Sprintf("you ↔ %s ↔ workspace", url.Host)
+	}
+	w.logSuccess(fmt.Sprintf("%.2fms", probe.RTTMS), connectionText)
+	return probe, nil
+}
 
-		connectionText := "direct via STUN"
-		if isRelaying {
-			connectionText = "proxied via TURN"
+// filterICEServers returns the servers with only URLs of the schemes provided.
+func filterICEServers(servers []webrtc.ICEServer, schemes map[ice.SchemeType]interface{}) ([]webrtc.ICEServer, error) {
+	filteredServers := make([]webrtc.ICEServer, 0, len(servers))
+	for _, server := range servers {
+		good := true
+		for _, rawURL := range server.URLs {
+			url, err := ice.ParseURL(rawURL)
+			if err != nil {
+				return nil, fmt.Errorf("parse url %q: %w", rawURL, err)
+			}
+			if _, ok := schemes[url.Scheme]; !ok {
+				good = false
+			}
 		}
-		if w.tunneled {
-			connectionText = fmt.Sprintf("proxied via %s", url.Host)
+		if good {
+			filteredServers = append(filteredServers, server)
 		}
+	}
+	return filteredServers, nil
+}
+
+// connect dials the workspace with the servers provided, falling back to a
+// websocket through Coder if WebRTC can't connect and fallback is set. If the
+// workspace is unreachable, the dialer is left nil and why is returned. Only
+// return fatal errors.
+func (w *wsPinger) connect(ctx context.Context, servers []webrtc.ICEServer, fallback bool) (string, error) {
+	url := w.client.BaseURL()
+	workspace, err := w.client.WorkspaceByID(ctx, w.workspace.ID)
+	if err != nil {
+		return "", err
+	}
+	if workspace.LatestStat.ContainerStatus != coder.WorkspaceOn {
+		return fmt.Sprintf("workspace is unreachable (status=%s)", workspace.LatestStat.ContainerStatus), nil
+	}
+	connectStart := time.Now()
+	dialer, err := wsnet.DialWebsocket(ctx, wsnet.ConnectEndpoint(&url, w.workspace.ID, w.client.Token()), &wsnet.DialOptions{
+		ICEServers:         servers,
+		TURNProxyAuthToken: w.client.Token(),
+		TURNRemoteProxyURL: &url,
+		TURNLocalProxyURL:  &url,
+		WebsocketFallback:  fallback,
+	}, &websocket.DialOptions{})
+	if err != nil {
+		return fmt.Sprintf("dial workspace: %s", err.Error()), nil
+	}
+	connectMS := durationMS(time.Since(connectStart))
+
+	if dialer.Transport() == wsnet.TransportWebsocket {
+		w.dialer = dialer
+		w.candidateType = string(wsnet.TransportWebsocket)
+		w.tunneled = true
 		w.logSuccess("——", fmt.Sprintf(
-			"connected in %.2fms (%s) candidates=%s",
+			"connected in %.2fms (websocket via %s, webrtc unavailable)",
 			connectMS,
-			connectionText,
-			strings.Join(candidateURLs, ","),
+			url.Host,
 		))
+		return "", nil
 	}
 
-	pingStart := time.Now()
-	err := w.dialer.Ping(ctx)
+	candidates, err := dialer.Candidates()
 	if err != nil {
-		if errors.Is(err, io.EOF) {
-			w.dialer = nil
-			w.logFail("connection timed out")
+		_ = dialer.Close()
+		return "", err
+	}
+	w.dialer = dialer
+	w.candidateType = candidates.Local.Typ.String()
+	isRelaying := candidates.Local.Typ == webrtc.ICECandidateTypeRelay
+	w.tunneled = false
+	candidateURLs := []string{}
+
+	for _, server := range servers {
+		if server.Username == wsnet.TURNProxyICECandidate().Username {
+			candidateURLs = append(candidateURLs, fmt.Sprintf("turn:%s", url.Host))
+			if !isRelaying {
+				continue
+			}
+			w.tunneled = true
+			continue
+		}
+
+		candidateURLs = append(candidateURLs, server.URLs...)
+	}
+
+	connectionText := "direct via STUN"
+	if isRelaying {
+		connectionText = "proxied via TURN"
+	}
+	if w.tunneled {
+		connectionText = fmt.Sprintf("proxied via %s", url.Host)
+	}
+	w.logSuccess("——", fmt.Sprintf(
+		"connected in %.2fms (%s) candidates=%s",
+		connectMS,
+		connectionText,
+		strings.Join(candidateURLs, ","),
+	))
+	return "", nil
+}
+
+// probeInterval is the delay between packets sent to measure loss.
+const probeInterval = 20 * time.Millisecond
+
+// measure connects to the workspace directly and through a TURN server, and
+// reports the throughput and loss of each connection.
+func (w *wsPinger) measure(ctx context.Context, throughput, loss bool, duration time.Duration) error {
+	servers, err := w.client.ICEServers(ctx)
+	if err != nil {
+		return fmt.Errorf("list ice servers: %w", err)
+	}
+
+	paths := []struct {
+		name    string
+		schemes []ice.SchemeType
+	}{
+		{name: "direct", schemes: []ice.SchemeType{ice.SchemeTypeSTUN, ice.SchemeTypeSTUNS}},
+		{name: "relayed", schemes: []ice.SchemeType{ice.SchemeTypeTURN, ice.SchemeTypeTURNS}},
+	}
+	for _, path := range paths {
+		schemes := map[ice.SchemeType]interface{}{}
+		for _, scheme := range path.schemes {
+			if _, ok := w.iceSchemes[scheme]; ok {
+				schemes[scheme] = nil
+			}
+		}
+		if len(schemes) == 0 {
+			continue
+		}
+		filteredServers, err := filterICEServers(servers, schemes)
+		if err != nil {
+			return err
+		}
+		if len(filteredServers) == 0 {
+			w.logFail(fmt.Sprintf("no ice servers for a %s connection", path.name))
+			continue
+		}
+		if path.name == "relayed" {
+			// A single TURN server forces the connection to be relayed.
+			filteredServers = filteredServers[:1]
+		}
+
+		connectCtx, cancel := context.WithTimeout(ctx, time.Second*15)
+		// Speed tests need a WebRTC connection.
+		failure, err := w.connect(connectCtx, filteredServers, false)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if failure != "" {
+			w.logFail(failure)
+			continue
+		}
+		err = w.speedTest(ctx, throughput, loss, duration)
+		_ = w.dialer.Close()
+		w.dialer = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// speedTest measures the connection of the dialer. Only return fatal errors.
+func (w *wsPinger) speedTest(ctx context.Context, throughput, loss bool, duration time.Duration) error {
+	url := w.client.BaseURL()
+	path := "workspace"
+	if w.tunneled {
+		path = fmt.Sprintf("%s ↔ workspace", url.Host)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*duration+time.Second*15)
+	defer cancel()
+
+	logErr := func(measurement string, err error) {
+		var dialErr *wsnet.DialError
+		if errors.As(err, &dialErr) && dialErr.Code == wsnet.CodeBadAddressErr {
+			w.logFail("the workspace agent doesn't support speed tests, try rebuilding the workspace")
+			return
+		}
+		w.logFail(fmt.Sprintf("%s: %s", measurement, err.Error()))
+	}
+
+	if throughput {
+		upload, err := w.dialer.Upload(ctx, duration)
+		if err != nil {
+			logErr("upload", err)
 			return nil
 		}
-		if errors.Is(err, webrtc.ErrConnectionClosed) {
-			w.dialer = nil
-			w.logFail("webrtc connection is closed")
+		w.logSuccess(fmt.Sprintf("%.2f Mbps", upload.BitsPerSecond()/1e6), fmt.Sprintf("upload you → %s", path))
+
+		download, err := w.dialer.Download(ctx, duration)
+		if err != nil {
+			logErr("download", err)
 			return nil
 		}
-		return fmt.Errorf("ping workspace: %w", err)
+		w.logSuccess(fmt.Sprintf("%.2f Mbps", download.BitsPerSecond()/1e6), fmt.Sprintf("download you ← %s", path))
 	}
-	pingMS := float64(time.Since(pingStart).Microseconds()) / 1000
-	connectionText := "you ↔ workspace"
-	if w.tunneled {
-		connectionText = fmt.Sprintf("you ↔ %s ↔ workspace", url.Host)
+
+	if loss {
+		count := int(duration / probeInterval)
+		if count < 1 {
+			count = 1
+		}
+		res, err := w.dialer.Loss(ctx, count, probeInterval)
+		if err != nil {
+			logErr("loss", err)
+			return nil
+		}
+		w.logSuccess(fmt.Sprintf("%.1f%% loss", res.Ratio()*100), fmt.Sprintf(
+			"jitter=%.2fms rtt=%.2fms sent=%d received=%d you ↔ %s",
+			float64(res.Jitter.Microseconds())/1000,
+			float64(res.RTT.Microseconds())/1000,
+			res.Sent,
+			res.Received,
+			path,
+		))
 	}
-	w.logSuccess(fmt.Sprintf("%.2fms", pingMS), connectionText)
 	return nil
 }
 
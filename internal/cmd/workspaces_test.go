@@ -13,10 +13,30 @@ import (
 	"cdr.dev/slog/sloggers/slogtest"
 	"cdr.dev/slog/sloggers/slogtest/assert"
 	"github.com/google/go-cmp/cmp"
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
 
 	"cdr.dev/coder-cli/coder-sdk"
 )
 
+func Test_filterICEServers(t *testing.T) {
+	t.Parallel()
+
+	servers := []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.example.com"}},
+		{URLs: []string{"turn:turn.example.com"}},
+		{URLs: []string{"stun:stun.example.com", "turn:turn.example.com"}},
+	}
+	filtered, err := filterICEServers(servers, map[ice.SchemeType]interface{}{
+		ice.SchemeTypeTURN: nil,
+	})
+	assert.Success(t, "filter servers", err)
+	assert.Equal(t, "servers", []webrtc.ICEServer{servers[1]}, filtered)
+
+	_, err = filterICEServers([]webrtc.ICEServer{{URLs: []string{"bad"}}}, nil)
+	assert.Error(t, "invalid url", err)
+}
+
 func Test_workspaces_ls(t *testing.T) {
 	skipIfNoAuth(t)
 	res := execute(t, nil, "workspaces", "ls")
@@ -0,0 +1,288 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"io"
+	"math"
+)
+
+const (
+	minBlockSize = 2 << 10
+	maxBlockSize = 128 << 10
+	// maxLiteral is the most data a single delta operation carries, so
+	// unmatched data is streamed instead of buffered.
+	maxLiteral = 256 << 10
+)
+
+// blockSizeFor returns the block size of signatures for a file of the size
+// provided. Like rsync, it grows with the square root of the size, so large
+// files don't have too many blocks to send.
+func blockSizeFor(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	if blockSize < minBlockSize {
+		return minBlockSize
+	}
+	if blockSize > maxBlockSize {
+		return maxBlockSize
+	}
+	// Round to a multiple of 8 like rsync does.
+	return blockSize &^ 7
+}
+
+// blockSignature describes a block of a file that the receiver of a sync
+// already has.
+type blockSignature struct {
+	Weak   uint32
+	Strong [sha256.Size]byte
+}
+
+// fileSignature describes the blocks of a file, so a delta can be computed
+// without the file.
+type fileSignature struct {
+	Path      string
+	Size      int64
+	BlockSize int
+	Blocks    []blockSignature
+}
+
+// lastSize returns the size of the last block, which may be shorter than the
+// others.
+func (f fileSignature) lastSize() int {
+	if len(f.Blocks) == 0 {
+		return 0
+	}
+	return int(f.Size - int64(len(f.Blocks)-1)*int64(f.BlockSize))
+}
+
+// signature returns the signature of the blocks of r.
+func signature(r io.Reader, blockSize int) (fileSignature, error) {
+	var (
+		sig = fileSignature{BlockSize: blockSize}
+		buf = make([]byte, blockSize)
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			var sum rollingSum
+			sum.init(buf[:n])
+			sig.Size += int64(n)
+			sig.Blocks = append(sig.Blocks, blockSignature{
+				Weak:   sum.sum(),
+				Strong: sha256.Sum256(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return fileSignature{}, err
+		}
+	}
+}
+
+// rollingSum is the weak checksum of rsync, which can be moved along a file
+// one byte at a time. Only the low 16 bits of a and b are significant.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rollingSum) init(block []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(block))
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+}
+
+// roll moves the window one byte forward, removing out and adding in.
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// deltaOp is an operation that rebuilds part of a file.
+type deltaOp struct {
+	// Block is the index of a block of the old file to copy, or -1 to copy
+	// Data.
+	Block int
+	Data  []byte
+}
+
+// computeDelta reads the new contents of a file from r and calls emit with
+// the operations that rebuild them from the old file described by sig. Data
+// that doesn't match a block of the old file is sent as is, in operations of
+// at most maxLiteral bytes.
+func computeDelta(r io.Reader, sig fileSignature, emit func(deltaOp) error) error {
+	blockSize := sig.BlockSize
+	if blockSize <= 0 {
+		blockSize = minBlockSize
+	}
+	lastSize := sig.lastSize()
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+	match := func(window []byte, weak uint32) int {
+		var strong *[sha256.Size]byte
+		for _, i := range index[weak] {
+			size := blockSize
+			if i == len(sig.Blocks)-1 {
+				size = lastSize
+			}
+			if len(window) != size {
+				continue
+			}
+			if strong == nil {
+				s := sha256.Sum256(window)
+				strong = &s
+			}
+			if sig.Blocks[i].Strong == *strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var (
+		buf = make([]byte, 0, maxLiteral+2*blockSize)
+		// lit is the start of the data that hasn't been emitted yet, and pos
+		// the start of the window matched against blocks.
+		lit, pos int
+		eof      bool
+		sum      rollingSum
+		summed   bool
+	)
+	fill := func() error {
+		if lit > 0 {
+			n := copy(buf[:cap(buf)], buf[lit:])
+			buf = buf[:n]
+			pos -= lit
+			lit = 0
+		}
+		for !eof && len(buf) < cap(buf) {
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	flush := func(end int) error {
+		if end == lit {
+			return nil
+		}
+		data := make([]byte, end-lit)
+		copy(data, buf[lit:end])
+		lit = end
+		return emit(deltaOp{Block: -1, Data: data})
+	}
+	emitBlock := func(i, end int) error {
+		err := flush(pos)
+		if err != nil {
+			return err
+		}
+		lit, pos, summed = end, end, false
+		return emit(deltaOp{Block: i})
+	}
+
+	for {
+		if pos+blockSize >= len(buf) && !eof {
+			err := fill()
+			if err != nil {
+				return err
+			}
+		}
+		remaining := len(buf) - pos
+		if remaining == 0 {
+			return nil
+		}
+
+		if remaining < blockSize {
+			// The end of the file can only match the last block of the old
+			// file, so it's checked once where they'd line up.
+			if lastSize > 0 && lastSize < blockSize && remaining >= lastSize {
+				pos = len(buf) - lastSize
+				var tail rollingSum
+				tail.init(buf[pos:])
+				if i := match(buf[pos:], tail.sum()); i >= 0 {
+					err := emitBlock(i, len(buf))
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			pos = len(buf)
+			err := flush(len(buf))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !summed {
+			sum.init(buf[pos : pos+blockSize])
+			summed = true
+		}
+		if i := match(buf[pos:pos+blockSize], sum.sum()); i >= 0 {
+			err := emitBlock(i, pos+blockSize)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if pos+blockSize < len(buf) {
+			sum.roll(buf[pos], buf[pos+blockSize])
+		} else {
+			summed = false
+		}
+		pos++
+		if pos-lit >= maxLiteral {
+			err := flush(pos)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// applyDelta writes the operations to w, copying blocks from old. The old
+// file may be nil if there are no blocks to copy.
+func applyDelta(w io.Writer, old io.ReaderAt, blockSize int, ops []deltaOp) error {
+	var buf []byte
+	for _, op := range ops {
+		if op.Block < 0 {
+			_, err := w.Write(op.Data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if old == nil {
+			return io.ErrUnexpectedEOF
+		}
+		if buf == nil {
+			buf = make([]byte, blockSize)
+		}
+		n, err := old.ReadAt(buf, int64(op.Block)*int64(blockSize))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package sync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func Test_rollingSum(t *testing.T) {
+	t.Parallel()
+
+	data := make([]byte, 64)
+	rand.New(rand.NewSource(1)).Read(data)
+	const size = 16
+	var rolling rollingSum
+	rolling.init(data[:size])
+	for i := 1; i+size <= len(data); i++ {
+		rolling.roll(data[i-1], data[i+size-1])
+		var fresh rollingSum
+		fresh.init(data[i : i+size])
+		assert.Equal(t, "rolled sum", fresh.sum(), rolling.sum())
+	}
+}
+
+func Test_delta(t *testing.T) {
+	t.Parallel()
+
+	random := rand.New(rand.NewSource(1))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		random.Read(b)
+		return b
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	old := randomBytes(10*minBlockSize + 100)
+
+	for _, test := range []struct {
+		name string
+		new  []byte
+		// maxData is the most data the delta may send.
+		maxData int
+	}{
+		{name: "Unchanged", new: old, maxData: 0},
+		{name: "Empty", new: nil, maxData: 0},
+		{name: "Appended", new: join(old, randomBytes(10)), maxData: 10 + 100},
+		{name: "Prepended", new: join(randomBytes(10), old), maxData: 10},
+		{name: "Inserted", new: join(old[:5000], randomBytes(3), old[5000:]), maxData: 3 + minBlockSize},
+		{name: "Truncated", new: old[:3*minBlockSize], maxData: 0},
+		{name: "Removed", new: join(old[:minBlockSize], old[2*minBlockSize:]), maxData: 0},
+		{name: "Unrelated", new: randomBytes(3 * maxLiteral), maxData: 3 * maxLiteral},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			sig, err := signature(bytes.NewReader(old), minBlockSize)
+			assert.Success(t, "signature", err)
+			var (
+				ops  []deltaOp
+				data int
+			)
+			err = computeDelta(bytes.NewReader(test.new), sig, func(op deltaOp) error {
+				assert.True(t, "data is limited", len(op.Data) <= maxLiteral)
+				data += len(op.Data)
+				ops = append(ops, op)
+				return nil
+			})
+			assert.Success(t, "compute delta", err)
+			assert.True(t, "delta is small", data <= test.maxData)
+
+			var rebuilt bytes.Buffer
+			err = applyDelta(&rebuilt, bytes.NewReader(old), minBlockSize, ops)
+			assert.Success(t, "apply delta", err)
+			assert.True(t, "rebuilt file matches", bytes.Equal(test.new, rebuilt.Bytes()))
+		})
+	}
+}
@@ -0,0 +1,764 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/wsep"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+
+	"cdr.dev/coder-cli/coder-sdk"
+	"cdr.dev/coder-cli/internal/coderutil"
+)
+
+// helperConn is a connection to a sync helper.
+type helperConn struct {
+	w     *bufio.Writer
+	enc   *gob.Encoder
+	dec   *gob.Decoder
+	close func() error
+	// root is the directory of requests that don't name one.
+	root string
+	// process is the helper's process in the workspace. It's nil for
+	// helpers that don't run in one.
+	process *helperProcess
+}
+
+func newHelperConn(r io.Reader, w io.Writer, close func() error) *helperConn {
+	bw := bufio.NewWriter(w)
+	return &helperConn{
+		w:     bw,
+		enc:   gob.NewEncoder(bw),
+		dec:   gob.NewDecoder(bufio.NewReader(r)),
+		close: close,
+	}
+}
+
+// send buffers a request that isn't answered, like opWrite.
+func (c *helperConn) send(req helperRequest) error {
+	if req.Root == "" {
+		req.Root = c.root
+	}
+	err := c.enc.Encode(&req)
+	if err != nil {
+		return xerrors.Errorf("write request: %w", err)
+	}
+	return nil
+}
+
+// call sends a request and calls fn with each of its responses.
+func (c *helperConn) call(req helperRequest, fn func(helperResponse) error) error {
+	err := c.send(req)
+	if err != nil {
+		return err
+	}
+	err = c.w.Flush()
+	if err != nil {
+		return xerrors.Errorf("write request: %w", err)
+	}
+	for {
+		var resp helperResponse
+		err := c.dec.Decode(&resp)
+		if err != nil {
+			return xerrors.Errorf("read response: %w", err)
+		}
+		if resp.Error != "" {
+			return xerrors.Errorf("sync helper: %s", resp.Error)
+		}
+		if fn != nil {
+			err = fn(resp)
+			if err != nil {
+				return err
+			}
+		}
+		if !resp.More {
+			return nil
+		}
+	}
+}
+
+// helperClient starts a sync helper when it's first needed, and again when
+// it fails. The engines of a session share one, which serves all of their
+// directories.
+type helperClient struct {
+	dial func(ctx context.Context) (*helperConn, error)
+
+	mut  sync.Mutex
+	conn *helperConn
+}
+
+// connect returns the connection to the helper, starting it if needed.
+func (c *helperClient) connect(ctx context.Context) (*helperConn, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	h, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var version int
+	err = h.call(helperRequest{Op: opHello, Version: helperProtocolVersion}, func(resp helperResponse) error {
+		version = resp.Version
+		return nil
+	})
+	if err == nil && version != helperProtocolVersion {
+		err = xerrors.Errorf("sync helper protocol mismatch: local = %d, remote = %d", helperProtocolVersion, version)
+	}
+	if err != nil {
+		_ = h.close()
+		return nil, h.startError(err)
+	}
+	c.conn = h
+	return h, nil
+}
+
+// startError explains why the helper failed to start with what it wrote to
+// stderr, which is usually more useful than the error reading its response.
+func (c *helperConn) startError(err error) error {
+	if c.process == nil {
+		return err
+	}
+	if stderr := c.process.stderr.String(); stderr != "" {
+		err = xerrors.Errorf("%w: %s", err, stderr)
+	}
+	if c.process.workspaceCoder {
+		return &helperUnavailableError{err: err}
+	}
+	return err
+}
+
+// helperUnavailableError is returned when no sync helper that speaks this
+// version's protocol can run in the workspace.
+type helperUnavailableError struct {
+	err error
+}
+
+func (e *helperUnavailableError) Error() string {
+	return fmt.Sprintf("no compatible sync helper in the workspace: %s: install this version of coder in the workspace", e.err)
+}
+
+func (e *helperUnavailableError) Unwrap() error {
+	return e.err
+}
+
+// close stops the helper.
+func (c *helperClient) close() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.close()
+	c.conn = nil
+	return err
+}
+
+// do runs fn with the helper, whose requests are for the remote directory
+// root. The helper is stopped if fn fails, since the connection may be out
+// of sync, and started again by the next call.
+func (c *helperClient) do(ctx context.Context, root string, fn func(h *helperConn) error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	h, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	h.root = root
+	err = fn(h)
+	var transferErr *transferError
+	if err != nil && !xerrors.As(err, &transferErr) {
+		_ = h.close()
+		c.conn = nil
+	}
+	return err
+}
+
+// engine transfers files to a workspace without rsync. Like rsync, files
+// whose size and modification time match are skipped, and the others are
+// sent as deltas against the blocks the workspace already has. The remote
+// side is a helper executed through wsep.
+type engine struct {
+	localDir string
+	// remoteDir is the directory of the helper's requests, which is the one
+	// it was started with if it's empty.
+	remoteDir string
+	ignore    *ignoreMatcher
+	helper    *helperClient
+	// state and writer are only set for two-way syncs.
+	state  *syncState
+	writer *fileWriter
+}
+
+// writeBatch is the most operations sent in a write.
+const writeBatch = 1024
+
+// do runs fn with the helper.
+func (e *engine) do(ctx context.Context, fn func(h *helperConn) error) error {
+	return e.helper.do(ctx, e.remoteDir, fn)
+}
+
+// transferError is the errors the helper reported for paths of a transfer.
+// They don't affect the connection to the helper.
+type transferError struct {
+	errs []string
+}
+
+func (t *transferError) Error() string {
+	return strings.Join(t.errs, "; ")
+}
+
+// flush waits for the helper to process the writes and removes sent.
+func flush(h *helperConn) error {
+	var errs []string
+	err := h.call(helperRequest{Op: opFlush}, func(resp helperResponse) error {
+		errs = append(errs, resp.Errors...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &transferError{errs: errs}
+	}
+	return nil
+}
+
+// remove removes the remote path, relative to the root of the sync.
+func (e *engine) remove(ctx context.Context, rel string) error {
+	return e.do(ctx, func(h *helperConn) error {
+		err := h.send(helperRequest{Op: opRemove, Paths: []string{rel}})
+		if err != nil {
+			return err
+		}
+		return flush(h)
+	})
+}
+
+// push makes the remote path, relative to the root of the sync, match the
+// local one. Remote paths that don't exist locally are removed, unless
+// they're ignored.
+func (e *engine) push(ctx context.Context, rel string) error {
+	return e.do(ctx, func(h *helperConn) error {
+		local, err := e.localEntries(rel)
+		if err != nil {
+			return err
+		}
+		remote, err := e.remoteManifest(h, []string{rel}, false)
+		if err != nil {
+			return err
+		}
+
+		removes, writes := diffEntries(local, remote)
+		if len(removes) > 0 {
+			err = h.send(helperRequest{Op: opRemove, Paths: removes})
+			if err != nil {
+				return err
+			}
+		}
+
+		localErrs, err := e.pushEntries(h, writes, remote)
+		if err != nil {
+			return err
+		}
+
+		err = flush(h)
+		var transferErr *transferError
+		if xerrors.As(err, &transferErr) {
+			localErrs = append(localErrs, transferErr.errs...)
+		} else if err != nil {
+			return err
+		}
+		if len(localErrs) > 0 {
+			return &transferError{errs: localErrs}
+		}
+		return nil
+	})
+}
+
+// pushEntries sends writes of the local entries to the helper, as deltas
+// against the remote entries. It returns the errors of reading local files,
+// which don't stop the other entries.
+func (e *engine) pushEntries(h *helperConn, writes []fileEntry, remote map[string]fileEntry) ([]string, error) {
+	// Signatures are only needed for files the workspace has a version of.
+	// They're requested in one batch.
+	var sigPaths []string
+	for _, entry := range writes {
+		old, ok := remote[entry.Path]
+		if entry.Mode.IsRegular() && ok && old.Mode.IsRegular() && old.Size > 0 {
+			sigPaths = append(sigPaths, entry.Path)
+		}
+	}
+	sigs := make(map[string]fileSignature, len(sigPaths))
+	if len(sigPaths) > 0 {
+		err := h.call(helperRequest{Op: opSignatures, Paths: sigPaths}, func(resp helperResponse) error {
+			for _, sig := range resp.Signatures {
+				sigs[sig.Path] = sig
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var localErrs []string
+	for _, entry := range writes {
+		if !entry.Mode.IsRegular() {
+			err := h.send(helperRequest{Op: opWrite, Write: &fileWrite{Entry: entry, Done: true}})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err := sendDelta(e.localPath(entry.Path), entry, sigs[entry.Path], func(write *fileWrite) error {
+			return h.send(helperRequest{Op: opWrite, Write: write})
+		})
+		var transferErr *transferError
+		if xerrors.As(err, &transferErr) {
+			localErrs = append(localErrs, transferErr.errs...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return localErrs, nil
+}
+
+// remoteManifest returns the remote entries of the paths and everything
+// inside them that isn't ignored.
+func (e *engine) remoteManifest(h *helperConn, rels []string, hash bool) (map[string]fileEntry, error) {
+	entries := make(map[string]fileEntry)
+	err := h.call(helperRequest{Op: opManifest, Paths: rels, Ignore: e.ignore.rules(), Hash: hash}, func(resp helperResponse) error {
+		for _, entry := range resp.Entries {
+			entries[entry.Path] = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// localEntryMap returns the local entries of the paths and everything inside
+// them that isn't ignored.
+func (e *engine) localEntryMap(rels []string) (map[string]fileEntry, error) {
+	entries := make(map[string]fileEntry)
+	for _, rel := range rels {
+		list, err := e.localEntries(rel)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list {
+			entries[entry.Path] = entry
+		}
+	}
+	return entries, nil
+}
+
+// localPath returns the local path of a relative path of the sync.
+func (e *engine) localPath(rel string) string {
+	return filepath.Join(e.localDir, filepath.FromSlash(rel))
+}
+
+// localEntries returns the entries of the local path and everything inside
+// it that isn't ignored.
+func (e *engine) localEntries(rel string) ([]fileEntry, error) {
+	var entries []fileEntry
+	err := walkEntries(e.localPath(rel), rel, e.ignore, func(entry fileEntry) error {
+		if runtime.GOOS == "windows" {
+			// Windows doesn't have Unix permissions, so the workspace's are
+			// kept.
+			entry.Mode &^= os.ModePerm
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("read local files: %w", err)
+	}
+	return entries, nil
+}
+
+// diffEntries returns the remote paths to remove and the local entries to
+// write so the remote entries match the local ones. Only the topmost of
+// removed paths are returned.
+func diffEntries(local []fileEntry, remote map[string]fileEntry) ([]string, []fileEntry) {
+	localPaths := make(map[string]struct{}, len(local))
+	var writes []fileEntry
+	for _, entry := range local {
+		localPaths[entry.Path] = struct{}{}
+		old, ok := remote[entry.Path]
+		if !ok || !sameEntry(entry, old) {
+			writes = append(writes, entry)
+		}
+	}
+
+	var removes []string
+	for p := range remote {
+		if _, ok := localPaths[p]; !ok {
+			removes = append(removes, p)
+		}
+	}
+	sort.Strings(removes)
+	topmost := removes[:0]
+	for _, p := range removes {
+		if len(topmost) > 0 && strings.HasPrefix(p, topmost[len(topmost)-1]+"/") {
+			continue
+		}
+		topmost = append(topmost, p)
+	}
+	return topmost, writes
+}
+
+// sameEntry returns whether a remote entry is already up to date. Like
+// rsync, files are assumed to be the same if their size and modification
+// time are.
+func sameEntry(local, remote fileEntry) bool {
+	if local.Mode.Type() != remote.Mode.Type() {
+		return false
+	}
+	if local.Mode.Perm() != 0 && local.Mode.Perm() != remote.Mode.Perm() {
+		return false
+	}
+	switch {
+	case local.Mode.IsDir():
+		return true
+	case local.Mode&os.ModeSymlink != 0:
+		return local.Link == remote.Link
+	default:
+		return local.Size == remote.Size && local.ModTime.Equal(remote.ModTime)
+	}
+}
+
+// sendDelta calls send with the writes that rebuild the file at localPath
+// from the file described by sig. Files removed since they were listed are
+// skipped. Errors reading the file are returned as a *transferError, and the
+// receiver discards the file because its hash doesn't match.
+func sendDelta(localPath string, entry fileEntry, sig fileSignature, send func(*fileWrite) error) error {
+	f, err := os.Open(localPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return &transferError{errs: []string{entry.Path + ": " + err.Error()}}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err == nil {
+		entry.Size = info.Size()
+		entry.ModTime = info.ModTime()
+	}
+
+	var (
+		write   = fileWrite{Entry: entry, BlockSize: sig.BlockSize}
+		hash    = sha256.New()
+		pending int
+		sendErr error
+	)
+	readErr := computeDelta(io.TeeReader(bufio.NewReader(f), hash), sig, func(op deltaOp) error {
+		write.Ops = append(write.Ops, op)
+		pending += len(op.Data)
+		if pending < maxLiteral && len(write.Ops) < writeBatch {
+			return nil
+		}
+		sendErr = send(&write)
+		write.Ops, pending = nil, 0
+		return sendErr
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	write.Done = true
+	write.Hash = hash.Sum(nil)
+	err = send(&write)
+	if err != nil {
+		return err
+	}
+	if readErr != nil {
+		return &transferError{errs: []string{entry.Path + ": " + readErr.Error()}}
+	}
+	return nil
+}
+
+// helperDir is where helpers are installed in workspaces, relative to the
+// home directory.
+const helperDir = ".cache/coder"
+
+// helperTimeout is how long starting the helper may take, including
+// uploading it.
+const helperTimeout = 5 * time.Minute
+
+// helperProcess is a sync helper running in a workspace.
+type helperProcess struct {
+	stdout io.Reader
+	stdin  io.WriteCloser
+	stderr *stderrTail
+	close  func() error
+	// workspaceCoder is set when the helper is the workspace's coder rather
+	// than this executable, so it may not have the same protocol, or a
+	// sync-helper command at all.
+	workspaceCoder bool
+}
+
+// maxStderrTail is how much of the end of a helper's stderr is kept.
+const maxStderrTail = 4096
+
+// stderrTail keeps the end of a helper's stderr.
+type stderrTail struct {
+	mut sync.Mutex
+	buf []byte
+	// done is closed once stderr has been read to its end.
+	done chan struct{}
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > maxStderrTail {
+		t.buf = t.buf[len(t.buf)-maxStderrTail:]
+	}
+	return len(p), nil
+}
+
+// String returns the end of stderr, waiting briefly for the rest of it if the
+// helper is exiting.
+func (t *stderrTail) String() string {
+	select {
+	case <-t.done:
+	case <-time.After(time.Second):
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return strings.TrimSpace(string(t.buf))
+}
+
+// startHelper starts a sync helper in the workspace with the arguments
+// provided, installing it first if needed. It runs until it's closed.
+func startHelper(ctx context.Context, client coder.Client, workspace *coder.Workspace, args ...string) (*helperProcess, error) {
+	ctx, cancelDial := context.WithTimeout(ctx, helperTimeout)
+	defer cancelDial()
+	command, workspaceCoder, err := installHelper(ctx, client, workspace)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := coderutil.DialWorkspaceWsep(ctx, client, workspace)
+	if err != nil {
+		return nil, xerrors.Errorf("dial executor: %w", err)
+	}
+
+	// The process stops when the context it's started with is canceled, so
+	// it has its own.
+	ctx, cancel := context.WithCancel(context.Background())
+	process, err := wsep.RemoteExecer(conn).Start(ctx, wsep.Command{
+		Command: "sh",
+		Args:    append([]string{"-c", "exec " + command + ` sync-helper "$@"`, "sh"}, args...),
+		Stdin:   true,
+	})
+	if err != nil {
+		cancel()
+		_ = conn.Close(websocket.StatusNormalClosure, "")
+		return nil, xerrors.Errorf("start sync helper: %w", err)
+	}
+	stderr := &stderrTail{done: make(chan struct{})}
+	go func() {
+		defer close(stderr.done)
+		_, _ = io.Copy(stderr, process.Stderr()) // Best effort.
+	}()
+
+	return &helperProcess{
+		stdout: process.Stdout(),
+		stdin:  process.Stdin(),
+		stderr: stderr,
+		close: func() error {
+			defer cancel()
+			_ = process.Stdin().Close()
+			_ = process.Close()
+			return conn.Close(websocket.StatusNormalClosure, "")
+		},
+		workspaceCoder: workspaceCoder,
+	}, nil
+}
+
+// dialHelper starts a sync helper that serves requests for the remote
+// directory.
+func dialHelper(ctx context.Context, client coder.Client, workspace *coder.Workspace, remoteDir string) (*helperConn, error) {
+	process, err := startHelper(ctx, client, workspace, "--", remoteDir)
+	if err != nil {
+		return nil, err
+	}
+	h := newHelperConn(process.stdout, process.stdin, process.close)
+	h.process = process
+	return h, nil
+}
+
+// installHelper returns the shell command that runs the sync helper in the
+// workspace. This executable is the helper, so it's copied to the workspace
+// when it can run there. Otherwise, the workspace's coder is used, which
+// must speak the same helper protocol, and workspaceCoder is set.
+func installHelper(ctx context.Context, client coder.Client, workspace *coder.Workspace) (command string, workspaceCoder bool, err error) {
+	name, err := helperName()
+	if err != nil {
+		return "", false, err
+	}
+	command = `"$HOME/` + helperDir + "/" + name + `"`
+
+	var out strings.Builder
+	err = execRemote(ctx, client, workspace, nil, &out, `
+if [ -x "$HOME/`+helperDir+`/$0" ]; then echo installed; else echo missing; fi
+uname -m
+command -v coder || true`, name)
+	if err != nil {
+		return "", false, xerrors.Errorf("find sync helper: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for len(lines) < 3 {
+		lines = append(lines, "")
+	}
+	installed, arch, remoteCoder := lines[0] == "installed", strings.TrimSpace(lines[1]), strings.TrimSpace(lines[2])
+	if installed {
+		return command, false, nil
+	}
+
+	if runtime.GOOS == "linux" && archMatches(arch) {
+		err = uploadHelper(ctx, client, workspace, name)
+		if err != nil {
+			return "", false, err
+		}
+		return command, false, nil
+	}
+	if remoteCoder != "" {
+		return "coder", true, nil
+	}
+	return "", false, &helperUnavailableError{
+		err: xerrors.Errorf("this %s/%s executable can't run in %s workspaces, and coder isn't installed in the workspace", runtime.GOOS, runtime.GOARCH, arch),
+	}
+}
+
+// helperName returns the file name of this executable in workspaces. It
+// includes a hash, so helpers of different versions don't conflict.
+func helperName() (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", xerrors.Errorf("find executable: %w", err)
+	}
+	f, err := os.Open(self)
+	if err != nil {
+		return "", xerrors.Errorf("open executable: %w", err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", xerrors.Errorf("hash executable: %w", err)
+	}
+	return "coder-sync-helper-" + hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+// archMatches returns whether this executable can run on a machine with the
+// architecture reported by uname -m.
+func archMatches(arch string) bool {
+	switch runtime.GOARCH {
+	case "amd64":
+		return arch == "x86_64"
+	case "arm64":
+		return arch == "aarch64" || arch == "arm64"
+	case "arm":
+		return strings.HasPrefix(arch, "armv7") || strings.HasPrefix(arch, "armv6")
+	case "386":
+		return arch == "i386" || arch == "i686"
+	default:
+		return arch == runtime.GOARCH
+	}
+}
+
+// uploadHelper copies this executable into the workspace. It's moved into
+// place once complete, so a failed upload is never run.
+func uploadHelper(ctx context.Context, client coder.Client, workspace *coder.Workspace, name string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return xerrors.Errorf("find executable: %w", err)
+	}
+	f, err := os.Open(self)
+	if err != nil {
+		return xerrors.Errorf("open executable: %w", err)
+	}
+	defer f.Close()
+
+	err = execRemote(ctx, client, workspace, f, ioutil.Discard, `set -e
+dir="$HOME/`+helperDir+`"
+mkdir -p "$dir"
+cat > "$dir/$0.$$"
+chmod 755 "$dir/$0.$$"
+mv "$dir/$0.$$" "$dir/$0"`, name)
+	if err != nil {
+		return xerrors.Errorf("upload sync helper: %w", err)
+	}
+	return nil
+}
+
+// execRemote runs a shell script in the workspace with the arguments
+// provided, which start at $0.
+func execRemote(ctx context.Context, client coder.Client, workspace *coder.Workspace, stdin io.Reader, stdout io.Writer, script string, args ...string) error {
+	conn, err := coderutil.DialWorkspaceWsep(ctx, client, workspace)
+	if err != nil {
+		return xerrors.Errorf("dial executor: %w", err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "") }() // Best effort.
+
+	process, err := wsep.RemoteExecer(conn).Start(ctx, wsep.Command{
+		Command: "sh",
+		Args:    append([]string{"-c", script}, args...),
+		Stdin:   stdin != nil,
+	})
+	if err != nil {
+		return xerrors.Errorf("exec remote process: %w", err)
+	}
+	defer process.Close()
+
+	if stdin != nil {
+		go func() {
+			processStdin := process.Stdin()
+			defer processStdin.Close()
+			_, _ = io.Copy(processStdin, stdin)
+		}()
+	}
+	var (
+		wg     sync.WaitGroup
+		stderr strings.Builder
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stdout, process.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(&stderr, process.Stderr())
+	}()
+	err = process.Wait()
+	wg.Wait()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return xerrors.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package sync
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+)
+
+// newTestEngine returns an engine that syncs local to remote with a helper
+// served in the same process.
+func newTestEngine(t *testing.T, local, remote string) *engine {
+	ignore, err := newIgnoreMatcher(local, nil, nil)
+	assert.Success(t, "create matcher", err)
+	return &engine{
+		localDir: local,
+		ignore:   ignore,
+		helper:   newTestHelper(remote),
+	}
+}
+
+// newTestHelper returns a client of a helper for the remote directory,
+// served in the same process.
+func newTestHelper(remote string) *helperClient {
+	return &helperClient{
+		dial: func(ctx context.Context) (*helperConn, error) {
+			requests, requestsW := io.Pipe()
+			responses, responsesW := io.Pipe()
+			go func() {
+				err := ServeHelper(remote, requests, responsesW)
+				_ = responsesW.CloseWithError(err)
+			}()
+			return newHelperConn(responses, requestsW, requestsW.Close), nil
+		},
+	}
+}
+
+func readFiles(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, localPath)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(localPath)
+			files[filepath.ToSlash(rel)] = "-> " + target
+			return err
+		}
+		content, err := ioutil.ReadFile(localPath)
+		files[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+	assert.Success(t, "read files", err)
+	return files
+}
+
+func Test_engine(t *testing.T) {
+	t.Parallel()
+
+	local, err := ioutil.TempDir("", "coder-sync-local")
+	assert.Success(t, "create local dir", err)
+	defer os.RemoveAll(local)
+	remote, err := ioutil.TempDir("", "coder-sync-remote")
+	assert.Success(t, "create remote dir", err)
+	defer os.RemoveAll(remote)
+
+	writeFiles(t, local, map[string]string{
+		".gitignore":     "*.log\n",
+		"main.go":        "package main\n",
+		"docs/README.md": "# docs\n",
+		"debug.log":      "local log\n",
+	})
+	err = os.Chmod(filepath.Join(local, "main.go"), 0o755)
+	assert.Success(t, "chmod", err)
+	err = os.Symlink("docs/README.md", filepath.Join(local, "README.md"))
+	assert.Success(t, "symlink", err)
+	writeFiles(t, remote, map[string]string{
+		"main.go":     "package old\n",
+		"stale/a.txt": "stale\n",
+		"remote.log":  "remote log\n",
+	})
+
+	e := newTestEngine(t, local, remote)
+	defer e.helper.close()
+	err = e.push(context.Background(), "")
+	assert.Success(t, "initial push", err)
+	assert.Equal(t, "remote files", map[string]string{
+		".gitignore":     "*.log\n",
+		"main.go":        "package main\n",
+		"docs/README.md": "# docs\n",
+		"README.md":      "-> docs/README.md",
+		// Ignored files aren't sent or removed.
+		"remote.log": "remote log\n",
+	}, readFiles(t, remote))
+
+	localInfo, err := os.Stat(filepath.Join(local, "main.go"))
+	assert.Success(t, "stat local", err)
+	remoteInfo, err := os.Stat(filepath.Join(remote, "main.go"))
+	assert.Success(t, "stat remote", err)
+	assert.Equal(t, "mode", localInfo.Mode(), remoteInfo.Mode())
+	assert.True(t, "modification time", localInfo.ModTime().Equal(remoteInfo.ModTime()))
+
+	// Files that are the same aren't sent again.
+	localEntries, err := e.localEntries("")
+	assert.Success(t, "list local", err)
+	removes, writes := diffEntries(localEntries, remoteEntries(t, e, ""))
+	assert.Equal(t, "removes", 0, len(removes))
+	assert.Equal(t, "writes", 0, len(writes))
+
+	// Paths are pushed individually, and removed when they're gone.
+	writeFiles(t, local, map[string]string{"docs/README.md": "# new docs\n"})
+	err = os.Chtimes(filepath.Join(local, "docs/README.md"), time.Now(), time.Now().Add(time.Hour))
+	assert.Success(t, "chtimes", err)
+	err = e.push(context.Background(), "docs/README.md")
+	assert.Success(t, "push file", err)
+	err = os.RemoveAll(filepath.Join(local, "docs"))
+	assert.Success(t, "remove local dir", err)
+	err = e.push(context.Background(), "docs")
+	assert.Success(t, "push removed dir", err)
+	err = e.remove(context.Background(), "README.md")
+	assert.Success(t, "remove", err)
+	assert.Equal(t, "remote files", map[string]string{
+		".gitignore": "*.log\n",
+		"main.go":    "package main\n",
+		"remote.log": "remote log\n",
+	}, readFiles(t, remote))
+
+	// Errors of paths don't stop the helper.
+	err = e.remove(context.Background(), "")
+	assert.Error(t, "remove root", err)
+	err = e.push(context.Background(), "main.go")
+	assert.Success(t, "push after error", err)
+}
+
+// remoteEntries returns the remote manifest of rel.
+func remoteEntries(t *testing.T, e *engine, rel string) map[string]fileEntry {
+	entries := make(map[string]fileEntry)
+	err := e.do(context.Background(), func(h *helperConn) error {
+		return h.call(helperRequest{Op: opManifest, Paths: []string{rel}, Ignore: e.ignore.rules()}, func(resp helperResponse) error {
+			for _, entry := range resp.Entries {
+				entries[entry.Path] = entry
+			}
+			return nil
+		})
+	})
+	assert.Success(t, "remote manifest", err)
+	return entries
+}
+
+func Test_twoWay(t *testing.T) {
+	t.Parallel()
+
+	local, err := ioutil.TempDir("", "coder-sync-local")
+	assert.Success(t, "create local dir", err)
+	defer os.RemoveAll(local)
+	remote, err := ioutil.TempDir("", "coder-sync-remote")
+	assert.Success(t, "create remote dir", err)
+	defer os.RemoveAll(remote)
+
+	writeFiles(t, local, map[string]string{
+		"same.txt":       "same\n",
+		"local.txt":      "local\n",
+		"edited.txt":     "original\n",
+		"conflict.txt":   "original\n",
+		"gone/a.txt":     "a\n",
+		"kept/a.txt":     "a\n",
+		"kept/b.txt":     "b\n",
+		"generated/x.go": "package x\n",
+	})
+	writeFiles(t, remote, map[string]string{
+		"same.txt": "same\n",
+		"lock.txt": "remote\n",
+	})
+
+	e := newTestEngine(t, local, remote)
+	e.state, err = loadSyncState("")
+	assert.Success(t, "load state", err)
+	e.writer = newFileWriter(local)
+	defer e.helper.close()
+
+	// The initial sync merges both sides without removing anything.
+	result, err := e.reconcile(context.Background(), []string{""})
+	assert.Success(t, "initial reconcile", err)
+	assert.Equal(t, "no conflicts", 0, len(result.Conflicts))
+	assert.Equal(t, "pulled", []string{"lock.txt"}, result.Pulled)
+	assert.Equal(t, "synced", readFiles(t, local), readFiles(t, remote))
+
+	// Changes on either side are propagated, and changes on both are
+	// conflicts.
+	later := time.Now().Add(time.Hour)
+	writeFiles(t, local, map[string]string{"edited.txt": "local edit\n", "conflict.txt": "local\n"})
+	writeFiles(t, remote, map[string]string{"lock.txt": "remote edit\n", "conflict.txt": "remote\n", "generated/y.go": "package y\n"})
+	for _, name := range []string{"edited.txt", "conflict.txt"} {
+		err = os.Chtimes(filepath.Join(local, name), later, later)
+		assert.Success(t, "chtimes", err)
+	}
+	err = os.Chtimes(filepath.Join(remote, "lock.txt"), later, later)
+	assert.Success(t, "chtimes", err)
+	err = os.RemoveAll(filepath.Join(local, "gone"))
+	assert.Success(t, "remove local dir", err)
+	// Removing a directory keeps what changed inside it on the other side.
+	err = os.RemoveAll(filepath.Join(remote, "kept"))
+	assert.Success(t, "remove remote dir", err)
+	writeFiles(t, local, map[string]string{"kept/b.txt": "b edit\n"})
+	err = os.Chtimes(filepath.Join(local, "kept/b.txt"), later, later)
+	assert.Success(t, "chtimes", err)
+
+	result, err = e.reconcile(context.Background(), []string{""})
+	assert.Success(t, "reconcile", err)
+	assert.Equal(t, "conflicts", []conflict{{Path: "conflict.txt", Copy: "conflict.txt.conflict"}}, result.Conflicts)
+	files := readFiles(t, local)
+	assert.Equal(t, "synced", files, readFiles(t, remote))
+	assert.Equal(t, "files", map[string]string{
+		"same.txt":              "same\n",
+		"local.txt":             "local\n",
+		"edited.txt":            "local edit\n",
+		"conflict.txt":          "local\n",
+		"conflict.txt.conflict": "remote\n",
+		"lock.txt":              "remote edit\n",
+		"kept/b.txt":            "b edit\n",
+		"generated/x.go":        "package x\n",
+		"generated/y.go":        "package y\n",
+	}, files)
+
+	// Once synced, nothing changes.
+	result, err = e.reconcile(context.Background(), []string{""})
+	assert.Success(t, "reconcile", err)
+	assert.Equal(t, "nothing changed", reconcileResult{}, result)
+}
+
+func Test_sharedHelper(t *testing.T) {
+	t.Parallel()
+
+	var dirs []string
+	for i := 0; i < 4; i++ {
+		dir, err := ioutil.TempDir("", "coder-sync")
+		assert.Success(t, "create dir", err)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	writeFiles(t, dirs[0], map[string]string{"a.txt": "a\n"})
+	writeFiles(t, dirs[1], map[string]string{"b.txt": "b\n"})
+
+	// The helper is started with the first remote directory, and requests
+	// name the other.
+	helper := newTestHelper(dirs[2])
+	defer helper.close()
+	for i, remoteDir := range []string{"", dirs[3]} {
+		e := newTestEngine(t, dirs[i], dirs[2])
+		e.remoteDir = remoteDir
+		e.helper = helper
+		err := e.push(context.Background(), "")
+		assert.Success(t, "push", err)
+	}
+	assert.Equal(t, "first remote", map[string]string{"a.txt": "a\n"}, readFiles(t, dirs[2]))
+	assert.Equal(t, "second remote", map[string]string{"b.txt": "b\n"}, readFiles(t, dirs[3]))
+}
+
+func Test_helperStartError(t *testing.T) {
+	t.Parallel()
+
+	// dial returns a client of a helper process that writes stderr and
+	// answers the hello with version, or exits if it's 0.
+	dial := func(stderr string, version int, workspaceCoder bool) *helperClient {
+		return &helperClient{
+			dial: func(ctx context.Context) (*helperConn, error) {
+				requests, requestsW := io.Pipe()
+				responses, responsesW := io.Pipe()
+				tail := &stderrTail{done: make(chan struct{})}
+				go func() {
+					defer close(tail.done)
+					_, _ = tail.Write([]byte(stderr + "\n"))
+					var req helperRequest
+					err := gob.NewDecoder(requests).Decode(&req)
+					if err == nil && version != 0 {
+						err = gob.NewEncoder(responsesW).Encode(helperResponse{Version: version})
+					}
+					_ = responsesW.CloseWithError(err)
+				}()
+				h := newHelperConn(responses, requestsW, requestsW.Close)
+				h.process = &helperProcess{stderr: tail, workspaceCoder: workspaceCoder}
+				return h, nil
+			},
+		}
+	}
+	connect := func(c *helperClient) error {
+		return c.do(context.Background(), "", func(*helperConn) error { return nil })
+	}
+
+	var unavailable *helperUnavailableError
+	err := connect(dial(`Error: unknown command "sync-helper" for "coder"`, 0, true))
+	assert.True(t, "helper is unavailable", xerrors.As(err, &unavailable))
+	assert.True(t, "error has stderr", strings.Contains(err.Error(), `unknown command "sync-helper"`))
+
+	err = connect(dial("", helperProtocolVersion-1, true))
+	assert.True(t, "helper is unavailable", xerrors.As(err, &unavailable))
+	assert.True(t, "error has versions", strings.Contains(err.Error(), "protocol mismatch"))
+
+	// This executable is always a compatible helper, so it just failed.
+	err = connect(dial("out of disk space", 0, false))
+	assert.Error(t, "helper failed", err)
+	assert.False(t, "helper isn't unavailable", xerrors.As(err, &unavailable))
+	assert.True(t, "error has stderr", strings.Contains(err.Error(), "out of disk space"))
+}
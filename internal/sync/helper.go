@@ -0,0 +1,556 @@
+package sync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/xerrors"
+)
+
+// helperProtocolVersion is incremented whenever the messages of the helper
+// change, so a sync never talks to an incompatible helper.
+const helperProtocolVersion = 3
+
+// helperOp is an operation requested of the sync helper.
+type helperOp string
+
+// Helper operations. Every request gets responses until one has More unset,
+// except for opWrite, opRemove and opRename, which are only answered by
+// opFlush. That lets transfers be streamed without waiting on the network.
+const (
+	// opHello returns the protocol version of the helper.
+	opHello helperOp = "hello"
+	// opManifest returns the entries of Paths and everything inside them,
+	// except for paths matched by Ignore. Regular files include their hash
+	// if Hash is set.
+	opManifest helperOp = "manifest"
+	// opSignatures returns the signatures of the regular files in Paths.
+	opSignatures helperOp = "signatures"
+	// opDelta returns the writes that rebuild the regular files of the
+	// helper from the files described by Signatures.
+	opDelta helperOp = "delta"
+	// opWrite writes part of a file, or creates a directory or symlink.
+	opWrite helperOp = "write"
+	// opRemove removes Paths and everything inside them.
+	opRemove helperOp = "remove"
+	// opRename moves the first of Paths to the second.
+	opRename helperOp = "rename"
+	// opFlush returns the errors of writes, removes and renames since the
+	// last flush.
+	opFlush helperOp = "flush"
+)
+
+// helperRequest is a request from the local side of a sync to the helper.
+// Paths are slash-separated and relative to Root, which is the directory the
+// helper was started with if it's empty. Syncs of different directories can
+// share a helper that way.
+type helperRequest struct {
+	Op         helperOp
+	Version    int
+	Root       string
+	Paths      []string
+	Ignore     []ignoreRule
+	Hash       bool
+	Signatures []fileSignature
+	Write      *fileWrite
+}
+
+// helperResponse is a response of the helper.
+type helperResponse struct {
+	Version    int
+	Error      string
+	Errors     []string
+	Entries    []fileEntry
+	Signatures []fileSignature
+	Write      *fileWrite
+	// More is set when more responses to the request follow.
+	More bool
+}
+
+// fileEntry describes a path of a sync.
+type fileEntry struct {
+	Path string
+	// Mode has no permission bits if they're unknown, like on Windows.
+	// Existing permissions are kept in that case.
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	// Link is the target of a symlink.
+	Link string
+	// Hash is the SHA-256 of a regular file, if it was requested.
+	Hash []byte `json:",omitempty"`
+}
+
+// fileWrite is part of a file written by the helper. A file is written
+// with any number of writes, the last of which sets Done.
+type fileWrite struct {
+	Entry     fileEntry
+	BlockSize int
+	Ops       []deltaOp
+	Done      bool
+	// Hash is the SHA-256 of the file, which is checked once it's written.
+	Hash []byte
+}
+
+// watchEvent is a batch of paths that changed in one of the directories
+// watched by the helper. They're relative to Root, which is the directory as
+// it was given to the helper.
+type watchEvent struct {
+	Root  string
+	Paths []string
+	// Overflow is set when too many paths changed to send, so the whole
+	// directory must be synced.
+	Overflow bool
+}
+
+// manifestBatch is the most entries sent in a response.
+const manifestBatch = 1024
+
+// helper serves the requests of the local side of a sync in a workspace.
+type helper struct {
+	root    string
+	writers map[string]*fileWriter
+	enc     *gob.Encoder
+	w       *bufio.Writer
+}
+
+// expandHome expands a leading ~ to the home directory, like a shell would
+// for paths given to rsync.
+func expandHome(root string) (string, error) {
+	if !strings.HasPrefix(root, "~/") && root != "~" {
+		return root, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", xerrors.Errorf("get home directory: %w", err)
+	}
+	return filepath.Join(home, strings.TrimPrefix(root, "~")), nil
+}
+
+// ServeHelper serves the sync engine's requests for the directory root, and
+// any other directory they name, from r, writing responses to w, until r is
+// closed. It's run in the workspace by the hidden sync-helper command.
+func ServeHelper(root string, r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	h := &helper{
+		root:    root,
+		writers: make(map[string]*fileWriter),
+		enc:     gob.NewEncoder(bw),
+		w:       bw,
+	}
+	// Like requests, the directory of the helper must be valid.
+	_, err := h.writer("")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, w := range h.writers {
+			w.abort()
+		}
+	}()
+
+	dec := gob.NewDecoder(bufio.NewReader(r))
+	for {
+		var req helperRequest
+		err := dec.Decode(&req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return xerrors.Errorf("read request: %w", err)
+		}
+		err = h.serve(req)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writer returns the writer of a directory of the helper, which is the
+// directory it was started with if root is empty.
+func (h *helper) writer(root string) (*fileWriter, error) {
+	if root == "" {
+		root = h.root
+	}
+	if w, ok := h.writers[root]; ok {
+		return w, nil
+	}
+	dir, err := expandHome(root)
+	if err != nil {
+		return nil, err
+	}
+	w := newFileWriter(dir)
+	h.writers[root] = w
+	return w, nil
+}
+
+func (h *helper) serve(req helperRequest) error {
+	w, err := h.writer(req.Root)
+	if err != nil {
+		// Only requests for the home directory fail, which can't be served
+		// at all without one.
+		return err
+	}
+	switch req.Op {
+	case opHello:
+		return h.respond(helperResponse{Version: helperProtocolVersion})
+	case opManifest:
+		return h.manifest(w, req.Paths, req.Ignore, req.Hash)
+	case opSignatures:
+		return h.signatures(w, req.Paths)
+	case opDelta:
+		return h.delta(w, req.Signatures)
+	case opWrite:
+		if req.Write != nil {
+			w.write(*req.Write)
+		}
+		return nil
+	case opRemove:
+		for _, rel := range req.Paths {
+			w.remove(rel)
+		}
+		return nil
+	case opRename:
+		if len(req.Paths) == 2 {
+			w.rename(req.Paths[0], req.Paths[1])
+		}
+		return nil
+	case opFlush:
+		return h.respond(helperResponse{Errors: w.flush()})
+	default:
+		return h.respond(helperResponse{Error: "unknown operation " + string(req.Op)})
+	}
+}
+
+func (h *helper) respond(resp helperResponse) error {
+	err := h.enc.Encode(&resp)
+	if err != nil {
+		return xerrors.Errorf("write response: %w", err)
+	}
+	if resp.More {
+		return nil
+	}
+	return h.w.Flush()
+}
+
+func (h *helper) manifest(w *fileWriter, rels []string, rules []ignoreRule, hash bool) error {
+	ignore := newRuleMatcher(w.root, rules)
+	var entries []fileEntry
+	for _, rel := range rels {
+		root, err := w.path(rel)
+		if err != nil {
+			return h.respond(helperResponse{Error: err.Error()})
+		}
+		err = walkEntries(root, rel, ignore, func(entry fileEntry) error {
+			if hash && entry.Mode.IsRegular() {
+				var err error
+				entry.Hash, err = hashFile(filepath.Join(w.root, filepath.FromSlash(entry.Path)))
+				if err != nil {
+					return err
+				}
+			}
+			entries = append(entries, entry)
+			if len(entries) < manifestBatch {
+				return nil
+			}
+			err := h.respond(helperResponse{Entries: entries, More: true})
+			entries = nil
+			return err
+		})
+		if err != nil {
+			return h.respond(helperResponse{Error: err.Error()})
+		}
+	}
+	return h.respond(helperResponse{Entries: entries})
+}
+
+func (h *helper) signatures(w *fileWriter, rels []string) error {
+	for i, rel := range rels {
+		localPath, err := w.path(rel)
+		if err != nil {
+			return h.respond(helperResponse{Error: err.Error()})
+		}
+		sig, err := fileSignatureOf(localPath)
+		if err != nil {
+			return h.respond(helperResponse{Error: xerrors.Errorf("read %s: %w", rel, err).Error()})
+		}
+		sig.Path = rel
+		err = h.respond(helperResponse{
+			Signatures: []fileSignature{sig},
+			More:       i < len(rels)-1,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(rels) == 0 {
+		return h.respond(helperResponse{})
+	}
+	return nil
+}
+
+func (h *helper) delta(w *fileWriter, sigs []fileSignature) error {
+	var errs []string
+	for _, sig := range sigs {
+		localPath, err := w.path(sig.Path)
+		if err != nil {
+			errs = append(errs, sig.Path+": "+err.Error())
+			continue
+		}
+		info, err := os.Stat(localPath)
+		if err != nil || !info.Mode().IsRegular() {
+			// Only regular files have deltas, and removed files are skipped.
+			continue
+		}
+		err = sendDelta(localPath, fileEntry{Path: sig.Path, Mode: info.Mode()}, sig, func(write *fileWrite) error {
+			return h.respond(helperResponse{Write: write, More: true})
+		})
+		var transferErr *transferError
+		if xerrors.As(err, &transferErr) {
+			errs = append(errs, transferErr.errs...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return h.respond(helperResponse{Errors: errs})
+}
+
+// fileSignatureOf returns the signature of a file, which has no blocks if it
+// isn't a regular file.
+func fileSignatureOf(localPath string) (fileSignature, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fileSignature{}, nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return fileSignature{}, nil
+	}
+	return signature(bufio.NewReader(f), blockSizeFor(info.Size()))
+}
+
+// hashFile returns the SHA-256 of a file.
+func hashFile(localPath string) ([]byte, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// watchLatency is how long changes are collected before they're sent.
+const watchLatency = 100 * time.Millisecond
+
+// watchLimit is the most paths a batch of changes holds. When more change,
+// the batch overflows and the whole directory is synced instead.
+const watchLimit = 4096
+
+// watchBatch collects the paths that changed in a directory until they're
+// taken.
+type watchBatch struct {
+	paths    map[string]struct{}
+	overflow bool
+}
+
+func (b *watchBatch) add(paths []string, overflow bool) {
+	if overflow || b.overflow {
+		b.paths, b.overflow = nil, true
+		return
+	}
+	if b.paths == nil {
+		b.paths = make(map[string]struct{})
+	}
+	for _, p := range paths {
+		if len(b.paths) >= watchLimit {
+			b.paths, b.overflow = nil, true
+			return
+		}
+		b.paths[p] = struct{}{}
+	}
+}
+
+func (b *watchBatch) empty() bool {
+	return !b.overflow && len(b.paths) == 0
+}
+
+// take empties the batch, returning the paths in it, sorted.
+func (b *watchBatch) take() (paths []string, overflow bool) {
+	for p := range b.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	overflow = b.overflow
+	b.paths, b.overflow = nil, false
+	return paths, overflow
+}
+
+// ServeWatch writes the paths that change in the directories roots to w,
+// in batches, until r is closed. It's run in the workspace by the hidden
+// sync-helper command for two-way syncs.
+func ServeWatch(roots []string, r io.Reader, w io.Writer) error {
+	events := make(chan notify.EventInfo, 1024)
+	defer notify.Stop(events)
+	dirs := make([]string, len(roots))
+	for i, root := range roots {
+		dir, err := expandHome(root)
+		if err != nil {
+			return err
+		}
+		err = notify.Watch(filepath.Join(dir, "..."), events, notify.All)
+		if err != nil {
+			return xerrors.Errorf("watch %s: %w", root, err)
+		}
+		dirs[i] = dir
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, r)
+		closed <- err
+	}()
+
+	var (
+		mut     sync.Mutex
+		batches = make([]watchBatch, len(roots))
+		changed = make(chan struct{}, 1)
+		done    = make(chan struct{})
+	)
+	defer close(done)
+	// Events are collected however long writing them takes, since notify
+	// drops the events it can't send. Batches overflow instead, which is
+	// noticed.
+	go func() {
+		for {
+			var event notify.EventInfo
+			select {
+			case event = <-events:
+			case <-done:
+				return
+			}
+			mut.Lock()
+			// Roots may be inside each other, so an event can be in several.
+			for i, dir := range dirs {
+				rel, err := filepath.Rel(dir, event.Path())
+				if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) ||
+					strings.HasPrefix(filepath.Base(rel), tempPrefix) {
+					continue
+				}
+				if rel == "." {
+					rel = ""
+				}
+				batches[i].add([]string{filepath.ToSlash(rel)}, false)
+			}
+			mut.Unlock()
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	enc := gob.NewEncoder(w)
+	for {
+		select {
+		case err := <-closed:
+			return err
+		case <-changed:
+		}
+		select {
+		case err := <-closed:
+			return err
+		case <-time.After(watchLatency):
+		}
+
+		var pending []watchEvent
+		mut.Lock()
+		for i := range batches {
+			if batches[i].empty() {
+				continue
+			}
+			event := watchEvent{Root: roots[i]}
+			event.Paths, event.Overflow = batches[i].take()
+			pending = append(pending, event)
+		}
+		mut.Unlock()
+		for _, event := range pending {
+			err := enc.Encode(&event)
+			if err != nil {
+				return xerrors.Errorf("write event: %w", err)
+			}
+		}
+	}
+}
+
+// walkEntries calls fn with the entries of root and everything inside it that
+// isn't ignored, in lexical order. Symlinks aren't followed. Nothing is
+// called if root doesn't exist.
+func walkEntries(root, rel string, ignore *ignoreMatcher, fn func(fileEntry) error) error {
+	return filepath.Walk(root, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Paths may be removed during the walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ignore != nil && ignore.Ignored(localPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			// Files that are being written aren't synced until they're done.
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			// Devices, sockets and pipes aren't synced.
+			return nil
+		}
+
+		sub, err := filepath.Rel(root, localPath)
+		if err != nil {
+			return err
+		}
+		if sub != "." {
+			sub = path.Join(rel, filepath.ToSlash(sub))
+		} else {
+			sub = rel
+		}
+		entry := fileEntry{
+			Path:    sub,
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+		if entry.Mode.IsRegular() {
+			entry.Size = info.Size()
+		}
+		if entry.Mode&os.ModeSymlink != 0 {
+			entry.Link, err = os.Readlink(localPath)
+			if err != nil {
+				return err
+			}
+		}
+		return fn(entry)
+	})
+}
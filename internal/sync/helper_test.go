@@ -0,0 +1,81 @@
+package sync
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func Test_watchBatch(t *testing.T) {
+	t.Parallel()
+
+	var batch watchBatch
+	assert.True(t, "new batch is empty", batch.empty())
+	batch.add([]string{"b", "a"}, false)
+	batch.add([]string{"a"}, false)
+	paths, overflow := batch.take()
+	assert.Equal(t, "paths", []string{"a", "b"}, paths)
+	assert.False(t, "overflow", overflow)
+	assert.True(t, "taken batch is empty", batch.empty())
+
+	// Batches overflow once they're full, until they're taken.
+	for i := 0; i <= watchLimit; i++ {
+		batch.add([]string{fmt.Sprint(i)}, false)
+	}
+	batch.add([]string{"after"}, false)
+	paths, overflow = batch.take()
+	assert.Equal(t, "no paths", 0, len(paths))
+	assert.True(t, "overflow", overflow)
+	batch.add([]string{"a"}, false)
+	paths, overflow = batch.take()
+	assert.Equal(t, "paths", []string{"a"}, paths)
+	assert.False(t, "overflow", overflow)
+}
+
+func Test_ServeWatch(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "coder-sync-watch")
+	assert.Success(t, "create dir", err)
+	defer os.RemoveAll(root)
+
+	requests, requestsW := io.Pipe()
+	events, eventsW := io.Pipe()
+	defer requestsW.Close()
+	go func() {
+		err := ServeWatch([]string{root}, requests, eventsW)
+		_ = eventsW.CloseWithError(err)
+	}()
+	// Let the watch start.
+	time.Sleep(100 * time.Millisecond)
+
+	// Changes made while events aren't read aren't lost: there are either
+	// all of them or an overflow.
+	const files = watchLimit + 100
+	for i := 0; i < files; i++ {
+		err = ioutil.WriteFile(filepath.Join(root, fmt.Sprint(i)), nil, 0o644)
+		assert.Success(t, "write file", err)
+	}
+
+	dec := gob.NewDecoder(events)
+	seen := make(map[string]bool)
+	for len(seen) < files {
+		var event watchEvent
+		err = dec.Decode(&event)
+		assert.Success(t, "read event", err)
+		assert.Equal(t, "root", root, event.Root)
+		if event.Overflow {
+			return
+		}
+		for _, p := range event.Paths {
+			seen[p] = true
+		}
+	}
+}
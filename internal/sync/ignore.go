@@ -0,0 +1,374 @@
+package sync
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// ignoreFiles are read from every directory of the sync, in order, so
+// patterns in .coderignore override those in .gitignore.
+var ignoreFiles = []string{".gitignore", ".coderignore"}
+
+// defaultIgnores are ignored unless included again, like git does.
+var defaultIgnores = []string{".git"}
+
+// ignorePattern is a single pattern of an ignore file.
+type ignorePattern struct {
+	// base is the directory of the ignore file the pattern is from, relative
+	// to the root of the sync. Patterns only match paths inside it.
+	base []string
+	// segments are matched against path segments with path.Match, except for
+	// "**", which matches any number of segments.
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// parseIgnorePattern parses a line of an ignore file in the directory base.
+// It returns false for blank lines and comments.
+func parseIgnorePattern(base []string, line string) (ignorePattern, bool) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	p := ignorePattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	// Patterns without a slash match at any depth. Otherwise, they're
+	// relative to the directory of the ignore file.
+	if !strings.Contains(line, "/") {
+		p.segments = []string{"**", line}
+		return p, true
+	}
+	p.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	return p, true
+}
+
+// matches returns whether the pattern matches the path segments provided,
+// regardless of whether it negates.
+func (p ignorePattern) matches(parts []string) bool {
+	if len(parts) < len(p.base) {
+		return false
+	}
+	for i, segment := range p.base {
+		if parts[i] != segment {
+			return false
+		}
+	}
+	return matchSegments(p.segments, parts[len(p.base):])
+}
+
+func matchSegments(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		// A trailing "**" matches everything inside, but not the directory
+		// itself.
+		if len(pattern) == 1 {
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], parts[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], parts[1:])
+}
+
+// ignoreMatcher decides which paths of the sync are ignored, using the
+// semantics of .gitignore. Paths inside an ignored directory are always
+// ignored, even if a later pattern includes them.
+type ignoreMatcher struct {
+	root string
+	// overrides are the exclude and include patterns, which apply after
+	// the patterns of ignore files.
+	overrides []ignorePattern
+
+	mut      sync.RWMutex
+	patterns []ignorePattern
+}
+
+// newIgnoreMatcher reads the ignore files in root and its subdirectories.
+// Exclude patterns apply after the ignore files and include patterns after
+// them, so they take precedence.
+func newIgnoreMatcher(root string, exclude, include []string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{root: root}
+	for _, line := range exclude {
+		p, ok := parseIgnorePattern(nil, line)
+		if ok {
+			m.overrides = append(m.overrides, p)
+		}
+	}
+	for _, line := range include {
+		p, ok := parseIgnorePattern(nil, strings.TrimPrefix(line, "!"))
+		if ok {
+			p.negate = true
+			m.overrides = append(m.overrides, p)
+		}
+	}
+	err := m.reload()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// reload reads the ignore files again.
+func (m *ignoreMatcher) reload() error {
+	var patterns []ignorePattern
+	for _, line := range defaultIgnores {
+		p, _ := parseIgnorePattern(nil, line)
+		patterns = append(patterns, p)
+	}
+
+	// Ignore files in ignored directories are never read, so patterns are
+	// added as directories are walked.
+	walking := &ignoreMatcher{root: m.root, overrides: m.overrides, patterns: patterns}
+	err := filepath.Walk(m.root, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory may have been removed during the walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		rel, ok := walking.rel(localPath)
+		if ok && walking.Ignored(localPath, true) {
+			return filepath.SkipDir
+		}
+		var base []string
+		if ok {
+			base = strings.Split(rel, "/")
+		}
+		for _, name := range ignoreFiles {
+			filePatterns, err := readIgnoreFile(filepath.Join(localPath, name), base)
+			if err != nil {
+				return err
+			}
+			walking.patterns = append(walking.patterns, filePatterns...)
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("read ignore files: %w", err)
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.patterns = walking.patterns
+	return nil
+}
+
+// readIgnoreFile returns the patterns of an ignore file in the directory
+// base. A missing file has no patterns.
+func readIgnoreFile(name string, base []string) ([]ignorePattern, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readIgnorePatterns(f, base)
+}
+
+func readIgnorePatterns(r io.Reader, base []string) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p, ok := parseIgnorePattern(base, scanner.Text())
+		if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// rel returns the slash-separated path of localPath relative to the root. It
+// returns false for the root itself and paths outside of it.
+func (m *ignoreMatcher) rel(localPath string) (string, bool) {
+	rel, err := filepath.Rel(m.root, localPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Ignored returns whether the local path is ignored. Paths outside the root
+// are never ignored.
+func (m *ignoreMatcher) Ignored(localPath string, isDir bool) bool {
+	rel, ok := m.rel(localPath)
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	for i := 1; i < len(parts); i++ {
+		if m.match(parts[:i], true) {
+			return true
+		}
+	}
+	return m.match(parts, isDir)
+}
+
+// match returns whether the last pattern that matches ignores the path.
+func (m *ignoreMatcher) match(parts []string, isDir bool) bool {
+	ignored := false
+	for _, patterns := range [][]ignorePattern{m.patterns, m.overrides} {
+		for _, p := range patterns {
+			if p.dirOnly && !isDir {
+				continue
+			}
+			if p.matches(parts) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// ignoreRule is an ignorePattern that can be sent to the sync helper, so the
+// remote side of a sync ignores the same paths as the local one.
+type ignoreRule struct {
+	Base     []string
+	Segments []string
+	Negate   bool
+	DirOnly  bool
+}
+
+// rules returns the patterns of the matcher in the order they apply.
+func (m *ignoreMatcher) rules() []ignoreRule {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	rules := make([]ignoreRule, 0, len(m.patterns)+len(m.overrides))
+	for _, patterns := range [][]ignorePattern{m.patterns, m.overrides} {
+		for _, p := range patterns {
+			rules = append(rules, ignoreRule{
+				Base:     p.base,
+				Segments: p.segments,
+				Negate:   p.negate,
+				DirOnly:  p.dirOnly,
+			})
+		}
+	}
+	return rules
+}
+
+// newRuleMatcher returns a matcher for root with the rules of another
+// matcher. It never reads ignore files.
+func newRuleMatcher(root string, rules []ignoreRule) *ignoreMatcher {
+	m := &ignoreMatcher{root: root}
+	for _, rule := range rules {
+		m.patterns = append(m.patterns, ignorePattern{
+			base:     rule.Base,
+			segments: rule.Segments,
+			negate:   rule.Negate,
+			dirOnly:  rule.DirOnly,
+		})
+	}
+	return m
+}
+
+// isIgnoreFile returns whether changes to the local path should reload the
+// ignore files.
+func isIgnoreFile(localPath string) bool {
+	name := filepath.Base(localPath)
+	for _, ignoreFile := range ignoreFiles {
+		if name == ignoreFile {
+			return true
+		}
+	}
+	return false
+}
+
+// writeExcludes writes the paths under dir that are ignored to w, one per
+// line, for rsync's --exclude-from. Paths are anchored to the root of the
+// transfer, which is prefix when dir is transferred as a subdirectory.
+// Ignored directories aren't walked, so only the topmost ignored path is
+// written.
+func (m *ignoreMatcher) writeExcludes(w io.Writer, dir, prefix string) error {
+	return filepath.Walk(dir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if localPath == dir || !m.Ignored(localPath, info.IsDir()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, localPath)
+		if err != nil {
+			return err
+		}
+		// Anchor the path so it doesn't match files of the same name in
+		// other directories, and escape rsync's wildcards.
+		line := "/" + escapeRsyncPattern(path.Join(prefix, filepath.ToSlash(rel)))
+		if info.IsDir() {
+			line += "/"
+		}
+		_, err = io.WriteString(w, line+"\n")
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// escapeRsyncPattern escapes the characters rsync treats as wildcards.
+// Backslashes are only escapes in patterns with wildcards.
+func escapeRsyncPattern(name string) string {
+	if !strings.ContainsAny(name, "*?[") {
+		return name
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,129 @@
+package sync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(name), 0o755)
+		assert.Success(t, "create directory", err)
+		err = ioutil.WriteFile(name, []byte(content), 0o644)
+		assert.Success(t, "write file", err)
+	}
+}
+
+func Test_ignorePattern(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		pattern string
+		path    string
+		isDir   bool
+		matches bool
+	}{
+		{pattern: "*.log", path: "debug.log", matches: true},
+		{pattern: "*.log", path: "logs/debug.log", matches: true},
+		{pattern: "/*.log", path: "logs/debug.log", matches: false},
+		{pattern: "build/", path: "build", isDir: true, matches: true},
+		{pattern: "build/", path: "build", matches: false},
+		{pattern: "docs/*.md", path: "docs/a.md", matches: true},
+		{pattern: "docs/*.md", path: "src/docs/a.md", matches: false},
+		{pattern: "**/fixtures", path: "a/b/fixtures", isDir: true, matches: true},
+		{pattern: "a/**/b", path: "a/b", matches: true},
+		{pattern: "a/**/b", path: "a/x/y/b", matches: true},
+		{pattern: "out/**", path: "out", isDir: true, matches: false},
+		{pattern: "out/**", path: "out/bin", matches: true},
+		{pattern: `\#notes`, path: "#notes", matches: true},
+		{pattern: "# comment", path: "# comment", matches: false},
+	} {
+		p, ok := parseIgnorePattern(nil, test.pattern)
+		matches := ok && (!p.dirOnly || test.isDir) && p.matches(strings.Split(test.path, "/"))
+		assert.Equal(t, test.pattern+" "+test.path, test.matches, matches)
+	}
+}
+
+func Test_ignoreMatcher(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "coder-sync-ignore")
+	assert.Success(t, "create temp dir", err)
+	defer os.RemoveAll(root)
+	writeFiles(t, root, map[string]string{
+		".gitignore":              "node_modules/\n*.log\n!keep.log\nsecret.txt\n",
+		".coderignore":            "dist\n",
+		".git/HEAD":               "",
+		"keep.log":                "",
+		"debug.log":               "",
+		"main.go":                 "",
+		"secret.txt":              "",
+		"dist/app":                "",
+		"node_modules/x/index.js": "",
+		"node_modules/.gitignore": "!*.log\n",
+		"web/.gitignore":          "/generated\n",
+		"web/generated/a.js":      "",
+		"web/src/generated/b.js":  "",
+	})
+
+	m, err := newIgnoreMatcher(root, []string{"*.tmp"}, []string{"secret.txt"})
+	assert.Success(t, "create matcher", err)
+	for name, ignored := range map[string]bool{
+		".git":                    true,
+		".git/HEAD":               true,
+		"debug.log":               true,
+		"keep.log":                false,
+		"main.go":                 false,
+		"scratch.tmp":             true,
+		"secret.txt":              false,
+		"dist/app":                true,
+		"node_modules/x/index.js": true,
+		"web/generated/a.js":      true,
+		"web/src/generated/b.js":  false,
+	} {
+		localPath := filepath.Join(root, filepath.FromSlash(name))
+		info, err := os.Stat(localPath)
+		isDir := err == nil && info.IsDir()
+		assert.Equal(t, name, ignored, m.Ignored(localPath, isDir))
+	}
+	assert.False(t, "root", m.Ignored(root, true))
+	assert.False(t, "outside root", m.Ignored(filepath.Dir(root), true))
+
+	var buf bytes.Buffer
+	err = m.writeExcludes(&buf, root, "")
+	assert.Success(t, "write excludes", err)
+	excludes := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, "excludes", []string{
+		"/.git/",
+		"/debug.log",
+		"/dist/",
+		"/node_modules/",
+		"/web/generated/",
+	}, excludes)
+
+	buf.Reset()
+	err = m.writeExcludes(&buf, filepath.Join(root, "web"), "web")
+	assert.Success(t, "write subdirectory excludes", err)
+	assert.Equal(t, "subdirectory excludes", "/web/generated/\n", buf.String())
+
+	// Changes to ignore files apply once reloaded.
+	writeFiles(t, root, map[string]string{".coderignore": ""})
+	err = m.reload()
+	assert.Success(t, "reload", err)
+	assert.False(t, "dist", m.Ignored(filepath.Join(root, "dist"), true))
+}
+
+func Test_escapeRsyncPattern(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "plain", `a\b`, escapeRsyncPattern(`a\b`))
+	assert.Equal(t, "wildcards", `\[a]\*\\b`, escapeRsyncPattern(`[a]*\b`))
+}
@@ -0,0 +1,230 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/yaml.v2"
+
+	"cdr.dev/coder-cli/coder-sdk"
+	"cdr.dev/coder-cli/pkg/clog"
+)
+
+// ConfigPath is where the sync configuration of a project is, relative to
+// its directory.
+var ConfigPath = filepath.Join(".coder", "sync.yaml")
+
+// Config is the sync configuration of a project, which a Session runs.
+type Config struct {
+	// Workspace is the name of the workspace the directories are synced to.
+	Workspace string `yaml:"workspace"`
+	// Syncs are the directories to sync.
+	Syncs []SyncConfig `yaml:"syncs"`
+}
+
+// SyncConfig is a directory of a sync configuration.
+type SyncConfig struct {
+	// Name tells the sync apart in logs. It defaults to Local.
+	Name string `yaml:"name"`
+	// Local is the local directory, relative to the project's directory.
+	// It's absolute once the configuration is read.
+	Local string `yaml:"local"`
+	// Remote is the directory in the workspace.
+	Remote string `yaml:"remote"`
+	// Mode is the direction of the sync, which is one-way by default.
+	Mode Mode `yaml:"mode"`
+	// Exclude and Include are like the fields of Sync.
+	Exclude []string `yaml:"exclude"`
+	Include []string `yaml:"include"`
+}
+
+// ReadConfig reads a sync configuration file. The project's directory is the
+// one that contains its .coder directory, or the file itself if it isn't in
+// one.
+func ReadConfig(configPath string) (*Config, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, xerrors.Errorf("read sync config: %w", err)
+	}
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+	projectDir := filepath.Dir(configPath)
+	if filepath.Base(projectDir) == ".coder" {
+		projectDir = filepath.Dir(projectDir)
+	}
+	config, err := parseConfig(data, projectDir)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", configPath, err)
+	}
+	return config, nil
+}
+
+// parseConfig parses a sync configuration, filling in defaults and making
+// local directories absolute.
+func parseConfig(data []byte, projectDir string) (*Config, error) {
+	var config Config
+	err := yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, xerrors.Errorf("parse sync config: %w", err)
+	}
+	if len(config.Syncs) == 0 {
+		return nil, xerrors.New("no syncs are configured")
+	}
+
+	var (
+		names   = make(map[string]bool)
+		remotes = make(map[string]bool)
+	)
+	for i := range config.Syncs {
+		c := &config.Syncs[i]
+		if c.Remote == "" {
+			return nil, xerrors.Errorf("sync %d has no remote directory", i+1)
+		}
+		if c.Local == "" {
+			c.Local = "."
+		}
+		if c.Name == "" {
+			c.Name = filepath.ToSlash(filepath.Clean(c.Local))
+		}
+		if names[c.Name] {
+			return nil, xerrors.Errorf("sync name %q is used twice", c.Name)
+		}
+		names[c.Name] = true
+		// Watch events are told apart by their remote directory.
+		if remotes[c.Remote] {
+			return nil, xerrors.Errorf("remote directory %q is synced twice", c.Remote)
+		}
+		remotes[c.Remote] = true
+
+		c.Mode, err = ParseMode(string(c.Mode))
+		if err != nil {
+			return nil, xerrors.Errorf("sync %q: %w", c.Name, err)
+		}
+		if !filepath.IsAbs(c.Local) {
+			c.Local = filepath.Join(projectDir, filepath.FromSlash(c.Local))
+		}
+	}
+	return &config, nil
+}
+
+// Session runs the syncs of a configuration in one process. They share the
+// helpers started in the workspace, so a session has one connection for
+// transfers and one for watching remote directories, however many
+// directories it syncs.
+type Session struct {
+	Config *Config
+	// Init sets whether the syncs do the initial sync and then return.
+	Init bool
+
+	Workspace           coder.Workspace
+	Client              coder.Client
+	OutW                io.Writer
+	ErrW                io.Writer
+	IsInteractiveOutput bool
+
+	helper  *helperClient
+	watcher *remoteWatcher
+}
+
+// Run runs the syncs until they all stop. A sync that fails doesn't stop the
+// others.
+func (s *Session) Run() error {
+	var remoteDirs, watchedDirs []string
+	for _, c := range s.Config.Syncs {
+		info, err := os.Stat(c.Local)
+		if err != nil {
+			return xerrors.Errorf("sync %q: %w", c.Name, err)
+		}
+		if !info.IsDir() {
+			return xerrors.Errorf("sync %q: %s isn't a directory", c.Name, c.Local)
+		}
+		remoteDirs = append(remoteDirs, c.Remote)
+		if c.Mode == ModeTwoWay {
+			watchedDirs = append(watchedDirs, c.Remote)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Directories are expanded like the helper's.
+	err := execRemote(ctx, s.Client, &s.Workspace, nil, ioutil.Discard, `for dir; do
+	case $dir in "~" | "~/"*) dir="$HOME${dir#\~}" ;; esac
+	mkdir -p -- "$dir"
+done`, append([]string{"sh"}, remoteDirs...)...)
+	if err != nil {
+		return xerrors.Errorf("create remote directories: %w", err)
+	}
+
+	s.helper = &helperClient{
+		dial: func(ctx context.Context) (*helperConn, error) {
+			return dialHelper(ctx, s.Client, &s.Workspace, remoteDirs[0])
+		},
+	}
+	defer func() { _ = s.helper.close() }() // Best effort.
+	// The helper is started before the syncs, so they don't each fail if it
+	// can't be.
+	err = s.helper.do(context.Background(), remoteDirs[0], func(*helperConn) error { return nil })
+	if err != nil {
+		return err
+	}
+	s.watcher = &remoteWatcher{
+		start: func(ctx context.Context) (*helperProcess, error) {
+			return startHelper(ctx, s.Client, &s.Workspace, append([]string{"--watch", "--"}, watchedDirs...)...)
+		},
+	}
+	defer func() { _ = s.watcher.close() }() // Best effort.
+
+	s.logSyncs()
+	group := clog.LoggedErrGroup()
+	for _, c := range s.Config.Syncs {
+		pair := Sync{
+			Init:                s.Init,
+			LocalDir:            c.Local,
+			RemoteDir:           c.Remote,
+			Exclude:             c.Exclude,
+			Include:             c.Include,
+			Mode:                c.Mode,
+			Name:                c.Name,
+			Workspace:           s.Workspace,
+			Client:              s.Client,
+			OutW:                s.OutW,
+			ErrW:                s.ErrW,
+			IsInteractiveOutput: s.IsInteractiveOutput,
+			session:             s,
+		}
+		group.Go(func() error {
+			for {
+				err := pair.Run()
+				if err == ErrRestartSync {
+					continue
+				}
+				if err != nil {
+					return xerrors.Errorf("sync %q: %w", pair.Name, err)
+				}
+				return nil
+			}
+		})
+	}
+	return group.Wait()
+}
+
+// logSyncs logs the directories of the session.
+func (s *Session) logSyncs() {
+	lines := make([]string, 0, len(s.Config.Syncs))
+	for _, c := range s.Config.Syncs {
+		arrow := "->"
+		if c.Mode == ModeTwoWay {
+			arrow = "<->"
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s %s %s:%s", c.Name, c.Local, arrow, s.Workspace.Name, c.Remote))
+	}
+	clog.LogInfo(fmt.Sprintf("syncing %d directories", len(s.Config.Syncs)), lines...)
+}
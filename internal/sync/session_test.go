@@ -0,0 +1,56 @@
+package sync
+
+import (
+	"path/filepath"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func Test_parseConfig(t *testing.T) {
+	t.Parallel()
+
+	projectDir := filepath.FromSlash("/home/user/app")
+	config, err := parseConfig([]byte(`
+workspace: dev
+syncs:
+  - local: frontend
+    remote: /home/coder/app/frontend
+    exclude: ["node_modules"]
+  - name: api
+    local: services/api
+    remote: ~/app/api
+    mode: two-way
+`), projectDir)
+	assert.Success(t, "parse config", err)
+	assert.Equal(t, "config", &Config{
+		Workspace: "dev",
+		Syncs: []SyncConfig{{
+			Name:    "frontend",
+			Local:   filepath.Join(projectDir, "frontend"),
+			Remote:  "/home/coder/app/frontend",
+			Mode:    ModeOneWay,
+			Exclude: []string{"node_modules"},
+		}, {
+			Name:   "api",
+			Local:  filepath.Join(projectDir, "services", "api"),
+			Remote: "~/app/api",
+			Mode:   ModeTwoWay,
+		}},
+	}, config)
+
+	for _, test := range []struct {
+		name   string
+		config string
+	}{
+		{name: "NoSyncs", config: "workspace: dev"},
+		{name: "UnknownField", config: "syncs: [{local: a, remote: /a, excludes: [b]}]"},
+		{name: "NoRemote", config: "syncs: [{local: a}]"},
+		{name: "UnknownMode", config: "syncs: [{local: a, remote: /a, mode: three-way}]"},
+		{name: "SameName", config: "syncs: [{local: a, remote: /a}, {local: b, name: a, remote: /b}]"},
+		{name: "SameRemote", config: "syncs: [{local: a, remote: /a}, {local: b, remote: /a}]"},
+	} {
+		_, err := parseConfig([]byte(test.config), projectDir)
+		assert.Error(t, test.name, err)
+	}
+}
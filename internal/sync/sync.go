@@ -40,6 +40,21 @@ type Sync struct {
 	RemoteDir string
 	// DisableMetrics disables activity metric pushing.
 	DisableMetrics bool
+	// Exclude are patterns of paths not to sync, in addition to those of
+	// .gitignore and .coderignore files. They use the syntax of .gitignore.
+	Exclude []string
+	// Include are patterns of paths to sync even if they're ignored. Paths
+	// inside an ignored directory can't be included.
+	Include []string
+	// Rsync transfers files with rsync, which must be installed locally and
+	// in the workspace, instead of the built-in engine.
+	Rsync bool
+	// Mode is the direction of the sync, which is one-way if it's empty.
+	// Two-way syncs can't use rsync.
+	Mode Mode
+	// Name prefixes the logs of the sync if it's set, which tells the syncs
+	// of a session apart.
+	Name string
 
 	Workspace           coder.Workspace
 	Client              coder.Client
@@ -47,6 +62,12 @@ type Sync struct {
 	ErrW                io.Writer
 	InputReader         io.Reader
 	IsInteractiveOutput bool
+
+	// ignore and engine are set by Run. engine is nil when rsync is used.
+	ignore *ignoreMatcher
+	engine *engine
+	// session is set for the syncs of a session, which share its helpers.
+	session *Session
 }
 
 // See https://lxadm.com/Rsync_exit_codes#List_of_standard_rsync_exit_codes.
@@ -61,7 +82,7 @@ func (s Sync) syncPaths(delete bool, local, remote string) error {
 	args := []string{"-zz",
 		"-a",
 		"--delete",
-		"-e", self + " sh", local, s.Workspace.Name + ":" + remote,
+		"-e", self + " rsh", local, s.Workspace.Name + ":" + remote,
 	}
 	if delete {
 		args = append([]string{"--delete"}, args...)
@@ -69,6 +90,14 @@ func (s Sync) syncPaths(delete bool, local, remote string) error {
 	if os.Getenv("DEBUG_RSYNC") != "" {
 		args = append([]string{"--progress"}, args...)
 	}
+	excludeFrom, err := s.rsyncExcludes(local)
+	if err != nil {
+		return err
+	}
+	if excludeFrom != "" {
+		defer os.Remove(excludeFrom)
+		args = append([]string{"--exclude-from", excludeFrom}, args...)
+	}
 
 	// See https://unix.stackexchange.com/questions/188737/does-compression-option-z-with-rsync-speed-up-backup
 	// on compression level.
@@ -125,20 +154,103 @@ func (s Sync) remoteCmd(ctx context.Context, prog string, args ...string) error
 	return nil
 }
 
+// rsyncExcludes writes the ignored paths under the local path to a temporary
+// file for rsync's --exclude-from and returns its name. Nothing is written if
+// the local path isn't a directory.
+func (s Sync) rsyncExcludes(local string) (string, error) {
+	if s.ignore == nil {
+		return "", nil
+	}
+	// A trailing "/." transfers the contents of the directory instead of the
+	// directory itself.
+	dir, prefix := strings.TrimSuffix(local, "/."), ""
+	if dir == local {
+		prefix = filepath.Base(local)
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return "", nil
+	}
+
+	f, err := ioutil.TempFile("", "coder-sync-exclude")
+	if err != nil {
+		return "", xerrors.Errorf("create exclude file: %w", err)
+	}
+	defer f.Close()
+	err = s.ignore.writeExcludes(f, dir, prefix)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", xerrors.Errorf("write exclude file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// relPath returns the slash-separated path of the local path relative to the
+// local directory, which is empty for the directory itself.
+func (s Sync) relPath(localPath string) (string, error) {
+	rel, err := filepath.Rel(s.LocalDir, localPath)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// ignored returns whether the path of an event is ignored. Removed paths are
+// ignored if they would be as either a file or a directory.
+func (s Sync) ignored(localPath string) bool {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return s.ignore.Ignored(localPath, false) || s.ignore.Ignored(localPath, true)
+	}
+	return s.ignore.Ignored(localPath, info.IsDir())
+}
+
+// header prefixes a log header with the name of the sync, if it has one.
+func (s Sync) header(header string) string {
+	if s.Name == "" {
+		return header
+	}
+	return "[" + s.Name + "] " + header
+}
+
 // initSync performs the initial synchronization of the directory.
 func (s Sync) initSync() error {
-	clog.LogInfo(fmt.Sprintf("doing initial sync (%s -> %s)", s.LocalDir, s.RemoteDir))
+	arrow := "->"
+	if s.Mode == ModeTwoWay {
+		arrow = "<->"
+	}
+	clog.LogInfo(s.header(fmt.Sprintf("doing initial sync (%s %s %s)", s.LocalDir, arrow, s.RemoteDir)))
 
 	start := time.Now()
-	// Delete old files on initial sync (e.g git checkout).
-	// Add the "/." to the local directory so rsync doesn't try to place the directory
-	// into the remote dir.
-	if err := s.syncPaths(true, s.LocalDir+"/.", s.RemoteDir); err != nil {
-		return err
+	if s.Mode == ModeTwoWay {
+		result, err := s.engine.reconcile(context.Background(), []string{""})
+		s.logConflicts(result)
+		if err != nil {
+			return xerrors.Errorf("initial sync: %w", err)
+		}
+		clog.LogSuccess(s.header(fmt.Sprintf("finished initial sync (%s): pushed %d, pulled %d, removed %d",
+			time.Since(start).Truncate(time.Millisecond),
+			len(result.Pushed), len(result.Pulled), len(result.RemovedRemote)+len(result.RemovedLocal),
+		)))
+		return nil
+	} else if s.engine != nil {
+		if err := s.engine.push(context.Background(), ""); err != nil {
+			return xerrors.Errorf("initial sync: %w", err)
+		}
+	} else {
+		// Delete old files on initial sync (e.g git checkout).
+		// Add the "/." to the local directory so rsync doesn't try to place the directory
+		// into the remote dir.
+		if err := s.syncPaths(true, s.LocalDir+"/.", s.RemoteDir); err != nil {
+			return err
+		}
 	}
-	clog.LogSuccess(
+	clog.LogSuccess(s.header(
 		fmt.Sprintf("finished initial sync (%s)", time.Since(start).Truncate(time.Millisecond)),
-	)
+	))
 	return nil
 }
 
@@ -151,6 +263,14 @@ func (s Sync) convertPath(local string) string {
 }
 
 func (s Sync) handleCreate(localPath string) error {
+	if s.engine != nil {
+		// The engine handles paths that were quickly deleted by removing them.
+		rel, err := s.relPath(localPath)
+		if err != nil {
+			return err
+		}
+		return s.engine.push(context.Background(), rel)
+	}
 	target := s.convertPath(localPath)
 
 	if err := s.syncPaths(false, localPath, target); err != nil {
@@ -167,6 +287,13 @@ func (s Sync) handleDelete(localPath string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
+	if s.engine != nil {
+		rel, err := s.relPath(localPath)
+		if err != nil {
+			return err
+		}
+		return s.engine.remove(ctx, rel)
+	}
 	return s.remoteCmd(ctx, "rm", "-rf", s.convertPath(localPath))
 }
 
@@ -175,7 +302,10 @@ func (s Sync) handleRename(localPath string) error {
 	// for the old (gone) file and one for the new file.
 	// Catching both would require complex state.
 	// Instead, we turn it into a Create or Delete based
-	// on file existence.
+	// on file existence, which the engine's push already does.
+	if s.engine != nil {
+		return s.handleCreate(localPath)
+	}
 	info, err := os.Stat(localPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -203,16 +333,16 @@ func (s Sync) work(ev timedEvent) {
 	case notify.Remove:
 		err = s.handleDelete(localPath)
 	default:
-		clog.LogInfo(fmt.Sprintf("unhandled event %+v %s", ev.Event(), ev.Path()))
+		clog.LogInfo(s.header(fmt.Sprintf("unhandled event %+v %s", ev.Event(), ev.Path())))
 	}
 
 	log := fmt.Sprintf("%v %s (%s)",
 		ev.Event(), filepath.Base(localPath), time.Since(ev.CreatedAt).Truncate(time.Millisecond*10),
 	)
 	if err != nil {
-		clog.Log(clog.Error(fmt.Sprintf("%s: %s", log, err)))
+		clog.Log(clog.Error(s.header(fmt.Sprintf("%s: %s", log, err))))
 	} else {
-		clog.LogSuccess(log)
+		clog.LogSuccess(s.header(log))
 	}
 }
 
@@ -221,6 +351,20 @@ var ErrRestartSync = errors.New("the sync exited because it was overloaded, rest
 
 // workEventGroup converges a group of events to prevent duplicate work.
 func (s Sync) workEventGroup(evs []timedEvent) {
+	if s.Mode == ModeTwoWay {
+		// Two-way syncs decide what to do from the state of both sides, so
+		// only the paths matter.
+		var rels []string
+		for _, ev := range evs {
+			rel, err := s.relPath(ev.Path())
+			if err == nil {
+				rels = append(rels, rel)
+			}
+		}
+		s.reconcilePaths(rels)
+		return
+	}
+
 	cache := eventCache{}
 	for _, ev := range evs {
 		cache.Add(ev)
@@ -241,7 +385,7 @@ func (s Sync) workEventGroup(evs []timedEvent) {
 
 	var wg sync.WaitGroup
 	for _, ev := range cache.ConcurrentEvents() {
-		setConsoleTitle(fmtUpdateTitle(ev.Path()), s.IsInteractiveOutput)
+		setConsoleTitle(s.header(fmtUpdateTitle(ev.Path())), s.IsInteractiveOutput)
 
 		wg.Add(1)
 		// TODO: Document why this error is discarded. See https://github.com/cdr/coder-cli/issues/122 for reference.
@@ -272,7 +416,7 @@ const (
 	maxAcceptableDispatch = 50 * time.Millisecond
 )
 
-// Version returns remote protocol version as a string.
+// Version returns the remote rsync protocol version as a string.
 // Or, an error if one exists.
 func (s Sync) Version() (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -312,9 +456,43 @@ func (s Sync) Version() (string, error) {
 }
 
 // Run starts the sync synchronously.
-// Use this command to debug what wasn't sync'd correctly:
-// rsync -e "coder sh" -nicr ~/Projects/cdr/coder-cli/. ammar:/home/coder/coder-cli/.
+// When using rsync, use this command to debug what wasn't sync'd correctly:
+// rsync -e "coder rsh" -nicr ~/Projects/cdr/coder-cli/. ammar:/home/coder/coder-cli/.
 func (s Sync) Run() error {
+	ignore, err := newIgnoreMatcher(s.LocalDir, s.Exclude, s.Include)
+	if err != nil {
+		return err
+	}
+	s.ignore = ignore
+	if s.Mode == ModeTwoWay && s.Rsync {
+		return xerrors.New("two-way syncs can't use rsync")
+	}
+	if !s.Rsync {
+		s.engine = &engine{
+			localDir:  s.LocalDir,
+			remoteDir: s.RemoteDir,
+			ignore:    ignore,
+		}
+		if s.session != nil {
+			s.engine.helper = s.session.helper
+		} else {
+			helper := &helperClient{
+				dial: func(ctx context.Context) (*helperConn, error) {
+					return dialHelper(ctx, s.Client, &s.Workspace, s.RemoteDir)
+				},
+			}
+			s.engine.helper = helper
+			defer func() { _ = helper.close() }() // Best effort.
+		}
+	}
+	if s.Mode == ModeTwoWay {
+		s.engine.state, err = loadSyncState(syncStateFile(s.Workspace.ID, s.LocalDir, s.RemoteDir))
+		if err != nil {
+			return err
+		}
+		s.engine.writer = newFileWriter(s.LocalDir)
+	}
+
 	events := make(chan notify.EventInfo, maxInflightInotify)
 	// Set up a recursive watch.
 	// We do this before the initial sync so we can capture any changes
@@ -327,14 +505,49 @@ func (s Sync) Run() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	if err := s.remoteCmd(ctx, "mkdir", "-p", s.RemoteDir); err != nil {
-		return xerrors.Errorf("create remote directory: %w", err)
+	// Sessions create the directories of their syncs at once.
+	if s.session == nil {
+		if err := s.remoteCmd(ctx, "mkdir", "-p", s.RemoteDir); err != nil {
+			return xerrors.Errorf("create remote directory: %w", err)
+		}
+	}
+
+	// Sessions start their helper themselves. Otherwise, it's started now, so
+	// one-way syncs can use rsync if there's no helper for the workspace.
+	if s.engine != nil && s.session == nil {
+		err := s.engine.do(context.Background(), func(*helperConn) error { return nil })
+		var unavailable *helperUnavailableError
+		if s.Mode != ModeTwoWay && xerrors.As(err, &unavailable) {
+			clog.LogWarn(s.header("using rsync"), err.Error())
+			s.Rsync, s.engine = true, nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Like the local watch, the remote one starts before the initial sync.
+	var (
+		remote      *watchSubscription
+		remoteReady <-chan struct{}
+		remoteErrs  <-chan error
+	)
+	if s.Mode == ModeTwoWay && !s.Init {
+		watcher := s.remoteWatcher()
+		if s.session == nil {
+			defer func() { _ = watcher.close() }() // Best effort.
+		}
+		sub, err := watcher.subscribe(ctx, s.RemoteDir)
+		if err != nil {
+			return err
+		}
+		defer watcher.unsubscribe(s.RemoteDir, sub)
+		remote, remoteReady, remoteErrs = sub, sub.ready, sub.errs
 	}
 
 	ap := activity.NewPusher(s.Client, s.Workspace.ID, activityName)
 	ap.Push(ctx)
 
-	setConsoleTitle("⏳ syncing project", s.IsInteractiveOutput)
+	setConsoleTitle(s.header("⏳ syncing project"), s.IsInteractiveOutput)
 	if err := s.initSync(); err != nil {
 		return err
 	}
@@ -343,7 +556,7 @@ func (s Sync) Run() error {
 		return nil
 	}
 
-	clog.LogInfo(fmt.Sprintf("watching %s for changes", s.LocalDir))
+	clog.LogInfo(s.header(fmt.Sprintf("watching %s for changes", s.LocalDir)))
 
 	var droppedEvents uint64
 	// Timed events lets us track how long each individual file takes to
@@ -352,6 +565,16 @@ func (s Sync) Run() error {
 	go func() {
 		defer close(timedEvents)
 		for event := range events {
+			if isIgnoreFile(event.Path()) {
+				err := s.ignore.reload()
+				if err != nil {
+					clog.LogInfo(s.header(fmt.Sprintf("reload ignore files: %s", err)))
+				}
+			}
+			// Ignored paths are filtered here so they can't overload the sync.
+			if s.ignored(event.Path()) {
+				continue
+			}
 			select {
 			case timedEvents <- timedEvent{
 				CreatedAt: time.Now(),
@@ -359,7 +582,7 @@ func (s Sync) Run() error {
 			}:
 			default:
 				if atomic.AddUint64(&droppedEvents, 1) == 1 {
-					clog.LogInfo("dropped event, sync should restart soon")
+					clog.LogInfo(s.header("dropped event, sync should restart soon"))
 				}
 			}
 		}
@@ -371,7 +594,7 @@ func (s Sync) Run() error {
 	defer dispatchEventGroup.Stop()
 	for {
 		const watchingFilesystemTitle = "🛰 watching filesystem"
-		setConsoleTitle(watchingFilesystemTitle, s.IsInteractiveOutput)
+		setConsoleTitle(s.header(watchingFilesystemTitle), s.IsInteractiveOutput)
 
 		select {
 		case ev := <-timedEvents:
@@ -390,6 +613,26 @@ func (s Sync) Run() error {
 			s.workEventGroup(eventGroup)
 			eventGroup = eventGroup[:0]
 			ap.Push(context.TODO())
+		case <-remoteReady:
+			rels, overflow := remote.take()
+			if overflow {
+				clog.LogInfo(s.header("too many paths changed in the workspace to track, syncing everything"))
+			}
+			// Events of ignored paths are filtered here, like local ones.
+			var filtered []string
+			for _, rel := range rels {
+				if !s.ignored(filepath.Join(s.LocalDir, filepath.FromSlash(rel))) {
+					filtered = append(filtered, rel)
+				}
+			}
+			if len(filtered) == 0 {
+				continue
+			}
+			s.reconcilePaths(filtered)
+			ap.Push(context.TODO())
+		case err := <-remoteErrs:
+			clog.LogInfo(s.header(fmt.Sprintf("workspace watch stopped: %s", err)))
+			return ErrRestartSync
 		}
 	}
 }
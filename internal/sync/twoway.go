@@ -0,0 +1,708 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/coder-cli/internal/config"
+	"cdr.dev/coder-cli/pkg/clog"
+)
+
+// Mode is the direction of a sync.
+type Mode string
+
+// Mode enums.
+const (
+	// ModeOneWay makes the remote directory match the local one. Remote
+	// changes are overwritten.
+	ModeOneWay Mode = "one-way"
+	// ModeTwoWay propagates the changes of each side to the other. When both
+	// sides change a path, the remote version is kept as a conflict copy.
+	ModeTwoWay Mode = "two-way"
+)
+
+// ParseMode returns the mode named s, which is one-way if s is empty.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case "":
+		return ModeOneWay, nil
+	case ModeOneWay, ModeTwoWay:
+		return mode, nil
+	default:
+		return "", xerrors.Errorf("unknown sync mode %q, expected %q or %q", s, ModeOneWay, ModeTwoWay)
+	}
+}
+
+// syncedEntry is what each side of a two-way sync had when a path was last
+// synced. The sides can differ in ways that don't matter, like the
+// modification times of files that were the same when the sync started.
+type syncedEntry struct {
+	Local  fileEntry
+	Remote fileEntry
+}
+
+// syncState is the last-synced manifest of a two-way sync, which tells which
+// side changed a path. It's saved in the configuration directory, so changes
+// made while the sync isn't running aren't mistaken for conflicts.
+type syncState struct {
+	file    config.File
+	entries map[string]syncedEntry
+}
+
+// syncStateFile returns the file the state of a sync is saved in.
+func syncStateFile(workspaceID, localDir, remoteDir string) config.File {
+	sum := sha256.Sum256([]byte(workspaceID + "\x00" + localDir + "\x00" + remoteDir))
+	return config.File(path.Join("sync", hex.EncodeToString(sum[:8])+".json"))
+}
+
+// loadSyncState reads the state saved in file. A missing file is an empty
+// state, and an empty file name is never saved.
+func loadSyncState(file config.File) (*syncState, error) {
+	s := &syncState{file: file, entries: make(map[string]syncedEntry)}
+	if file == "" {
+		return s, nil
+	}
+	data, err := file.Read()
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("read sync state: %w", err)
+	}
+	err = json.Unmarshal([]byte(data), &s.entries)
+	if err != nil {
+		return nil, xerrors.Errorf("parse sync state: %w", err)
+	}
+	return s, nil
+}
+
+func (s *syncState) save() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	return s.file.Write(string(data))
+}
+
+// under returns the entries of the paths and everything inside them.
+func (s *syncState) under(rels []string) map[string]syncedEntry {
+	entries := make(map[string]syncedEntry)
+	for p, entry := range s.entries {
+		for _, rel := range rels {
+			if isUnder(p, rel) {
+				entries[p] = entry
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// forget removes the entries of the path and everything inside it.
+func (s *syncState) forget(rel string) {
+	for p := range s.entries {
+		if isUnder(p, rel) {
+			delete(s.entries, p)
+		}
+	}
+}
+
+// isUnder returns whether p is rel or inside it. Every path is inside the
+// root, which is empty.
+func isUnder(p, rel string) bool {
+	return rel == "" || p == rel || strings.HasPrefix(p, rel+"/")
+}
+
+// topmostPaths returns the paths that aren't inside another, sorted.
+func topmostPaths(rels []string) []string {
+	sorted := append([]string(nil), rels...)
+	sortPaths(sorted)
+	var topmost []string
+	for _, p := range sorted {
+		if len(topmost) > 0 && isUnder(p, topmost[len(topmost)-1]) {
+			continue
+		}
+		topmost = append(topmost, p)
+	}
+	return topmost
+}
+
+// sortPaths sorts paths so directories are followed by everything inside
+// them, and nothing else.
+func sortPaths(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.ReplaceAll(paths[i], "/", "\x00") < strings.ReplaceAll(paths[j], "/", "\x00")
+	})
+}
+
+// syncAction is what a two-way sync does with a path.
+type syncAction int
+
+const (
+	actionNone syncAction = iota
+	actionPush
+	actionPull
+	actionRemoveRemote
+	actionRemoveLocal
+	actionConflict
+	// actionRecord records a path that changed the same way on both sides.
+	actionRecord
+	// actionForget forgets a path that was removed on both sides.
+	actionForget
+)
+
+// reconcileResult is what a two-way sync changed.
+type reconcileResult struct {
+	Pushed        []string
+	Pulled        []string
+	RemovedRemote []string
+	RemovedLocal  []string
+	Conflicts     []conflict
+}
+
+// conflict is a path that changed on both sides of a two-way sync. The
+// local version is kept, and the remote one is copied to Copy on both sides.
+type conflict struct {
+	Path string
+	Copy string
+}
+
+// reconcile propagates the changes of the paths on each side of a two-way
+// sync to the other, and saves the state of the sync.
+func (e *engine) reconcile(ctx context.Context, rels []string) (reconcileResult, error) {
+	var result reconcileResult
+	err := e.do(ctx, func(h *helperConn) error {
+		retry, err := e.reconcileOnce(h, topmostPaths(rels), &result)
+		var transferErr *transferError
+		if len(retry) > 0 && (err == nil || xerrors.As(err, &transferErr)) {
+			// Conflicts are synced like new paths once the remote versions
+			// are moved out of the way.
+			_, retryErr := e.reconcileOnce(h, topmostPaths(retry), &result)
+			if err == nil {
+				err = retryErr
+			}
+		}
+		saveErr := e.state.save()
+		if err == nil && saveErr != nil {
+			err = xerrors.Errorf("save sync state: %w", saveErr)
+		}
+		return err
+	})
+	return result, err
+}
+
+// reconcileOnce syncs the paths, returning the paths of conflicts to sync
+// again.
+func (e *engine) reconcileOnce(h *helperConn, rels []string, result *reconcileResult) ([]string, error) {
+	local, err := e.localEntryMap(rels)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := e.remoteManifest(h, rels, false)
+	if err != nil {
+		return nil, err
+	}
+	actions, paths, err := e.plan(h, rels, local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		removeRemote, removeLocal, retry []string
+		pushes, pulls                    []fileEntry
+	)
+	for _, p := range paths {
+		switch actions[p] {
+		case actionPush:
+			pushes = append(pushes, local[p])
+		case actionPull:
+			pulls = append(pulls, remote[p])
+		case actionRemoveRemote:
+			if len(removeRemote) == 0 || !isUnder(p, removeRemote[len(removeRemote)-1]) {
+				removeRemote = append(removeRemote, p)
+			}
+		case actionRemoveLocal:
+			if len(removeLocal) == 0 || !isUnder(p, removeLocal[len(removeLocal)-1]) {
+				removeLocal = append(removeLocal, p)
+			}
+		case actionConflict:
+			name, err := e.conflictName(h, p, local, remote)
+			if err != nil {
+				return nil, err
+			}
+			err = h.send(helperRequest{Op: opRename, Paths: []string{p, name}})
+			if err != nil {
+				return nil, err
+			}
+			e.state.forget(p)
+			retry = append(retry, p, name)
+			result.Conflicts = append(result.Conflicts, conflict{Path: p, Copy: name})
+		case actionRecord:
+			e.state.entries[p] = syncedEntry{Local: local[p], Remote: remote[p]}
+		case actionForget:
+			e.state.forget(p)
+		}
+	}
+
+	if len(removeRemote) > 0 {
+		err = h.send(helperRequest{Op: opRemove, Paths: removeRemote})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range removeLocal {
+		e.writer.remove(p)
+	}
+	errs, err := e.pushEntries(h, pushes, remote)
+	if err != nil {
+		return nil, err
+	}
+	pullErrs, err := e.pullEntries(h, pulls, local)
+	if err != nil {
+		return nil, err
+	}
+	errs = append(errs, pullErrs...)
+	err = flush(h)
+	var transferErr *transferError
+	if xerrors.As(err, &transferErr) {
+		errs = append(errs, transferErr.errs...)
+	} else if err != nil {
+		return nil, err
+	}
+	errs = append(errs, e.writer.flush()...)
+
+	// Paths are only recorded as synced once they're confirmed to be, so
+	// failures and changes made during the sync are synced again later.
+	localNow, err := e.localEntryMap(rels)
+	if err != nil {
+		return nil, err
+	}
+	remoteNow, err := e.remoteManifest(h, rels, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range pushes {
+		now, ok := remoteNow[entry.Path]
+		if ok && wrote(entry, now) {
+			e.state.entries[entry.Path] = syncedEntry{Local: entry, Remote: now}
+			result.Pushed = append(result.Pushed, entry.Path)
+		}
+	}
+	for _, entry := range pulls {
+		now, ok := localNow[entry.Path]
+		if ok && wrote(entry, now) {
+			e.state.entries[entry.Path] = syncedEntry{Local: now, Remote: entry}
+			result.Pulled = append(result.Pulled, entry.Path)
+		}
+	}
+	for _, removes := range []struct {
+		paths  []string
+		result *[]string
+	}{
+		{paths: removeRemote, result: &result.RemovedRemote},
+		{paths: removeLocal, result: &result.RemovedLocal},
+	} {
+		for _, p := range removes.paths {
+			_, localOK := localNow[p]
+			_, remoteOK := remoteNow[p]
+			if !localOK && !remoteOK {
+				e.state.forget(p)
+				*removes.result = append(*removes.result, p)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return retry, &transferError{errs: errs}
+	}
+	return retry, nil
+}
+
+// plan decides what to do with each path, returning the paths sorted.
+func (e *engine) plan(h *helperConn, rels []string, local, remote map[string]fileEntry) (map[string]syncAction, []string, error) {
+	base := e.state.under(rels)
+	var paths []string
+	for _, entries := range []map[string]fileEntry{local, remote} {
+		for p := range entries {
+			paths = append(paths, p)
+		}
+	}
+	for p := range base {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	unique := paths[:0]
+	for i, p := range paths {
+		if i == 0 || p != paths[i-1] {
+			unique = append(unique, p)
+		}
+	}
+	paths = unique
+	sortPaths(paths)
+
+	actions := make(map[string]syncAction, len(paths))
+	var sameSize []string
+	for _, p := range paths {
+		l, localOK := local[p]
+		r, remoteOK := remote[p]
+		b, baseOK := base[p]
+		localChanged := changed(l, localOK, b.Local, baseOK)
+		remoteChanged := changed(r, remoteOK, b.Remote, baseOK)
+		switch {
+		case !localOK && !remoteOK:
+			if baseOK {
+				actions[p] = actionForget
+			}
+		case !localChanged && !remoteChanged:
+		case !remoteChanged && localOK:
+			actions[p] = actionPush
+		case !remoteChanged:
+			actions[p] = actionRemoveRemote
+		case !localChanged && remoteOK:
+			actions[p] = actionPull
+		case !localChanged:
+			actions[p] = actionRemoveLocal
+		// When one side removed a path the other changed, the change wins so
+		// nothing is lost.
+		case !remoteOK:
+			actions[p] = actionPush
+		case !localOK:
+			actions[p] = actionPull
+		case equivalent(l, r):
+			actions[p] = actionRecord
+		case l.Mode.IsRegular() && r.Mode.IsRegular() && l.Size == r.Size:
+			actions[p] = actionConflict
+			sameSize = append(sameSize, p)
+		default:
+			actions[p] = actionConflict
+		}
+	}
+
+	// Files that changed on both sides only conflict if their contents
+	// differ.
+	if len(sameSize) > 0 {
+		hashed, err := e.remoteManifest(h, sameSize, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range sameSize {
+			localHash, err := hashFile(e.localPath(p))
+			if err == nil && bytes.Equal(localHash, hashed[p].Hash) {
+				actions[p] = actionRecord
+			}
+		}
+	}
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		p := paths[i]
+		action := actions[p]
+		if action != actionRemoveRemote && action != actionRemoveLocal {
+			continue
+		}
+		// A directory can't be removed if something inside it is kept, so
+		// it's restored instead.
+		for _, child := range paths[i+1:] {
+			if !isUnder(child, p) {
+				break
+			}
+			childAction := actions[child]
+			if childAction == action || childAction == actionForget || childAction == actionNone {
+				continue
+			}
+			if action == actionRemoveRemote {
+				actions[p] = actionPull
+			} else {
+				actions[p] = actionPush
+			}
+			break
+		}
+	}
+	for i, p := range paths {
+		if actions[p] != actionConflict {
+			continue
+		}
+		// Everything inside a conflict is synced with it.
+		for _, child := range paths[i+1:] {
+			if !isUnder(child, p) {
+				break
+			}
+			actions[child] = actionNone
+		}
+	}
+	return actions, paths, nil
+}
+
+// changed returns whether an entry of a side changed since it was synced.
+func changed(entry fileEntry, ok bool, base fileEntry, baseOK bool) bool {
+	if ok != baseOK {
+		return true
+	}
+	return ok && !sameEntry(entry, base)
+}
+
+// equivalent returns whether local and remote entries that both changed
+// don't conflict, without reading files.
+func equivalent(local, remote fileEntry) bool {
+	if local.Mode.IsDir() && remote.Mode.IsDir() {
+		return true
+	}
+	return sameEntry(local, remote)
+}
+
+// wrote returns whether an entry was written as expected. Directories only
+// need to exist.
+func wrote(want, got fileEntry) bool {
+	if want.Mode.Type() != got.Mode.Type() {
+		return false
+	}
+	switch {
+	case want.Mode.IsDir():
+		return true
+	case want.Mode&os.ModeSymlink != 0:
+		return want.Link == got.Link
+	default:
+		return want.Size == got.Size && want.ModTime.Equal(got.ModTime)
+	}
+}
+
+// conflictName returns a free path for the conflict copy of p.
+func (e *engine) conflictName(h *helperConn, p string, local, remote map[string]fileEntry) (string, error) {
+	for i := 1; ; i++ {
+		name := p + ".conflict"
+		if i > 1 {
+			name += fmt.Sprint(i)
+		}
+		if _, ok := local[name]; ok {
+			continue
+		}
+		if _, ok := remote[name]; ok {
+			continue
+		}
+		if _, err := os.Lstat(e.localPath(name)); err == nil {
+			continue
+		}
+		existing, err := e.remoteManifest(h, []string{name}, false)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := existing[name]; !ok {
+			return name, nil
+		}
+	}
+}
+
+// pullEntries writes the remote entries to the local directory, as deltas
+// against the local entries. It returns the errors of reading remote files.
+func (e *engine) pullEntries(h *helperConn, pulls []fileEntry, local map[string]fileEntry) ([]string, error) {
+	var sigs []fileSignature
+	for _, entry := range pulls {
+		if !entry.Mode.IsRegular() {
+			e.writer.write(fileWrite{Entry: entry, Done: true})
+			continue
+		}
+		sig := fileSignature{Path: entry.Path}
+		if old, ok := local[entry.Path]; ok && old.Mode.IsRegular() && old.Size > 0 {
+			var err error
+			sig, err = fileSignatureOf(e.localPath(entry.Path))
+			if err != nil {
+				return nil, xerrors.Errorf("read %s: %w", entry.Path, err)
+			}
+			sig.Path = entry.Path
+		}
+		sigs = append(sigs, sig)
+	}
+	if len(sigs) == 0 {
+		return nil, nil
+	}
+
+	var errs []string
+	err := h.call(helperRequest{Op: opDelta, Signatures: sigs}, func(resp helperResponse) error {
+		if resp.Write != nil {
+			write := *resp.Write
+			if runtime.GOOS == "windows" {
+				write.Entry.Mode &^= os.ModePerm
+			}
+			e.writer.write(write)
+		}
+		errs = append(errs, resp.Errors...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// remoteWatcher watches the remote directories of two-way syncs with one
+// helper. It's started when a sync first subscribes, and again when a sync
+// subscribes after it stopped.
+type remoteWatcher struct {
+	start func(ctx context.Context) (*helperProcess, error)
+
+	mut     sync.Mutex
+	process *helperProcess
+	subs    map[string]*watchSubscription
+}
+
+// watchSubscription collects the paths that change in a remote directory
+// until the sync takes them, so a busy sync doesn't hold up the watch of
+// the others. ready is signaled when there are paths to take. The error
+// that stops the watch is sent once.
+type watchSubscription struct {
+	mut   sync.Mutex
+	batch watchBatch
+	ready chan struct{}
+	errs  chan error
+}
+
+func (s *watchSubscription) add(paths []string, overflow bool) {
+	s.mut.Lock()
+	s.batch.add(paths, overflow)
+	s.mut.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the paths that changed since it was last called. If too many
+// changed, the root is returned and overflow is set.
+func (s *watchSubscription) take() (paths []string, overflow bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	paths, overflow = s.batch.take()
+	if overflow {
+		paths = []string{""}
+	}
+	return paths, overflow
+}
+
+// subscribe returns the subscription to a remote directory, which must be
+// one the helper watches.
+func (w *remoteWatcher) subscribe(ctx context.Context, remoteDir string) (*watchSubscription, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.process == nil {
+		process, err := w.start(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("watch workspace: %w", err)
+		}
+		w.process = process
+		w.subs = make(map[string]*watchSubscription)
+		go w.read(process)
+	}
+	sub := &watchSubscription{
+		ready: make(chan struct{}, 1),
+		errs:  make(chan error, 1),
+	}
+	w.subs[remoteDir] = sub
+	return sub, nil
+}
+
+// unsubscribe stops collecting paths for the subscription.
+func (w *remoteWatcher) unsubscribe(remoteDir string, sub *watchSubscription) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.subs[remoteDir] == sub {
+		delete(w.subs, remoteDir)
+	}
+}
+
+// read passes the events of the process to the subscriptions until it
+// stops. It never waits on a sync.
+func (w *remoteWatcher) read(process *helperProcess) {
+	dec := gob.NewDecoder(process.stdout)
+	for {
+		var event watchEvent
+		err := dec.Decode(&event)
+		w.mut.Lock()
+		if err != nil {
+			for _, sub := range w.subs {
+				sub.errs <- err
+			}
+			_ = process.close()
+			w.process, w.subs = nil, nil
+			w.mut.Unlock()
+			return
+		}
+		sub, ok := w.subs[event.Root]
+		w.mut.Unlock()
+		if ok {
+			sub.add(event.Paths, event.Overflow)
+		}
+	}
+}
+
+// close stops the helper.
+func (w *remoteWatcher) close() error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.process == nil {
+		return nil
+	}
+	// The subscriptions get the error of the stopped process.
+	return w.process.close()
+}
+
+// remoteWatcher returns the watcher of the sync's session, or a new one
+// that watches its remote directory.
+func (s Sync) remoteWatcher() *remoteWatcher {
+	if s.session != nil {
+		return s.session.watcher
+	}
+	return &remoteWatcher{
+		start: func(ctx context.Context) (*helperProcess, error) {
+			return startHelper(ctx, s.Client, &s.Workspace, "--watch", "--", s.RemoteDir)
+		},
+	}
+}
+
+// reconcilePaths syncs the paths both ways and logs what changed.
+func (s Sync) reconcilePaths(rels []string) {
+	start := time.Now()
+	result, err := s.engine.reconcile(context.Background(), rels)
+	elapsed := time.Since(start).Truncate(time.Millisecond * 10)
+	for _, changes := range []struct {
+		verb  string
+		paths []string
+	}{
+		{verb: "pushed", paths: result.Pushed},
+		{verb: "pulled", paths: result.Pulled},
+		{verb: "removed in workspace", paths: result.RemovedRemote},
+		{verb: "removed locally", paths: result.RemovedLocal},
+	} {
+		for _, p := range changes.paths {
+			clog.LogSuccess(s.header(fmt.Sprintf("%s %s (%s)", changes.verb, p, elapsed)))
+		}
+	}
+	s.logConflicts(result)
+	if err != nil {
+		clog.Log(clog.Error(s.header(fmt.Sprintf("sync %s: %s", strings.Join(rels, ", "), err))))
+	}
+}
+
+func (s Sync) logConflicts(result reconcileResult) {
+	for _, c := range result.Conflicts {
+		clog.LogWarn(
+			s.header(fmt.Sprintf("conflict: %s changed locally and in the workspace", c.Path)),
+			fmt.Sprintf("the local version was kept, and the workspace's was saved as %s", c.Copy),
+		)
+	}
+}
@@ -0,0 +1,246 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+)
+
+// fileWriter applies the writes and removes of a sync to a directory. The
+// helper uses it for the remote side of a sync, and two-way syncs for the
+// local side. Errors are collected until they're flushed, so writes can be
+// streamed.
+type fileWriter struct {
+	root    string
+	errs    []string
+	pending map[string]*pendingWrite
+}
+
+func newFileWriter(root string) *fileWriter {
+	return &fileWriter{
+		root:    root,
+		pending: make(map[string]*pendingWrite),
+	}
+}
+
+// pendingWrite is a file that's being written.
+type pendingWrite struct {
+	old  *os.File
+	tmp  *os.File
+	hash hash.Hash
+	err  error
+}
+
+// path returns the path of a relative path of the sync, which can't be
+// outside the root.
+func (w *fileWriter) path(rel string) (string, error) {
+	if rel != "" && path.Clean("/"+rel) != "/"+rel {
+		return "", xerrors.Errorf("invalid path %q", rel)
+	}
+	return filepath.Join(w.root, filepath.FromSlash(rel)), nil
+}
+
+func (w *fileWriter) fail(rel string, err error) {
+	w.errs = append(w.errs, rel+": "+err.Error())
+}
+
+// flush returns the errors since the last flush.
+func (w *fileWriter) flush() []string {
+	errs := w.errs
+	w.errs = nil
+	return errs
+}
+
+func (w *fileWriter) write(write fileWrite) {
+	entry := write.Entry
+	localPath, err := w.path(entry.Path)
+	if err != nil {
+		w.fail(entry.Path, err)
+		return
+	}
+	switch {
+	case entry.Mode.IsDir():
+		err = writeDir(localPath, entry.Mode)
+	case entry.Mode&os.ModeSymlink != 0:
+		err = writeSymlink(localPath, entry.Link)
+	default:
+		err = w.writeFile(localPath, write)
+	}
+	if err != nil {
+		w.fail(entry.Path, err)
+	}
+}
+
+func writeDir(localPath string, mode os.FileMode) error {
+	info, err := os.Lstat(localPath)
+	if err == nil && !info.IsDir() {
+		err = os.Remove(localPath)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.MkdirAll(localPath, 0o755)
+	if err != nil {
+		return err
+	}
+	if mode.Perm() == 0 {
+		return nil
+	}
+	return os.Chmod(localPath, mode.Perm())
+}
+
+func writeSymlink(localPath, target string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(localPath)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, localPath)
+}
+
+// writeFile applies a write to a temporary file, which replaces the file
+// once it's done and its hash is verified.
+func (w *fileWriter) writeFile(localPath string, write fileWrite) error {
+	rel := write.Entry.Path
+	p, ok := w.pending[rel]
+	if !ok {
+		p = &pendingWrite{hash: sha256.New()}
+		w.pending[rel] = p
+		p.err = p.open(localPath)
+	}
+	if p.err == nil {
+		var old io.ReaderAt
+		if p.old != nil {
+			old = p.old
+		}
+		p.err = applyDelta(io.MultiWriter(p.tmp, p.hash), old, write.BlockSize, write.Ops)
+	}
+	if !write.Done {
+		// Errors are reported once the file is done, so they're only
+		// reported once.
+		return nil
+	}
+
+	delete(w.pending, rel)
+	defer p.close()
+	if p.err != nil {
+		return p.err
+	}
+	if !bytes.Equal(p.hash.Sum(nil), write.Hash) {
+		return xerrors.New("checksum mismatch")
+	}
+	return p.commit(localPath, write.Entry)
+}
+
+func (p *pendingWrite) open(localPath string) error {
+	dir := filepath.Dir(localPath)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	old, err := os.Open(localPath)
+	if err == nil {
+		p.old = old
+	}
+	p.tmp, err = ioutil.TempFile(dir, tempPrefix)
+	return err
+}
+
+// tempPrefix is the prefix of the names of files that are being written.
+const tempPrefix = ".coder-sync-"
+
+// commit replaces the file with the temporary file.
+func (p *pendingWrite) commit(localPath string, entry fileEntry) error {
+	perm := entry.Mode.Perm()
+	if perm == 0 {
+		perm = 0o644
+		if p.old != nil {
+			info, err := p.old.Stat()
+			if err == nil {
+				perm = info.Mode().Perm()
+			}
+		}
+	}
+	err := p.tmp.Chmod(perm)
+	if err != nil {
+		return err
+	}
+	err = p.tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(p.tmp.Name(), entry.ModTime, entry.ModTime)
+	if err != nil {
+		return err
+	}
+	// A directory can't be replaced by a rename.
+	info, err := os.Lstat(localPath)
+	if err == nil && info.IsDir() {
+		err = os.RemoveAll(localPath)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(p.tmp.Name(), localPath)
+}
+
+func (p *pendingWrite) close() {
+	if p.old != nil {
+		_ = p.old.Close()
+	}
+	if p.tmp != nil {
+		_ = p.tmp.Close()
+		// It's already gone if it was renamed.
+		_ = os.Remove(p.tmp.Name())
+	}
+}
+
+func (w *fileWriter) remove(rel string) {
+	localPath, err := w.path(rel)
+	if err == nil && localPath == w.root {
+		err = xerrors.New("can't remove the root of the sync")
+	}
+	if err == nil {
+		err = os.RemoveAll(localPath)
+	}
+	if err != nil {
+		w.fail(rel, err)
+	}
+}
+
+// rename moves a path of the sync, replacing the destination.
+func (w *fileWriter) rename(from, to string) {
+	fromPath, err := w.path(from)
+	if err != nil {
+		w.fail(from, err)
+		return
+	}
+	toPath, err := w.path(to)
+	if err == nil {
+		err = os.RemoveAll(toPath)
+	}
+	if err == nil {
+		err = os.Rename(fromPath, toPath)
+	}
+	if err != nil {
+		w.fail(from, err)
+	}
+}
+
+// abort removes the temporary files of writes that weren't done.
+func (w *fileWriter) abort() {
+	for rel, p := range w.pending {
+		p.close()
+		delete(w.pending, rel)
+	}
+}
@@ -23,3 +23,18 @@ func ExactArgs(n int) cobra.PositionalArgs {
 		return nil
 	}
 }
+
+// MinimumNArgs returns an error if there are fewer than n args.
+func MinimumNArgs(n int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) < n {
+			return clog.Error(
+				fmt.Sprintf("requires at least %d arg(s), received %d", n, len(args)),
+				clog.Bold("usage: ")+cmd.UseLine(),
+				clog.BlankLine,
+				clog.Tipf("use \"--help\" for more info"),
+			)
+		}
+		return nil
+	}
+}
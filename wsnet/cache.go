@@ -6,7 +6,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/pion/webrtc/v3"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -64,19 +63,25 @@ func (d *DialerCache) evict() {
 			defer wg.Done()
 
 			// If we're no longer signaling, the connection is pending close.
-			evict := dialer.rtc.SignalingState() == webrtc.SignalingStateClosed
+			evict := dialer.isClosed()
 
 			// HACK: since the pion package can't reuse data channel IDs we need
 			// to terminate the connection once we approach the critical number.
 			// We're working on adding data channel ID reuse support upstream.
-			stats, ok := dialer.rtc.GetStats().GetConnectionStats(dialer.rtc)
-			if ok && stats.DataChannelsRequested > 32500 {
-				evict = true
+			// Dialers with DialOptions.Multiplex only open data channels for
+			// datagrams and remote listeners, so they rarely get here.
+			if dialer.rtc != nil {
+				stats, ok := dialer.rtc.GetStats().GetConnectionStats(dialer.rtc)
+				if ok && stats.DataChannelsRequested > 32500 {
+					evict = true
+				}
 			}
 
 			if dialer.activeConnections() == 0 && time.Since(d.atime[key]) >= d.ttl {
 				evict = true
-			} else {
+			} else if dialer.State() != DialerStateRestarting {
+				// Pings fail while ICE restarts, but connections are kept
+				// open, so the dialer is only evicted if the restart fails.
 				ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
 				defer cancel()
 				err := dialer.Ping(ctx)
@@ -125,7 +130,7 @@ func (d *DialerCache) Dial(ctx context.Context, key string, dialerFunc func() (*
 		d.mut.Unlock()
 
 		// The connection is pending close here...
-		if dialer.rtc.SignalingState() != webrtc.SignalingStateClosed {
+		if !dialer.isClosed() {
 			return dialer, true, nil
 		}
 	}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/datachannel"
@@ -63,6 +64,8 @@ func TURNProxyICECandidate() webrtc.ICEServer {
 type turnProxyDialer struct {
 	baseURL *url.URL
 	token   string
+	// proxy returns the proxy to connect through. See websocketClient.
+	proxy func(*http.Request) (*url.URL, error)
 }
 
 func (t *turnProxyDialer) Dial(network, addr string) (c net.Conn, err error) {
@@ -83,7 +86,12 @@ func (t *turnProxyDialer) Dial(network, addr string) (c net.Conn, err error) {
 		return nil, errors.New("invalid turn url addr scheme provided")
 	}
 	url.Path = "/api/private/turn"
+	client, err := websocketClient(url.String(), t.proxy)
+	if err != nil {
+		return nil, err
+	}
 	conn, resp, err := websocket.Dial(ctx, url.String(), &websocket.DialOptions{
+		HTTPClient: client,
 		HTTPHeader: headers,
 	})
 	if err != nil {
@@ -117,6 +125,13 @@ func (*turnProxyConn) LocalAddr() net.Addr {
 
 // Properly buffers data for data channel connections.
 type dataChannelConn struct {
+	// Accessed atomically, so these must stay 64-bit aligned.
+	bytesRead    uint64
+	bytesWritten uint64
+	openedAt     time.Time
+	// tracker is set if traffic is recorded.
+	tracker *statsTracker
+
 	addr *net.UnixAddr
 	dc   *webrtc.DataChannel
 	rw   datachannel.ReadWriteCloser
@@ -147,7 +162,9 @@ func (c *dataChannelConn) init() {
 }
 
 func (c *dataChannelConn) Read(b []byte) (n int, err error) {
-	return c.rw.Read(b)
+	n, err = c.rw.Read(b)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	return n, err
 }
 
 func (c *dataChannelConn) Write(b []byte) (n int, err error) {
@@ -166,19 +183,44 @@ func (c *dataChannelConn) Write(b []byte) (n int, err error) {
 	// See: https://github.com/pion/sctp/issues/181
 	time.Sleep(time.Microsecond)
 
-	return c.rw.Write(b)
+	n, err = c.rw.Write(b)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	return n, err
 }
 
 func (c *dataChannelConn) Close() error {
 	c.closedMutex.Lock()
-	defer c.closedMutex.Unlock()
+	untrack := !c.closed && c.tracker != nil
 	if !c.closed {
 		c.closed = true
 		close(c.sendMore)
 	}
+	c.closedMutex.Unlock()
+	if untrack {
+		c.tracker.untrack(c)
+	}
 	return c.dc.Close()
 }
 
+func (c *dataChannelConn) setTracker(tracker *statsTracker) {
+	c.openedAt = time.Now()
+	c.tracker = tracker
+}
+
+// stats returns the traffic statistics of the connection.
+func (c *dataChannelConn) stats() ConnStats {
+	stats := ConnStats{
+		BytesRead:    atomic.LoadUint64(&c.bytesRead),
+		BytesWritten: atomic.LoadUint64(&c.bytesWritten),
+		OpenedAt:     c.openedAt,
+	}
+	if c.addr != nil {
+		stats.Network = c.addr.Net
+		stats.Address = c.addr.Name
+	}
+	return stats
+}
+
 func (c *dataChannelConn) LocalAddr() net.Addr {
 	return c.addr
 }
@@ -7,10 +7,14 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/yamux"
 	"github.com/pion/datachannel"
 	"github.com/pion/webrtc/v3"
 	"golang.org/x/net/proxy"
@@ -40,6 +44,40 @@ type DialOptions struct {
 
 	// TURNLocalProxyURL is the URL to proxy client TURN data through.
 	TURNLocalProxyURL *url.URL
+
+	// Proxy returns the proxy to connect to the broker and TURNLocalProxyURL
+	// through, like http.Transport.Proxy. If nil, the proxy is taken from the
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables. It's not
+	// used if wsOpts provides an HTTP client.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// OnConnClosed is called with the final statistics of each connection
+	// when it closes or fails to open.
+	OnConnClosed func(ConnStats)
+
+	// Multiplex carries stream connections over a single data channel when
+	// the listener supports it. Otherwise, a data channel is opened per
+	// connection, and the peer connection must be replaced after about 32,500
+	// connections because data channel IDs can't be reused.
+	Multiplex bool
+
+	// WebsocketFallback carries stream connections over a multiplexed
+	// WebSocket through the broker if a peer connection can't be established,
+	// such as on networks that block UDP and TURN. It's only used by
+	// DialWebsocket. The fallback is slower because all traffic is relayed by
+	// the broker, and datagrams, remote listeners and speed tests aren't
+	// supported. Transport reports which is in use.
+	WebsocketFallback bool
+
+	// OnStateChange is called when the state of the connection to the
+	// listener changes. Dialers created with DialWebsocket restart ICE when
+	// the connection is lost or the local network changes, which keeps
+	// connections open while the network path changes.
+	OnStateChange func(DialerState)
+
+	// OnGoAway is called when the listener starts shutting down. Open
+	// connections keep working until the deadline, but new ones are refused.
+	OnGoAway func(GoAway)
 }
 
 // DialWebsocket dials the broker with a WebSocket and negotiates a connection.
@@ -55,15 +93,13 @@ func DialWebsocket(ctx context.Context, broker string, netOpts *DialOptions, wsO
 	log := *netOpts.Log
 
 	log.Debug(ctx, "connecting to broker", slog.F("broker", broker))
-	conn, resp, err := websocket.Dial(ctx, broker, wsOpts)
+	wsOpts, err := brokerDialOptions(broker, wsOpts, netOpts.Proxy)
 	if err != nil {
-		if resp != nil {
-			defer func() {
-				_ = resp.Body.Close()
-			}()
-			return nil, coder.NewHTTPError(resp)
-		}
-		return nil, fmt.Errorf("dial websocket: %w", err)
+		return nil, err
+	}
+	conn, err := dialBroker(ctx, broker, wsOpts)
+	if err != nil {
+		return nil, err
 	}
 	log.Debug(ctx, "connected to broker")
 
@@ -73,11 +109,69 @@ func DialWebsocket(ctx context.Context, broker string, netOpts *DialOptions, wsO
 		// We should close the socket intentionally.
 		_ = conn.Close(websocket.StatusInternalError, "an error occurred")
 	}()
-	return Dial(ctx, nconn, netOpts)
+	brokerFunc := func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialBroker(ctx, broker, wsOpts)
+		if err != nil {
+			return nil, err
+		}
+		return websocket.NetConn(context.Background(), conn, websocket.MessageBinary), nil
+	}
+	dialer, err := dial(ctx, nconn, netOpts, brokerFunc)
+	// Errors from the listener would refuse the fallback too.
+	if err == nil || !netOpts.WebsocketFallback || errors.Is(err, errFromPeer) || ctx.Err() != nil {
+		return dialer, err
+	}
+
+	log.Warn(ctx, "peer connection failed, falling back to websocket", slog.Error(err))
+	fallback, fallbackErr := dialFallback(ctx, netOpts, brokerFunc)
+	if fallbackErr != nil {
+		return dialer, fmt.Errorf("%w; websocket fallback: %v", err, fallbackErr)
+	}
+	return fallback, nil
+}
+
+// brokerDialOptions returns WebSocket options that connect to the broker
+// through the proxy for it.
+func brokerDialOptions(broker string, wsOpts *websocket.DialOptions, proxyFunc func(*http.Request) (*url.URL, error)) (*websocket.DialOptions, error) {
+	if wsOpts == nil {
+		wsOpts = &websocket.DialOptions{}
+	}
+	if wsOpts.HTTPClient != nil {
+		return wsOpts, nil
+	}
+	client, err := websocketClient(broker, proxyFunc)
+	if err != nil {
+		return nil, err
+	}
+	opts := *wsOpts
+	opts.HTTPClient = client
+	return &opts, nil
 }
 
-// Dial negotiates a connection to a listener.
+// dialBroker opens a WebSocket to the broker to negotiate over.
+func dialBroker(ctx context.Context, broker string, wsOpts *websocket.DialOptions) (*websocket.Conn, error) {
+	conn, resp, err := websocket.Dial(ctx, broker, wsOpts)
+	if err != nil {
+		if resp != nil {
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			return nil, coder.NewHTTPError(resp)
+		}
+		return nil, fmt.Errorf("dial websocket: %w", err)
+	}
+	return conn, nil
+}
+
+// Dial negotiates a connection to a listener. ICE can't be restarted without
+// a broker to renegotiate over, so the connection isn't recovered if it's lost.
 func Dial(ctx context.Context, conn net.Conn, options *DialOptions) (*Dialer, error) {
+	return dial(ctx, conn, options, nil)
+}
+
+// dial negotiates a connection to a listener. If broker is non-nil, it's used
+// to restart ICE.
+func dial(ctx context.Context, conn net.Conn, options *DialOptions, broker func(ctx context.Context) (net.Conn, error)) (*Dialer, error) {
 	if options == nil {
 		options = &DialOptions{}
 	}
@@ -96,6 +190,7 @@ func Dial(ctx context.Context, conn net.Conn, options *DialOptions) (*Dialer, er
 		turnProxy = &turnProxyDialer{
 			baseURL: options.TURNLocalProxyURL,
 			token:   options.TURNProxyAuthToken,
+			proxy:   options.Proxy,
 		}
 	}
 
@@ -156,6 +251,12 @@ func Dial(ctx context.Context, conn net.Conn, options *DialOptions) (*Dialer, er
 		Servers:      options.ICEServers,
 		TURNProxyURL: turnProxyURL,
 	}
+	if broker != nil {
+		bmsg.Session, err = newSession()
+		if err != nil {
+			return nil, fmt.Errorf("create session: %w", err)
+		}
+	}
 	log.Debug(ctx, "sending offer message", slog.F("msg", bmsg))
 	offerMessage, err := json.Marshal(&bmsg)
 	if err != nil {
@@ -169,12 +270,21 @@ func Dial(ctx context.Context, conn net.Conn, options *DialOptions) (*Dialer, er
 	flushCandidates()
 
 	dialer := &Dialer{
-		log:         log,
-		conn:        conn,
-		ctrl:        ctrl,
-		rtc:         rtc,
-		connClosers: []io.Closer{ctrl},
+		log:           log,
+		conn:          conn,
+		ctrl:          ctrl,
+		rtc:           rtc,
+		connClosers:   []io.Closer{ctrl},
+		listeners:     make(map[uint16]*remoteListener),
+		stats:         newStatsTracker(nil, options.OnConnClosed, options.OnConnClosed),
+		broker:        broker,
+		offer:         bmsg,
+		state:         DialerStateConnecting,
+		onStateChange: options.OnStateChange,
+		onGoAway:      options.OnGoAway,
+		closed:        make(chan struct{}),
 	}
+	rtc.OnDataChannel(dialer.handleDataChannel)
 
 	err = dialer.negotiate(ctx)
 	if err != nil {
@@ -183,6 +293,16 @@ func Dial(ctx context.Context, conn net.Conn, options *DialOptions) (*Dialer, er
 		return dialer, xerrors.Errorf("negotiate rtc connection: %w", err)
 	}
 
+	if options.Multiplex {
+		muxErr := dialer.negotiateMux(ctx)
+		if muxErr != nil {
+			log.Debug(ctx, "multiplexing unavailable, using a data channel per connection", slog.Error(muxErr))
+		}
+	}
+	if broker != nil {
+		go dialer.watchNetwork(networkChangeInterval, interfaceAddrs)
+	}
+
 	return dialer, nil
 }
 
@@ -199,17 +319,40 @@ type Dialer struct {
 	connClosers    []io.Closer
 	connClosersMut sync.Mutex
 	pingMut        sync.Mutex
+
+	// listeners are keyed by the ID of their listen data channel.
+	listeners    map[uint16]*remoteListener
+	listenersMut sync.Mutex
+
+	stats *statsTracker
+	// mux carries stream connections if it was negotiated.
+	mux *yamux.Session
+
+	// broker reconnects to the broker to restart ICE. It's nil if the
+	// connection can't be restarted.
+	broker func(ctx context.Context) (net.Conn, error)
+	// offer is the initial offer, which restart offers are based on.
+	offer BrokerMessage
+	// restarting is 1 while ICE is being restarted. Accessed atomically.
+	restarting int32
+	// restarted is closed when the connection is reestablished by the
+	// restart in progress.
+	restarted chan struct{}
+
+	state         DialerState
+	stateMut      sync.Mutex
+	onStateChange func(DialerState)
+	callbackMut   sync.Mutex
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	goAway    *GoAway
+	goAwayMut sync.Mutex
+	onGoAway  func(GoAway)
 }
 
 func (d *Dialer) negotiate(ctx context.Context) (err error) {
-	var (
-		decoder = json.NewDecoder(d.conn)
-		errCh   = make(chan error, 1)
-		// If candidates are sent before an offer, we place them here.
-		// We currently have no assurances to ensure this can't happen,
-		// so it's better to buffer and process than fail.
-		pendingCandidates = []webrtc.ICECandidateInit{}
-	)
+	errCh := make(chan error, 1)
 	go func() {
 		defer close(errCh)
 		defer func() { _ = d.conn.Close() }()
@@ -222,29 +365,35 @@ func (d *Dialer) negotiate(ctx context.Context) (err error) {
 			return
 		}
 
-		d.rtc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
-			if pcs == webrtc.PeerConnectionStateConnected {
-				d.log.Debug(ctx, "connected")
-				return
-			}
-
-			// Close connections opened when RTC was alive.
-			d.log.Warn(ctx, "closing connections due to connection state change", slog.F("pcs", pcs.String()))
-			d.connClosersMut.Lock()
-			defer d.connClosersMut.Unlock()
-			for _, connCloser := range d.connClosers {
-				_ = connCloser.Close()
-			}
-			d.connClosers = make([]io.Closer, 0)
-		})
+		d.setState(DialerStateConnected)
+		d.rtc.OnConnectionStateChange(d.handleStateChange)
 	}()
 
+	err = d.readBrokerMessages(ctx, d.conn)
+	if err != nil {
+		return err
+	}
+	return <-errCh
+}
+
+// readBrokerMessages applies the answer and candidates sent by the listener
+// until the broker connection is closed.
+func (d *Dialer) readBrokerMessages(ctx context.Context, conn net.Conn) error {
+	var (
+		decoder  = json.NewDecoder(conn)
+		answered = false
+		// If candidates are sent before an offer, we place them here.
+		// We currently have no assurances to ensure this can't happen,
+		// so it's better to buffer and process than fail.
+		pendingCandidates = []webrtc.ICECandidateInit{}
+	)
+
 	d.log.Debug(ctx, "beginning negotiation")
 	for {
 		var msg BrokerMessage
-		err = decoder.Decode(&msg)
+		err := decoder.Decode(&msg)
 		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
-			break
+			return nil
 		}
 		if err != nil {
 			return fmt.Errorf("read: %w", err)
@@ -255,7 +404,7 @@ func (d *Dialer) negotiate(ctx context.Context) (err error) {
 			c := webrtc.ICECandidateInit{
 				Candidate: msg.Candidate,
 			}
-			if d.rtc.RemoteDescription() == nil {
+			if !answered {
 				pendingCandidates = append(pendingCandidates, c)
 				continue
 			}
@@ -274,6 +423,7 @@ func (d *Dialer) negotiate(ctx context.Context) (err error) {
 			if err != nil {
 				return fmt.Errorf("set answer: %w", err)
 			}
+			answered = true
 
 			for _, candidate := range pendingCandidates {
 				err = d.rtc.AddICECandidate(candidate)
@@ -287,28 +437,52 @@ func (d *Dialer) negotiate(ctx context.Context) (err error) {
 
 		if msg.Error != "" {
 			d.log.Debug(ctx, "got error from peer", slog.F("err", msg.Error))
-			return fmt.Errorf("error from peer: %v", msg.Error)
+			return fmt.Errorf("%w: %v", errFromPeer, msg.Error)
 		}
 
 		return fmt.Errorf("unhandled message: %+v", msg)
 	}
-
-	return <-errCh
 }
 
 // ActiveConnections returns the amount of active connections. DialContext
 // opens a connection, and close will end it.
 func (d *Dialer) activeConnections() int {
+	if d.rtc == nil {
+		return d.mux.NumStreams()
+	}
 	stats, ok := d.rtc.GetStats().GetConnectionStats(d.rtc)
 	if !ok {
 		return -1
 	}
 	// Subtract 1 for the control channel.
-	return int(stats.DataChannelsRequested-stats.DataChannelsClosed) - 1
+	active := int(stats.DataChannelsRequested-stats.DataChannelsClosed) - 1
+	if d.mux != nil {
+		// The multiplexed channel carries a connection per stream.
+		active += d.mux.NumStreams() - 1
+	}
+	return active
+}
+
+// isClosed returns whether the connection to the listener is closed or pending
+// close.
+func (d *Dialer) isClosed() bool {
+	if d.rtc == nil {
+		return d.mux.IsClosed()
+	}
+	return d.rtc.SignalingState() == webrtc.SignalingStateClosed
+}
+
+// Stats returns traffic statistics for the connections opened by the dialer.
+func (d *Dialer) Stats() Stats {
+	return d.stats.snapshot()
 }
 
 // Candidates returns the candidate pair that was chosen for the connection.
+// There are none for the websocket fallback.
 func (d *Dialer) Candidates() (*webrtc.ICECandidatePair, error) {
+	if d.rtc == nil {
+		return nil, errWebsocketTransport
+	}
 	return d.rtc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
 }
 
@@ -316,11 +490,18 @@ func (d *Dialer) Candidates() (*webrtc.ICECandidatePair, error) {
 // All data channels dialed will be closed.
 func (d *Dialer) Close() error {
 	d.log.Debug(context.Background(), "close called")
+	if d.rtc == nil {
+		// Closing the session closes the broker connection.
+		return d.mux.Close()
+	}
 	return d.rtc.Close()
 }
 
 // Ping sends a ping through the control channel.
 func (d *Dialer) Ping(ctx context.Context) error {
+	if d.rtc == nil {
+		return d.pingMux(ctx)
+	}
 	if d.ctrl.ReadyState() == webrtc.DataChannelStateClosed || d.ctrl.ReadyState() == webrtc.DataChannelStateClosing {
 		return webrtc.ErrConnectionClosed
 	}
@@ -373,6 +554,14 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	proto := fmt.Sprintf("%s:%s", network, address)
 	ctx = slog.With(ctx, slog.F("proto", proto))
 
+	// Datagrams need their own unordered channel to keep message boundaries.
+	if d.mux != nil && network != "udp" {
+		return d.dialMux(ctx, network, address)
+	}
+	if d.rtc == nil {
+		return nil, fmt.Errorf("dial %s: %w", network, errWebsocketTransport)
+	}
+
 	d.log.Debug(ctx, "opening data channel")
 	dc, err := d.rtc.CreateDataChannel("proxy", &webrtc.DataChannelInit{
 		Ordered:  boolPtr(network != "udp"),
@@ -400,6 +589,54 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	}
 	d.log.Debug(ctx, "data channel detached")
 
+	err = d.readDialResponse(ctx, rw, nil)
+	if err != nil {
+		d.stats.dialFailed(network, address, err)
+		return nil, err
+	}
+
+	c := &dataChannelConn{
+		addr: &net.UnixAddr{
+			Name: address,
+			Net:  network,
+		},
+		dc: dc,
+		rw: rw,
+	}
+	c.init()
+	d.stats.track(c)
+
+	d.log.Debug(ctx, "dial channel ready")
+	return c, nil
+}
+
+// DialError is returned when the listener refuses or fails to open a data
+// channel. For CodeDialErr, Err is a *net.OpError.
+type DialError struct {
+	// Code is one of the DialChannelResponse codes.
+	Code string
+	Err  error
+}
+
+var _ error = &DialError{}
+var _ interface{ Unwrap() error } = &DialError{}
+
+// Error implements error.
+func (e *DialError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap implements Unwrapper.
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// readDialResponse waits for the listener to respond to a newly opened data
+// channel. The response is stored in res if it's non-nil.
+func (d *Dialer) readDialResponse(ctx context.Context, rw io.Reader, res *DialChannelResponse) error {
+	if res == nil {
+		res = &DialChannelResponse{}
+	}
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
@@ -407,8 +644,15 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	go func() {
 		defer close(errCh)
 
-		var res DialChannelResponse
-		err = json.NewDecoder(rw).Decode(&res)
+		// The response is always sent as a single message, so it must be
+		// read in full to avoid a short buffer.
+		buf := make([]byte, maxMessageLength)
+		n, err := rw.Read(buf)
+		if err != nil {
+			errCh <- fmt.Errorf("read dial response: %w", err)
+			return
+		}
+		err = json.Unmarshal(buf[:n], res)
 		if err != nil {
 			errCh <- fmt.Errorf("read dial response: %w", err)
 			return
@@ -419,7 +663,7 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 			return
 		}
 
-		err := errors.New(res.Err)
+		err = errors.New(res.Err)
 		if res.Code == CodeDialErr {
 			err = &net.OpError{
 				Op:  res.Op,
@@ -427,28 +671,182 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 				Err: err,
 			}
 		}
-		errCh <- err
+		errCh <- &DialError{
+			Code: res.Code,
+			Err:  err,
+		}
 	}()
 
 	select {
 	case err := <-errCh:
-		if err != nil {
-			return nil, err
-		}
+		return err
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return ctx.Err()
 	}
+}
 
-	c := &dataChannelConn{
+// Listen asks the remote listener to bind the network and address provided
+// inside the workspace. Connections accepted there are relayed back over new
+// data channels and returned by Accept on the returned net.Listener.
+func (d *Dialer) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	proto := fmt.Sprintf("%s%s:%s", listenProtocolPrefix, network, address)
+	ctx = slog.With(ctx, slog.F("proto", proto))
+
+	if d.rtc == nil {
+		return nil, fmt.Errorf("listen: %w", errWebsocketTransport)
+	}
+	d.log.Debug(ctx, "opening listen data channel")
+	dc, err := d.rtc.CreateDataChannel("listen", &webrtc.DataChannelInit{
+		Ordered:  boolPtr(true),
+		Protocol: &proto,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create data channel: %w", err)
+	}
+
+	d.connClosersMut.Lock()
+	d.connClosers = append(d.connClosers, dc)
+	d.connClosersMut.Unlock()
+
+	err = waitForDataChannelOpen(ctx, dc)
+	if err != nil {
+		return nil, fmt.Errorf("wait for open: %w", err)
+	}
+	rw, err := dc.Detach()
+	if err != nil {
+		return nil, fmt.Errorf("detach: %w", err)
+	}
+
+	var res DialChannelResponse
+	err = d.readDialResponse(ctx, rw, &res)
+	if err != nil {
+		d.stats.dialFailed(network, address, err)
+		_ = dc.Close()
+		return nil, err
+	}
+
+	ln := &remoteListener{
+		dialer: d,
+		id:     *dc.ID(),
+		dc:     dc,
 		addr: &net.UnixAddr{
-			Name: address,
+			Name: res.Addr,
 			Net:  network,
 		},
-		dc: dc,
-		rw: rw,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
 	}
-	c.init()
+	d.listenersMut.Lock()
+	d.listeners[ln.id] = ln
+	d.listenersMut.Unlock()
 
-	d.log.Debug(ctx, "dial channel ready")
-	return c, nil
+	go func() {
+		// Nothing is sent on the listen channel after the response, so a
+		// read only returns once the remote listener has closed.
+		_, _ = rw.Read(make([]byte, maxMessageLength))
+		_ = ln.Close()
+	}()
+
+	d.log.Debug(ctx, "listening on remote address", slog.F("addr", res.Addr))
+	return ln, nil
+}
+
+// handleDataChannel accepts data channels opened by the listener.
+func (d *Dialer) handleDataChannel(dc *webrtc.DataChannel) {
+	if dc.Label() == goAwayChannelLabel {
+		d.handleGoAway(dc)
+		return
+	}
+	d.handleReverse(dc)
+}
+
+// handleReverse accepts data channels opened by the listener for
+// connections accepted on a remote listener.
+func (d *Dialer) handleReverse(dc *webrtc.DataChannel) {
+	if dc.Label() != reverseChannelLabel {
+		d.log.Warn(context.Background(), "unexpected data channel opened by listener", slog.F("label", dc.Label()))
+		_ = dc.Close()
+		return
+	}
+
+	parts := strings.SplitN(dc.Protocol(), ":", 2)
+	id, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		_ = dc.Close()
+		return
+	}
+	d.listenersMut.Lock()
+	ln, ok := d.listeners[uint16(id)]
+	d.listenersMut.Unlock()
+	if !ok {
+		_ = dc.Close()
+		return
+	}
+
+	dc.OnOpen(func() {
+		rw, err := dc.Detach()
+		if err != nil {
+			return
+		}
+		c := &dataChannelConn{
+			addr: ln.addr,
+			dc:   dc,
+			rw:   rw,
+		}
+		c.init()
+		d.stats.track(c)
+
+		d.connClosersMut.Lock()
+		d.connClosers = append(d.connClosers, c)
+		d.connClosersMut.Unlock()
+
+		select {
+		case ln.conns <- c:
+		case <-ln.closed:
+			_ = c.Close()
+		}
+	})
+}
+
+// remoteListener is a net.Listener bound inside the workspace.
+type remoteListener struct {
+	dialer *Dialer
+	id     uint16
+	dc     *webrtc.DataChannel
+	addr   *net.UnixAddr
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = &remoteListener{}
+
+// Accept waits for and returns the next connection accepted inside the
+// workspace.
+func (l *remoteListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening inside the workspace. Connections that were already
+// accepted are not closed.
+func (l *remoteListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.dialer.listenersMut.Lock()
+		delete(l.dialer.listeners, l.id)
+		l.dialer.listenersMut.Unlock()
+		_ = l.dc.Close()
+	})
+	return nil
+}
+
+// Addr returns the address bound inside the workspace.
+func (l *remoteListener) Addr() net.Addr {
+	return l.addr
 }
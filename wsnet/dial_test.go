@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -101,6 +102,7 @@ func TestDial(t *testing.T) {
 		defer l.Close()
 
 		turnAddr, closeTurn := createTURNServer(t, ice.SchemeTypeTURN)
+		restarting := make(chan struct{}, 1)
 		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
 			Log: &log,
 			ICEServers: []webrtc.ICEServer{{
@@ -109,11 +111,19 @@ func TestDial(t *testing.T) {
 				Credential:     testPass,
 				CredentialType: webrtc.ICECredentialTypePassword,
 			}},
+			OnStateChange: func(state DialerState) {
+				if state == DialerStateRestarting {
+					restarting <- struct{}{}
+				}
+			},
 		}, nil)
 		require.NoError(t, err)
 
 		_ = dialer.Ping(context.Background())
 		closeTurn()
+		// The connection is lost, and can't be restarted without the TURN
+		// server.
+		<-restarting
 		err = dialer.Ping(context.Background())
 		assert.Error(t, err)
 		assert.ErrorIs(t, err, io.EOF)
@@ -139,6 +149,9 @@ func TestDial(t *testing.T) {
 		// Double pointer intended.
 		netErr := &net.OpError{}
 		assert.ErrorAs(t, err, &netErr)
+		dialErr := &DialError{}
+		assert.ErrorAs(t, err, &dialErr)
+		assert.Equal(t, CodeDialErr, dialErr.Code)
 	})
 
 	t.Run("Proxy", func(t *testing.T) {
@@ -176,6 +189,321 @@ func TestDial(t *testing.T) {
 		assert.Equal(t, msg, rec)
 	})
 
+	t.Run("Stats", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			// Echo until the connection closes.
+			_, _ = io.Copy(conn, conn)
+		}()
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		var (
+			listenerOpened = make(chan ConnStats, 1)
+			listenerFailed = make(chan ConnStats, 1)
+			listenerClosed = make(chan ConnStats, 1)
+		)
+		l, err := ListenWithOptions(context.Background(), log, listenAddr, "", &ListenOptions{
+			OnConnOpened: func(stats ConnStats) {
+				listenerOpened <- stats
+			},
+			OnDialFailed: func(stats ConnStats) {
+				listenerFailed <- stats
+			},
+			OnConnClosed: func(stats ConnStats) {
+				listenerClosed <- stats
+			},
+		})
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialerClosed := make(chan ConnStats, 2)
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &log,
+			OnConnClosed: func(stats ConnStats) {
+				dialerClosed <- stats
+			},
+		}, nil)
+		require.NoError(t, err)
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+		require.NoError(t, err)
+		opened := <-listenerOpened
+		assert.Equal(t, "tcp", opened.Network)
+		assert.Equal(t, listener.Addr().String(), opened.Address)
+
+		msg := []byte("Hello!")
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, make([]byte, len(msg)))
+		require.NoError(t, err)
+
+		stats := dialer.Stats()
+		require.Len(t, stats.Conns, 1)
+		assert.Equal(t, listener.Addr().String(), stats.Conns[0].Address)
+		assert.Equal(t, uint64(len(msg)), stats.Conns[0].BytesWritten)
+		assert.Equal(t, uint64(len(msg)), stats.Conns[0].BytesRead)
+		assert.Equal(t, uint64(1), stats.ConnsOpened)
+
+		_, err = dialer.DialContext(context.Background(), "tcp", "localhost:100")
+		require.Error(t, err)
+		failed := <-dialerClosed
+		assert.Equal(t, CodeDialErr, failed.ErrorCode)
+		failed = <-listenerFailed
+		assert.Equal(t, "localhost:100", failed.Address)
+		assert.Equal(t, CodeDialErr, failed.ErrorCode)
+
+		require.NoError(t, conn.Close())
+		closed := <-dialerClosed
+		assert.Equal(t, uint64(len(msg)), closed.BytesWritten)
+		assert.False(t, closed.ClosedAt.IsZero())
+
+		// The listener reads what the dialer wrote.
+		closed = <-listenerClosed
+		assert.Equal(t, listener.Addr().String(), closed.Address)
+		assert.Equal(t, uint64(len(msg)), closed.BytesRead)
+
+		stats = dialer.Stats()
+		assert.Len(t, stats.Conns, 0)
+		assert.Equal(t, uint64(1), stats.ConnsClosed)
+		assert.Equal(t, uint64(len(msg)), stats.BytesRead)
+		assert.Equal(t, uint64(1), stats.DialErrors[CodeDialErr])
+	})
+
+	t.Run("Proxy Multiplexed", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:       &log,
+			Multiplex: true,
+		}, nil)
+		require.NoError(t, err)
+		require.NotNil(t, dialer.mux)
+
+		// Larger than a single data channel message.
+		msg := make([]byte, maxMessageLength*3)
+		_, err = rand.Read(msg)
+		require.NoError(t, err)
+		for i := 0; i < 50; i++ {
+			conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+			require.NoError(t, err)
+			go func() {
+				_, _ = conn.Write(msg)
+			}()
+			rec := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, rec)
+			require.NoError(t, err)
+			require.Equal(t, msg, rec)
+			require.Equal(t, 1, dialer.activeConnections())
+			require.NoError(t, conn.Close())
+		}
+
+		// Connections should not use up data channels.
+		stats, ok := dialer.rtc.GetStats().GetConnectionStats(dialer.rtc)
+		require.True(t, ok)
+		assert.Equal(t, uint32(2), stats.DataChannelsRequested)
+
+		_, err = dialer.DialContext(context.Background(), "tcp", "localhost:100")
+		dialErr := &DialError{}
+		assert.ErrorAs(t, err, &dialErr)
+		assert.Equal(t, CodeDialErr, dialErr.Code)
+	})
+
+	t.Run("Multiplex Unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		// Listeners without multiplexing treat the mux channel like any other
+		// and reject it as an invalid address, which dialers fall back on.
+		_, _, err := BrokerMessage{}.getAddress(muxChannelProtocol)
+		require.Error(t, err)
+		assert.False(t, errors.As(err, &notPermittedByPolicyErr{}))
+	})
+
+	t.Run("Proxy UDP", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer pc.Close()
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = pc.WriteTo(buf[:n], addr)
+			}
+		}()
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &log,
+		}, nil)
+		require.NoError(t, err)
+
+		conn, err := dialer.DialContext(context.Background(), "udp", pc.LocalAddr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// Each write should arrive as a single datagram and be echoed back
+		// without being merged with the others.
+		for _, msg := range []string{"first", "second datagram"} {
+			_, err = conn.Write([]byte(msg))
+			require.NoError(t, err)
+
+			rec := make([]byte, 1024)
+			n, err := conn.Read(rec)
+			require.NoError(t, err)
+			assert.Equal(t, msg, string(rec[:n]))
+		}
+	})
+
+	t.Run("Proxy Unix", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		socketPath := filepath.Join(t.TempDir(), "test.sock")
+		listener, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+		defer listener.Close()
+
+		msg := []byte("Hello!")
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(msg)
+		}()
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &log,
+		}, nil)
+		require.NoError(t, err)
+
+		conn, err := dialer.DialContext(context.Background(), "unix", socketPath)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rec := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, rec)
+		require.NoError(t, err)
+		assert.Equal(t, msg, rec)
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &log,
+		}, nil)
+		require.NoError(t, err)
+
+		ln, err := dialer.Listen(context.Background(), "tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		require.NotEqual(t, "127.0.0.1:0", ln.Addr().String())
+
+		// Connect to the address bound by the listener, as a process inside
+		// the workspace would.
+		msg := []byte("Hello!")
+		go func() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(msg)
+		}()
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rec := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, rec)
+		require.NoError(t, err)
+		assert.Equal(t, msg, rec)
+
+		// Closing the listener should unbind the address in the workspace.
+		require.NoError(t, ln.Close())
+		_, err = ln.Accept()
+		assert.ErrorIs(t, err, net.ErrClosed)
+		require.Eventually(t, func() bool {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return true
+			}
+			_ = conn.Close()
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Reverse Bad Address", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &log,
+		}, nil)
+		require.NoError(t, err)
+
+		_, err = dialer.Listen(context.Background(), "tcp", "127.0.0.1:abc")
+		assert.Error(t, err)
+	})
+
 	// Expect that we'd get an EOF on the server closing.
 	t.Run("EOF on Close", func(t *testing.T) {
 		t.Parallel()
@@ -354,6 +682,66 @@ func TestDial(t *testing.T) {
 		_, err = conn.Read(b)
 		require.NoError(t, err)
 	})
+
+	t.Run("Speed Test", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &log,
+		}, nil)
+		require.NoError(t, err)
+
+		upload, err := dialer.Upload(context.Background(), 100*time.Millisecond)
+		require.NoError(t, err)
+		assert.NotZero(t, upload.Bytes)
+		assert.NotZero(t, upload.BitsPerSecond())
+
+		download, err := dialer.Download(context.Background(), 100*time.Millisecond)
+		require.NoError(t, err)
+		assert.NotZero(t, download.Bytes)
+		assert.NotZero(t, download.BitsPerSecond())
+
+		loss, err := dialer.Loss(context.Background(), 10, 10*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, 10, loss.Sent)
+		assert.NotZero(t, loss.Received)
+		assert.NotZero(t, loss.RTT)
+	})
+
+	t.Run("Speed Test Unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		// Listeners without speed tests reject them as an invalid address.
+		for _, mode := range []string{speedTestUpload, speedTestDownload, speedTestEcho} {
+			_, _, err := BrokerMessage{}.getAddress(speedTestProtocolPrefix + mode)
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestLossFromRTTs(t *testing.T) {
+	t.Parallel()
+
+	loss := lossFromRTTs(4, []time.Duration{
+		10 * time.Millisecond,
+		0,
+		20 * time.Millisecond,
+		15 * time.Millisecond,
+	})
+	assert.Equal(t, 4, loss.Sent)
+	assert.Equal(t, 3, loss.Received)
+	assert.Equal(t, 0.25, loss.Ratio())
+	assert.Equal(t, 15*time.Millisecond, loss.RTT)
+	// The lost probe is skipped: (10ms + 5ms) / 2.
+	assert.Equal(t, 7500*time.Microsecond, loss.Jitter)
+
+	assert.Zero(t, lossFromRTTs(0, nil).Ratio())
 }
 
 func BenchmarkThroughput(b *testing.B) {
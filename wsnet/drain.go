@@ -0,0 +1,190 @@
+package wsnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v3"
+
+	"cdr.dev/slog"
+)
+
+// goAwayChannelLabel is the label of the data channel a listener opens to tell
+// a dialer it's shutting down. The listener sends a GoAway message on it.
+// Dialers that don't support it close the channel.
+const goAwayChannelLabel = "goaway"
+
+// drainPollInterval is how often a draining listener checks whether
+// connections are still open.
+var drainPollInterval = 100 * time.Millisecond
+
+// errListenerDraining is returned to dialers that open connections while the
+// listener is shutting down.
+var errListenerDraining = errors.New("listener is shutting down")
+
+// GoAway is sent to dialers when the listener starts shutting down. Open
+// connections keep working until they close or the deadline passes, but new
+// connections are refused with CodeGoingAwayErr.
+type GoAway struct {
+	Reason string `json:"reason"`
+	// Deadline is when connections that are still open will be closed. It's
+	// zero if the listener waits for them indefinitely.
+	Deadline time.Time `json:"deadline"`
+}
+
+// Shutdown gracefully closes the listener. New peer connections and new
+// connections from dialers are refused, and dialers are sent a GoAway with the
+// reason provided. Peer connections are closed once every connection through
+// the listener has closed, or when the context is done.
+func (l *Listener) Shutdown(ctx context.Context, reason string) error {
+	l.drainOnce.Do(func() {
+		close(l.draining)
+	})
+	goAway := GoAway{Reason: reason}
+	if deadline, ok := ctx.Deadline(); ok {
+		goAway.Deadline = deadline
+	}
+	l.log.Info(ctx, "draining listener", slog.F("reason", reason), slog.F("deadline", goAway.Deadline))
+
+	l.statusMut.Lock()
+	peers := make([]*webrtc.PeerConnection, 0, len(l.peers))
+	for peer := range l.peers {
+		peers = append(peers, peer)
+	}
+	l.statusMut.Unlock()
+	for _, peer := range peers {
+		if peer.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+		l.sendGoAway(ctx, peer, goAway)
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	var err error
+	for l.stats.openConns() > 0 {
+		select {
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+			err = fmt.Errorf("%d connections still open: %w", l.stats.openConns(), ctx.Err())
+		}
+		break
+	}
+
+	closeErr := l.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// isDraining returns whether Shutdown was called.
+func (l *Listener) isDraining() bool {
+	select {
+	case <-l.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendGoAway opens a data channel to the dialer of a peer connection and
+// sends the GoAway message on it.
+func (l *Listener) sendGoAway(ctx context.Context, peer *webrtc.PeerConnection, goAway GoAway) {
+	dc, err := peer.CreateDataChannel(goAwayChannelLabel, &webrtc.DataChannelInit{
+		Ordered: boolPtr(true),
+	})
+	if err != nil {
+		l.log.Debug(ctx, "failed to create go away data channel", slog.Error(err))
+		return
+	}
+	dc.OnOpen(func() {
+		rw, err := dc.Detach()
+		if err != nil {
+			return
+		}
+		data, err := json.Marshal(&goAway)
+		if err != nil {
+			_ = dc.Close()
+			return
+		}
+		_, err = rw.Write(data)
+		if err != nil {
+			l.log.Debug(ctx, "failed to send go away", slog.Error(err))
+			_ = dc.Close()
+		}
+		// The dialer closes the channel once it has read the message.
+	})
+}
+
+// refuseDraining refuses a data channel opened while the listener is shutting
+// down. It returns false if the listener isn't shutting down.
+func (l *Listener) refuseDraining(ctx context.Context, dc *webrtc.DataChannel, rw datachannel.ReadWriteCloser) bool {
+	if !l.isDraining() {
+		return false
+	}
+	defer dc.Close()
+	l.log.Debug(ctx, "refusing data channel while draining")
+	// Echo channels don't expect a response.
+	if dc.Protocol() == speedTestProtocolPrefix+speedTestEcho {
+		return true
+	}
+	if !strings.HasPrefix(dc.Protocol(), speedTestProtocolPrefix) && dc.Protocol() != muxChannelProtocol {
+		network, addr := splitProtocol(strings.TrimPrefix(dc.Protocol(), listenProtocolPrefix))
+		l.stats.failed(network, addr, CodeGoingAwayErr)
+	}
+	data, err := json.Marshal(&DialChannelResponse{
+		Code: CodeGoingAwayErr,
+		Err:  errListenerDraining.Error(),
+	})
+	if err != nil {
+		return true
+	}
+	_, _ = rw.Write(data)
+	return true
+}
+
+// handleGoAway reads the GoAway sent by the listener on a data channel it
+// opened.
+func (d *Dialer) handleGoAway(dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		defer dc.Close()
+		rw, err := dc.Detach()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, maxMessageLength)
+		n, err := rw.Read(buf)
+		if err != nil {
+			return
+		}
+		var goAway GoAway
+		err = json.Unmarshal(buf[:n], &goAway)
+		if err != nil {
+			d.log.Debug(context.Background(), "failed to read go away", slog.Error(err))
+			return
+		}
+
+		d.log.Info(context.Background(), "listener is going away", slog.F("reason", goAway.Reason), slog.F("deadline", goAway.Deadline))
+		d.goAwayMut.Lock()
+		d.goAway = &goAway
+		d.goAwayMut.Unlock()
+		if d.onGoAway != nil {
+			d.onGoAway(goAway)
+		}
+	})
+}
+
+// GoAway returns the GoAway sent by the listener if it's shutting down, or
+// nil if it isn't.
+func (d *Dialer) GoAway() *GoAway {
+	d.goAwayMut.Lock()
+	defer d.goAwayMut.Unlock()
+	return d.goAway
+}
@@ -0,0 +1,133 @@
+package wsnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog"
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func TestListenerShutdown(t *testing.T) {
+	t.Parallel()
+
+	echo := func(t *testing.T) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = listener.Close()
+		})
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	t.Run("Drains", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+
+		goAways := make(chan GoAway, 1)
+		// The dialer logs state changes after the test returns, so it
+		// doesn't log to the test.
+		dialerLog := slog.Make()
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &dialerLog,
+			OnGoAway: func(goAway GoAway) {
+				goAways <- goAway
+			},
+		}, nil)
+		require.NoError(t, err)
+		defer dialer.Close()
+
+		addr := echo(t)
+		conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- l.Shutdown(ctx, "test")
+		}()
+
+		goAway := <-goAways
+		assert.Equal(t, "test", goAway.Reason)
+		assert.False(t, goAway.Deadline.IsZero())
+		assert.Equal(t, &goAway, dialer.GoAway())
+		assert.True(t, l.Status().Draining)
+		assert.False(t, l.Status().Ready())
+
+		// New connections are refused.
+		_, err = dialer.DialContext(context.Background(), "tcp", addr)
+		var dialErr *DialError
+		require.True(t, errors.As(err, &dialErr))
+		assert.Equal(t, CodeGoingAwayErr, dialErr.Code)
+
+		// Open connections keep working until they close.
+		msg := []byte("hello")
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, make([]byte, len(msg)))
+		require.NoError(t, err)
+		select {
+		case err := <-shutdown:
+			t.Fatalf("shutdown returned with a connection open: %v", err)
+		default:
+		}
+
+		require.NoError(t, conn.Close())
+		require.NoError(t, <-shutdown)
+		assert.Equal(t, BrokerStateClosed, l.Status().BrokerState)
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+
+		// The dialer restarts and logs state changes after the test returns,
+		// so it doesn't log to the test.
+		dialerLog := slog.Make()
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:       &dialerLog,
+			Multiplex: true,
+		}, nil)
+		require.NoError(t, err)
+		defer dialer.Close()
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", echo(t))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = l.Shutdown(ctx, "test")
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+		// The connection is closed with the peer connection.
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,185 @@
+package wsnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"cdr.dev/slog"
+)
+
+// Transport is how a Dialer's connections reach the listener.
+type Transport string
+
+// Transport enums.
+const (
+	// TransportWebRTC carries connections over a WebRTC peer connection.
+	TransportWebRTC Transport = "webrtc"
+	// TransportWebsocket carries connections over a multiplexed WebSocket
+	// through the broker. It's used when DialOptions.WebsocketFallback is set
+	// and a peer connection can't be established, such as on networks that
+	// block UDP.
+	TransportWebsocket Transport = "websocket"
+)
+
+// fallbackTimeout is how long a dialer waits for the listener to accept the
+// websocket fallback. Listeners that don't support it never respond.
+var fallbackTimeout = 10 * time.Second
+
+// errWebsocketTransport is returned by features that need a peer connection
+// when the dialer is using the websocket fallback.
+var errWebsocketTransport = errors.New("not supported by the websocket transport")
+
+// Transport returns how the dialer's connections reach the listener.
+func (d *Dialer) Transport() Transport {
+	if d.rtc == nil {
+		return TransportWebsocket
+	}
+	return TransportWebRTC
+}
+
+// dialFallback asks the listener to serve multiplexed streams over a new
+// broker connection instead of a peer connection. Streams are opened and
+// answered exactly like those of DialOptions.Multiplex, but all traffic is
+// relayed by the broker, so it's slower than a peer connection. Datagrams,
+// remote listeners and speed tests aren't supported.
+func dialFallback(ctx context.Context, options *DialOptions, broker func(ctx context.Context) (net.Conn, error)) (*Dialer, error) {
+	log := *options.Log
+	conn, err := broker(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dial broker: %w", err)
+	}
+	err = requestFallback(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	session, err := yamux.Client(conn, muxConfig())
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("create multiplex: %w", err)
+	}
+	dialer := &Dialer{
+		log:           log,
+		conn:          conn,
+		mux:           session,
+		listeners:     make(map[uint16]*remoteListener),
+		stats:         newStatsTracker(nil, options.OnConnClosed, options.OnConnClosed),
+		state:         DialerStateConnecting,
+		onStateChange: options.OnStateChange,
+		onGoAway:      options.OnGoAway,
+		closed:        make(chan struct{}),
+	}
+	dialer.setState(DialerStateConnected)
+	go func() {
+		<-session.CloseChan()
+		log.Debug(context.Background(), "websocket fallback closed")
+		dialer.setState(DialerStateClosed)
+		dialer.closeOnce.Do(func() {
+			close(dialer.closed)
+		})
+	}()
+	return dialer, nil
+}
+
+// requestFallback sends the fallback request on a broker connection and waits
+// for the listener to accept it. Nothing else is sent until it has, so the
+// acknowledgement is never read by the multiplexer.
+func requestFallback(ctx context.Context, conn net.Conn) error {
+	data, err := json.Marshal(&BrokerMessage{Fallback: true})
+	if err != nil {
+		return fmt.Errorf("marshal fallback message: %w", err)
+	}
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write fallback message: %w", err)
+	}
+
+	deadline := time.Now().Add(fallbackTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetReadDeadline(deadline)
+	var msg BrokerMessage
+	err = json.NewDecoder(conn).Decode(&msg)
+	if err != nil {
+		return fmt.Errorf("wait for listener to accept fallback: %w", err)
+	}
+	if msg.Error != "" {
+		return fmt.Errorf("%w: %v", errFromPeer, msg.Error)
+	}
+	if !msg.Fallback {
+		return fmt.Errorf("unexpected fallback response: %+v", msg)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return nil
+}
+
+// serveFallback accepts a fallback request from a dialer and serves
+// multiplexed streams over the broker connection until it closes.
+func (l *Listener) serveFallback(ctx context.Context, msg BrokerMessage, conn net.Conn) {
+	l.log.Info(ctx, "serving websocket fallback")
+	data, err := json.Marshal(&BrokerMessage{Fallback: true})
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_, err = conn.Write(data)
+	if err != nil {
+		l.log.Debug(ctx, "failed to accept fallback", slog.Error(err))
+		_ = conn.Close()
+		return
+	}
+	l.negotiated()
+	l.statusMut.Lock()
+	l.fallbacks++
+	l.statusMut.Unlock()
+	defer func() {
+		l.statusMut.Lock()
+		l.fallbacks--
+		l.statusMut.Unlock()
+	}()
+
+	var (
+		connClosers    = make([]io.Closer, 0)
+		connClosersMut sync.Mutex
+	)
+	msg.localPolicies = l.policies
+	l.serveMux(ctx, msg, conn, &connClosers, &connClosersMut)
+	connClosersMut.Lock()
+	defer connClosersMut.Unlock()
+	for _, connCloser := range connClosers {
+		_ = connCloser.Close()
+	}
+}
+
+// pingMux sends a ping over the multiplexed WebSocket of the fallback. Like a
+// lost peer connection, a closed WebSocket returns io.EOF.
+func (d *Dialer) pingMux(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := d.mux.Ping()
+		if errors.Is(err, yamux.ErrSessionShutdown) {
+			err = io.EOF
+		}
+		errCh <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
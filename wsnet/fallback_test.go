@@ -0,0 +1,150 @@
+package wsnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+// unreachableICEServers returns ICE servers that peer connections can't
+// connect through. The listener doesn't validate them because they use the
+// TURN proxy username.
+func unreachableICEServers(t *testing.T) []webrtc.ICEServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	return []webrtc.ICEServer{{
+		URLs:           []string{fmt.Sprintf("turn:%s?transport=tcp", addr)},
+		Username:       turnProxyMagicUsername,
+		Credential:     turnProxyMagicUsername,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}}
+}
+
+func TestWebsocketFallback(t *testing.T) {
+	t.Run("Fallback", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := ListenWithOptions(context.Background(), log, listenAddr, "", &ListenOptions{
+			Policies: []DialPolicy{{
+				Network: "tcp",
+				Host:    "127.0.0.1",
+				Port:    uint16(listener.Addr().(*net.TCPAddr).Port),
+			}},
+		})
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:               &log,
+			ICEServers:        unreachableICEServers(t),
+			WebsocketFallback: true,
+		}, nil)
+		require.NoError(t, err)
+		defer dialer.Close()
+		assert.Equal(t, TransportWebsocket, dialer.Transport())
+		assert.Equal(t, DialerStateConnected, dialer.State())
+		require.NoError(t, dialer.Ping(context.Background()))
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+		require.NoError(t, err)
+		msg := []byte("hello")
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		rec := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, rec)
+		require.NoError(t, err)
+		assert.Equal(t, msg, rec)
+		assert.Equal(t, 1, dialer.activeConnections())
+
+		// The peer connection that failed may still be counted until the
+		// listener notices.
+		status := l.Status()
+		assert.GreaterOrEqual(t, status.Peers, 1)
+		assert.Equal(t, 1, status.CandidateTypes[string(TransportWebsocket)])
+		require.NoError(t, conn.Close())
+
+		// The listener's policies still apply.
+		_, err = dialer.DialContext(context.Background(), "tcp", "localhost:22")
+		dialErr := &DialError{}
+		require.ErrorAs(t, err, &dialErr)
+		assert.Equal(t, CodePermissionErr, dialErr.Code)
+
+		// Features that need a peer connection aren't supported.
+		_, err = dialer.DialContext(context.Background(), "udp", listener.Addr().String())
+		assert.ErrorIs(t, err, errWebsocketTransport)
+		_, err = dialer.Listen(context.Background(), "tcp", "127.0.0.1:0")
+		assert.ErrorIs(t, err, errWebsocketTransport)
+		_, err = dialer.Candidates()
+		assert.ErrorIs(t, err, errWebsocketTransport)
+
+		require.NoError(t, dialer.Close())
+		<-dialer.closed
+		assert.Equal(t, DialerStateClosed, dialer.State())
+		assert.ErrorIs(t, dialer.Ping(context.Background()), io.EOF)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:        &log,
+			ICEServers: unreachableICEServers(t),
+		}, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("Draining", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+		l.drainOnce.Do(func() {
+			close(l.draining)
+		})
+
+		// The listener refuses the fallback like it refuses offers.
+		conn, err := dialBroker(context.Background(), connectAddr, nil)
+		require.NoError(t, err)
+		err = requestFallback(context.Background(), websocket.NetConn(context.Background(), conn, websocket.MessageBinary))
+		assert.ErrorIs(t, err, errFromPeer)
+		assert.Contains(t, err.Error(), errListenerDraining.Error())
+	})
+}
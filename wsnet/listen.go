@@ -2,17 +2,22 @@ package wsnet
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
+	"github.com/pion/datachannel"
 	"github.com/pion/webrtc/v3"
 	"golang.org/x/net/proxy"
 	"nhooyr.io/websocket"
@@ -27,9 +32,19 @@ const (
 	CodeDialErr       = "dial_error"
 	CodePermissionErr = "permission_error"
 	CodeBadAddressErr = "bad_address_error"
+	// CodeGoingAwayErr is returned for connections opened while the listener
+	// is shutting down.
+	CodeGoingAwayErr = "going_away_error"
 )
 
-var connectionRetryInterval = time.Second
+var (
+	// connectionRetryInterval is the delay before the first attempt to
+	// reconnect to the broker.
+	connectionRetryInterval = time.Second
+	// maxConnectionRetryInterval is the longest delay between attempts to
+	// reconnect to the broker.
+	maxConnectionRetryInterval = time.Minute
+)
 
 // DialChannelResponse is used to notify a dial channel of a
 // listening state. Modeled after net.OpError, and marshalled
@@ -40,17 +55,63 @@ type DialChannelResponse struct {
 	// Fields are set if the code is CodeDialErr.
 	Net string
 	Op  string
+	// Addr is set to the bound address when a listen channel succeeds.
+	Addr string `json:",omitempty"`
+}
+
+// ListenOptions are configurable options for a wsnet listener.
+//
+// The connection hooks are called for connections dialers open through the
+// listener, including connections accepted on addresses bound for reverse
+// tunnels. They may be called concurrently.
+type ListenOptions struct {
+	// OnConnOpened is called when a connection is opened.
+	OnConnOpened func(ConnStats)
+	// OnConnDenied is called when a connection is refused by the dial
+	// policy. ErrorCode is CodePermissionErr.
+	OnConnDenied func(ConnStats)
+	// OnDialFailed is called when a connection fails to open because the
+	// address is invalid or can't be reached.
+	OnDialFailed func(ConnStats)
+	// OnConnClosed is called with the final statistics of each connection
+	// that was opened when it closes.
+	OnConnClosed func(ConnStats)
+
+	// Proxy returns the proxy to connect to the broker and TURN proxy
+	// through, like http.Transport.Proxy. If nil, the proxy is taken from the
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Policies restrict the addresses dialers can dial or bind in addition to
+	// the policies sent by the broker, so an address must be permitted by
+	// both. If empty, only the broker's policies apply.
+	Policies []DialPolicy
 }
 
 // Listen connects to the broker proxies connections to the local net.
 // Close will end all RTC connections.
-func Listen(ctx context.Context, log slog.Logger, broker string, turnProxyAuthToken string) (io.Closer, error) {
-	l := &listener{
+func Listen(ctx context.Context, log slog.Logger, broker string, turnProxyAuthToken string) (*Listener, error) {
+	return ListenWithOptions(ctx, log, broker, turnProxyAuthToken, nil)
+}
+
+// ListenWithOptions is like Listen, with options for the listener. Options
+// may be nil.
+func ListenWithOptions(ctx context.Context, log slog.Logger, broker string, turnProxyAuthToken string, options *ListenOptions) (*Listener, error) {
+	if options == nil {
+		options = &ListenOptions{}
+	}
+	l := &Listener{
 		log:                log,
 		broker:             broker,
 		connClosers:        make([]io.Closer, 0),
 		closed:             make(chan struct{}, 1),
 		turnProxyAuthToken: turnProxyAuthToken,
+		stats:              newStatsTracker(options.OnConnOpened, options.OnConnClosed, options.connFailed),
+		policies:           options.Policies,
+		proxy:              options.Proxy,
+		sessions:           make(map[string]*webrtc.PeerConnection),
+		peers:              make(map[*webrtc.PeerConnection]struct{}),
+		draining:           make(chan struct{}),
 	}
 
 	// We do a one-off dial outside of the loop to ensure the initial
@@ -60,45 +121,89 @@ func Listen(ctx context.Context, log slog.Logger, broker string, turnProxyAuthTo
 	if err != nil {
 		return nil, err
 	}
-	go func() {
-		for {
-			err := <-ch
+	go l.reconnect(ctx, ch)
+	return l, nil
+}
+
+// connFailed reports a connection that failed to open to the hook for its
+// error code.
+func (o *ListenOptions) connFailed(stats ConnStats) {
+	hook := o.OnDialFailed
+	if stats.ErrorCode == CodePermissionErr {
+		hook = o.OnConnDenied
+	}
+	if hook != nil {
+		hook(stats)
+	}
+}
+
+// reconnect dials the broker again whenever the connection to it is lost,
+// waiting longer between each failed attempt. Peer connections that were
+// already negotiated keep serving while the broker is unreachable.
+func (l *Listener) reconnect(ctx context.Context, ch <-chan error) {
+	for {
+		var err error
+		select {
+		case err = <-ch:
+		case <-l.closed:
+			return
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-l.closed:
+			return
+		default:
+		}
+
+		l.log.Warn(ctx, "disconnected from broker", slog.Error(err))
+		l.setBrokerState(BrokerStateReconnecting, err)
+		disconnectedAt := time.Now()
+		for attempt := 1; ; attempt++ {
+			delay := connectionRetryDelay(attempt)
+			l.log.Info(ctx, "reconnecting to broker", slog.F("attempt", attempt), slog.F("delay", delay))
 			select {
-			case _, ok := <-l.closed:
-				if !ok {
-					return
-				}
-			default:
+			case <-time.After(delay):
+			case <-l.closed:
+				return
+			case <-ctx.Done():
+				return
 			}
 
-			if err != nil {
-				l.log.Warn(ctx, "disconnected from broker", slog.Error(err))
-
-				// If we hit an EOF, then the connection to the broker
-				// was interrupted. We'll take a short break then dial
-				// again.
-				ticker := time.NewTicker(connectionRetryInterval)
-				for {
-					select {
-					case <-ticker.C:
-						ch, err = l.dial(ctx)
-					case <-ctx.Done():
-						err = ctx.Err()
-					}
-					if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-						break
-					}
-					l.log.Warn(ctx, "connecting to broker failed", slog.Error(err))
-				}
-				ticker.Stop()
+			ch, err = l.dial(ctx)
+			if err == nil {
+				l.log.Info(ctx, "reconnected to broker", slog.F("attempts", attempt), slog.F("downtime", time.Since(disconnectedAt)))
+				break
 			}
-			l.log.Info(ctx, "connected to broker")
+			l.log.Warn(ctx, "connecting to broker failed", slog.F("attempt", attempt), slog.Error(err))
+			l.setBrokerState(BrokerStateReconnecting, err)
 		}
-	}()
-	return l, nil
+	}
 }
 
-type listener struct {
+// connectionRetryDelay returns how long to wait before the nth attempt to
+// reconnect to the broker. The delay doubles with each attempt up to
+// maxConnectionRetryInterval, and is jittered so agents that lost the broker
+// at the same time don't reconnect at the same time.
+func connectionRetryDelay(attempt int) time.Duration {
+	delay := maxConnectionRetryInterval
+	if attempt <= 30 {
+		if d := connectionRetryInterval << (attempt - 1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+
+	// Wait between half and all of the delay.
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(delay/2)+1))
+	if err != nil {
+		return delay
+	}
+	return delay/2 + time.Duration(jitter.Int64())
+}
+
+// Listener accepts peer connections from dialers through a broker and proxies
+// their connections to the local network.
+type Listener struct {
 	broker             string
 	turnProxyAuthToken string
 
@@ -108,15 +213,44 @@ type listener struct {
 	connClosersMut sync.Mutex
 	closed         chan struct{}
 	nextConnNumber int64
+
+	stats    *statsTracker
+	policies []DialPolicy
+	proxy    func(*http.Request) (*url.URL, error)
+
+	// sessions are peer connections that dialers can restart ICE for, keyed
+	// by BrokerMessage.Session.
+	sessions    map[string]*webrtc.PeerConnection
+	sessionsMut sync.Mutex
+
+	// The following are reported by Status.
+	statusMut         sync.Mutex
+	brokerState       BrokerState
+	brokerError       string
+	brokerConnectedAt time.Time
+	lastNegotiation   time.Time
+	peers             map[*webrtc.PeerConnection]struct{}
+	// fallbacks is the number of dialers using the websocket fallback.
+	fallbacks int
+
+	// draining is closed when Shutdown is called.
+	draining  chan struct{}
+	drainOnce sync.Once
 }
 
-func (l *listener) dial(ctx context.Context) (<-chan error, error) {
+func (l *Listener) dial(ctx context.Context) (<-chan error, error) {
 	l.log.Info(ctx, "connecting to broker", slog.F("broker_url", l.broker))
 	if l.ws != nil {
 		_ = l.ws.Close(websocket.StatusNormalClosure, "new connection inbound")
 	}
 
-	conn, resp, err := websocket.Dial(ctx, l.broker, nil)
+	client, err := websocketClient(l.broker, l.proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn, resp, err := websocket.Dial(ctx, l.broker, &websocket.DialOptions{
+		HTTPClient: client,
+	})
 	if err != nil {
 		if resp != nil {
 			return nil, coder.NewHTTPError(resp)
@@ -134,7 +268,10 @@ func (l *listener) dial(ctx context.Context) (<-chan error, error) {
 	}
 
 	l.log.Info(ctx, "broker connection established")
-	errCh := make(chan error)
+	l.setBrokerState(BrokerStateConnected, nil)
+	// Buffered so the accept loop can exit if the listener is closed before
+	// the error is received.
+	errCh := make(chan error, 1)
 	go func() {
 		defer close(errCh)
 		for {
@@ -154,7 +291,7 @@ func (l *listener) dial(ctx context.Context) (<-chan error, error) {
 // This functions control-flow is important to readability,
 // so the cognitive overload linter has been disabled.
 // nolint:gocognit,nestif
-func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
+func (l *Listener) negotiate(ctx context.Context, conn net.Conn) {
 	id := atomic.AddInt64(&l.nextConnNumber, 1)
 	ctx = slog.With(ctx, slog.F("conn_id", id))
 
@@ -168,6 +305,9 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 		// We currently have no assurances to ensure this can't happen,
 		// so it's better to buffer and process than fail.
 		pendingCandidates = []webrtc.ICECandidateInit{}
+		// restarting is set when the offer restarts ICE for a peer
+		// connection negotiated over another broker connection.
+		restarting bool
 		// Sends the error provided then closes the connection.
 		// If RTC isn't connected, we'll close it.
 		closeError = func(err error) {
@@ -178,7 +318,8 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 			})
 			_, _ = conn.Write(d)
 			_ = conn.Close()
-			if rtc != nil {
+			// Restarted peer connections are closed if the restart times out.
+			if rtc != nil && !restarting {
 				if rtc.ConnectionState() != webrtc.PeerConnectionStateConnected {
 					rtc.Close()
 					rtc = nil
@@ -216,25 +357,62 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 			}
 		}
 
-		if msg.Offer != nil {
-			if msg.Servers == nil {
-				closeError(fmt.Errorf("ICEServers must be provided"))
+		if msg.Fallback {
+			if l.isDraining() {
+				closeError(errListenerDraining)
 				return
 			}
-			for _, server := range msg.Servers {
-				if server.Username == turnProxyMagicUsername {
-					// This candidate is only used when proxying,
-					// so it will not validate.
-					continue
-				}
+			l.serveFallback(ctx, msg, conn)
+			return
+		}
 
-				l.log.Debug(ctx, "validating ICE server", slog.F("s", server))
-				err = DialICE(server, nil)
+		if msg.Offer != nil && msg.Restart {
+			l.sessionsMut.Lock()
+			rtc = l.sessions[msg.Session]
+			l.sessionsMut.Unlock()
+			if rtc == nil {
+				closeError(fmt.Errorf("unknown session %q", msg.Session))
+				return
+			}
+			restarting = true
+			l.log.Info(ctx, "restarting ice", slog.F("session", msg.Session))
+			// The network may have changed since the servers were validated.
+			err = l.validateServers(ctx, msg.Servers)
+			if err != nil {
+				closeError(err)
+				return
+			}
+
+			err = l.answer(ctx, conn, rtc, *msg.Offer, proxyICECandidates(rtc, conn))
+			if err != nil {
+				closeError(err)
+				return
+			}
+			l.negotiated()
+			for _, candidate := range pendingCandidates {
+				l.log.Debug(ctx, "adding pending ICE candidate", slog.F("c", candidate))
+				err = rtc.AddICECandidate(candidate)
 				if err != nil {
-					closeError(fmt.Errorf("dial server %+v: %w", server.URLs, err))
+					closeError(fmt.Errorf("add pending candidate: %w", err))
 					return
 				}
 			}
+			pendingCandidates = nil
+			continue
+		}
+
+		if msg.Offer != nil {
+			// Restarts are still accepted so open connections survive until
+			// they close.
+			if l.isDraining() {
+				closeError(errListenerDraining)
+				return
+			}
+			err = l.validateServers(ctx, msg.Servers)
+			if err != nil {
+				closeError(err)
+				return
+			}
 
 			var turnProxy proxy.Dialer
 			if msg.TURNProxyURL != "" {
@@ -246,6 +424,7 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 				turnProxy = &turnProxyDialer{
 					baseURL: u,
 					token:   l.turnProxyAuthToken,
+					proxy:   l.proxy,
 				}
 			}
 			rtc, err = newPeerConnection(msg.Servers, turnProxy)
@@ -256,6 +435,15 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 			l.connClosersMut.Lock()
 			l.connClosers = append(l.connClosers, rtc)
 			l.connClosersMut.Unlock()
+			l.trackPeer(rtc)
+			// The state handler outlives this negotiation, which resets rtc
+			// on failure.
+			session, peer := msg.Session, rtc
+			if session != "" {
+				l.sessionsMut.Lock()
+				l.sessions[session] = peer
+				l.sessionsMut.Unlock()
+			}
 			rtc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
 				l.log.Info(ctx, "connection state change", slog.F("state", pcs.String()))
 				switch pcs {
@@ -265,6 +453,27 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 					// Safe to close the negotiating WebSocket.
 					_ = conn.Close()
 					return
+				case webrtc.PeerConnectionStateNew:
+					// The connection is only new again during an ICE restart.
+					return
+				case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+					if session != "" {
+						// The dialer restarts ICE to recover the connection,
+						// so connections are kept open until it gives up.
+						time.AfterFunc(restartTimeout, func() {
+							if peer.ConnectionState() != webrtc.PeerConnectionStateConnected {
+								_ = peer.Close()
+							}
+						})
+						return
+					}
+				case webrtc.PeerConnectionStateClosed:
+					l.untrackPeer(peer)
+					if session != "" {
+						l.sessionsMut.Lock()
+						delete(l.sessions, session)
+						l.sessionsMut.Unlock()
+					}
 				}
 
 				// Close connections opened when RTC was alive.
@@ -277,44 +486,15 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 			})
 
 			flushCandidates := proxyICECandidates(rtc, conn)
-			rtc.OnDataChannel(l.handle(ctx, msg, &connClosers, &connClosersMut))
-
-			l.log.Debug(ctx, "set remote description", slog.F("offer", *msg.Offer))
-			err = rtc.SetRemoteDescription(*msg.Offer)
-			if err != nil {
-				closeError(fmt.Errorf("apply offer: %w", err))
-				return
-			}
-
-			answer, err := rtc.CreateAnswer(nil)
-			if err != nil {
-				closeError(fmt.Errorf("create answer: %w", err))
-				return
-			}
-
-			l.log.Debug(ctx, "set local description", slog.F("answer", answer))
-			err = rtc.SetLocalDescription(answer)
-			if err != nil {
-				closeError(fmt.Errorf("set local answer: %w", err))
-				return
-			}
-			flushCandidates()
-
-			bmsg := &BrokerMessage{
-				Answer: rtc.LocalDescription(),
-			}
-			data, err := json.Marshal(bmsg)
-			if err != nil {
-				closeError(fmt.Errorf("marshal: %w", err))
-				return
-			}
+			msg.localPolicies = l.policies
+			rtc.OnDataChannel(l.handle(ctx, msg, rtc, &connClosers, &connClosersMut))
 
-			l.log.Debug(ctx, "writing message", slog.F("msg", bmsg))
-			_, err = conn.Write(data)
+			err = l.answer(ctx, conn, rtc, *msg.Offer, flushCandidates)
 			if err != nil {
-				closeError(fmt.Errorf("write: %w", err))
+				closeError(err)
 				return
 			}
+			l.negotiated()
 
 			for _, candidate := range pendingCandidates {
 				l.log.Debug(ctx, "adding pending ICE candidate", slog.F("c", candidate))
@@ -329,8 +509,67 @@ func (l *listener) negotiate(ctx context.Context, conn net.Conn) {
 	}
 }
 
+// validateServers checks that the ICE servers offered by the dialer are
+// reachable.
+func (l *Listener) validateServers(ctx context.Context, servers []webrtc.ICEServer) error {
+	if servers == nil {
+		return fmt.Errorf("ICEServers must be provided")
+	}
+	for _, server := range servers {
+		if server.Username == turnProxyMagicUsername {
+			// This candidate is only used when proxying,
+			// so it will not validate.
+			continue
+		}
+
+		l.log.Debug(ctx, "validating ICE server", slog.F("s", server))
+		err := DialICE(server, nil)
+		if err != nil {
+			return fmt.Errorf("dial server %+v: %w", server.URLs, err)
+		}
+	}
+	return nil
+}
+
+// answer applies an offer to the peer connection and sends the answer over
+// the broker connection.
+func (l *Listener) answer(ctx context.Context, conn net.Conn, rtc *webrtc.PeerConnection, offer webrtc.SessionDescription, flushCandidates func()) error {
+	l.log.Debug(ctx, "set remote description", slog.F("offer", offer))
+	err := rtc.SetRemoteDescription(offer)
+	if err != nil {
+		return fmt.Errorf("apply offer: %w", err)
+	}
+
+	answer, err := rtc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("create answer: %w", err)
+	}
+
+	l.log.Debug(ctx, "set local description", slog.F("answer", answer))
+	err = rtc.SetLocalDescription(answer)
+	if err != nil {
+		return fmt.Errorf("set local answer: %w", err)
+	}
+	flushCandidates()
+
+	bmsg := &BrokerMessage{
+		Answer: rtc.LocalDescription(),
+	}
+	data, err := json.Marshal(bmsg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	l.log.Debug(ctx, "writing message", slog.F("msg", bmsg))
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
 // nolint:gocognit
-func (l *listener) handle(ctx context.Context, msg BrokerMessage, connClosers *[]io.Closer, connClosersMut *sync.Mutex) func(dc *webrtc.DataChannel) {
+func (l *Listener) handle(ctx context.Context, msg BrokerMessage, rtc *webrtc.PeerConnection, connClosers *[]io.Closer, connClosersMut *sync.Mutex) func(dc *webrtc.DataChannel) {
 	return func(dc *webrtc.DataChannel) {
 		if dc.Protocol() == controlChannel {
 			// The control channel handles pings.
@@ -372,6 +611,40 @@ func (l *listener) handle(ctx context.Context, msg BrokerMessage, connClosers *[
 			if err != nil {
 				return
 			}
+			if l.refuseDraining(ctx, dc, rw) {
+				return
+			}
+
+			if dc.Protocol() == muxChannelProtocol {
+				l.log.Debug(ctx, "sending mux init message")
+				initData, err := json.Marshal(&DialChannelResponse{})
+				if err != nil {
+					_ = dc.Close()
+					return
+				}
+				_, err = rw.Write(initData)
+				if err != nil {
+					_ = dc.Close()
+					return
+				}
+				co := &dataChannelConn{
+					dc: dc,
+					rw: rw,
+				}
+				co.init()
+				l.serveMux(ctx, msg, &messageConn{dataChannelConn: co}, connClosers, connClosersMut)
+				return
+			}
+
+			if strings.HasPrefix(dc.Protocol(), speedTestProtocolPrefix) {
+				l.handleSpeedTest(ctx, dc, rw)
+				return
+			}
+
+			if strings.HasPrefix(dc.Protocol(), listenProtocolPrefix) {
+				l.handleListen(ctx, msg, rtc, dc, rw, connClosers, connClosersMut)
+				return
+			}
 
 			var init DialChannelResponse
 			sendInitMessage := func() {
@@ -403,6 +676,8 @@ func (l *listener) handle(ctx context.Context, msg BrokerMessage, connClosers *[
 				if errors.As(err, &policyErr) {
 					init.Code = CodePermissionErr
 				}
+				network, addr := splitProtocol(dc.Protocol())
+				l.stats.failed(network, addr, init.Code)
 				sendInitMessage()
 				return
 			}
@@ -420,6 +695,7 @@ func (l *listener) handle(ctx context.Context, msg BrokerMessage, connClosers *[
 			}
 			sendInitMessage()
 			if init.Err != "" {
+				l.stats.failed(network, addr, init.Code)
 				return
 			}
 
@@ -427,14 +703,18 @@ func (l *listener) handle(ctx context.Context, msg BrokerMessage, connClosers *[
 			// for buffering from the dialed endpoint to the client.
 			l.log.Debug(ctx, "data channel initialized, tunnelling")
 			co := &dataChannelConn{
-				addr: nil,
-				dc:   dc,
-				rw:   rw,
+				addr: &net.UnixAddr{
+					Name: addr,
+					Net:  network,
+				},
+				dc: dc,
+				rw: rw,
 			}
 			connClosersMut.Lock()
 			*connClosers = append(*connClosers, co)
 			connClosersMut.Unlock()
 			co.init()
+			l.stats.track(co)
 			defer nc.Close()
 			defer co.Close()
 			go func() {
@@ -446,8 +726,139 @@ func (l *listener) handle(ctx context.Context, msg BrokerMessage, connClosers *[
 	}
 }
 
+// handleListen binds the address requested by a listen data channel and opens
+// a reverse data channel to the dialer for each connection accepted on it.
+func (l *Listener) handleListen(ctx context.Context, msg BrokerMessage, rtc *webrtc.PeerConnection, dc *webrtc.DataChannel, rw datachannel.ReadWriteCloser, connClosers *[]io.Closer, connClosersMut *sync.Mutex) {
+	var res DialChannelResponse
+	sendResponse := func() error {
+		l.log.Debug(ctx, "sending listen response", slog.F("msg", res))
+		data, err := json.Marshal(&res)
+		if err != nil {
+			return err
+		}
+		_, err = rw.Write(data)
+		return err
+	}
+
+	network, addr, err := msg.getAddress(strings.TrimPrefix(dc.Protocol(), listenProtocolPrefix))
+	if err != nil {
+		res.Code = CodeBadAddressErr
+		res.Err = err.Error()
+		var policyErr notPermittedByPolicyErr
+		if errors.As(err, &policyErr) {
+			res.Code = CodePermissionErr
+		}
+		network, addr := splitProtocol(strings.TrimPrefix(dc.Protocol(), listenProtocolPrefix))
+		l.stats.failed(network, addr, res.Code)
+		_ = sendResponse()
+		_ = dc.Close()
+		return
+	}
+
+	l.log.Debug(ctx, "binding address", slog.F("network", network), slog.F("addr", addr))
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		res.Code = CodeDialErr
+		res.Err = err.Error()
+		if op, ok := err.(*net.OpError); ok {
+			res.Net = op.Net
+			res.Op = op.Op
+		}
+		l.stats.failed(network, addr, res.Code)
+		_ = sendResponse()
+		_ = dc.Close()
+		return
+	}
+	defer ln.Close()
+
+	res.Addr = ln.Addr().String()
+	err = sendResponse()
+	if err != nil {
+		l.log.Debug(ctx, "failed to write listen response", slog.Error(err))
+		_ = dc.Close()
+		return
+	}
+
+	connClosersMut.Lock()
+	*connClosers = append(*connClosers, ln)
+	connClosersMut.Unlock()
+
+	// The dialer closes the listen channel to stop listening.
+	go func() {
+		_, _ = rw.Read(make([]byte, maxMessageLength))
+		_ = ln.Close()
+	}()
+
+	id := *dc.ID()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			l.log.Debug(ctx, "stopped listening", slog.Error(err))
+			return
+		}
+		l.reverse(ctx, rtc, id, nc, connClosers, connClosersMut)
+	}
+}
+
+// reverse opens a data channel to the dialer for a connection accepted on a
+// bound address and proxies it.
+func (l *Listener) reverse(ctx context.Context, rtc *webrtc.PeerConnection, listenID uint16, nc net.Conn, connClosers *[]io.Closer, connClosersMut *sync.Mutex) {
+	if l.isDraining() {
+		l.log.Debug(ctx, "refusing reverse connection while draining")
+		_ = nc.Close()
+		return
+	}
+	proto := fmt.Sprintf("%d:%s:%s", listenID, nc.RemoteAddr().Network(), nc.RemoteAddr().String())
+	dc, err := rtc.CreateDataChannel(reverseChannelLabel, &webrtc.DataChannelInit{
+		Ordered:  boolPtr(true),
+		Protocol: &proto,
+	})
+	if err != nil {
+		l.log.Debug(ctx, "failed to create reverse data channel", slog.Error(err))
+		_ = nc.Close()
+		return
+	}
+	dc.OnOpen(func() {
+		rw, err := dc.Detach()
+		if err != nil {
+			_ = nc.Close()
+			return
+		}
+		co := &dataChannelConn{
+			addr: &net.UnixAddr{
+				Name: nc.LocalAddr().String(),
+				Net:  nc.LocalAddr().Network(),
+			},
+			dc: dc,
+			rw: rw,
+		}
+		connClosersMut.Lock()
+		*connClosers = append(*connClosers, co)
+		connClosersMut.Unlock()
+		co.init()
+		l.stats.track(co)
+		defer nc.Close()
+		defer co.Close()
+		go func() {
+			defer dc.Close()
+			_, _ = io.Copy(co, nc)
+		}()
+		_, _ = io.Copy(nc, co)
+	})
+}
+
+// splitProtocol splits a data channel protocol into a network and address
+// without validating it.
+func splitProtocol(protocol string) (network, addr string) {
+	parts := strings.SplitN(protocol, ":", 2)
+	if len(parts) != 2 {
+		return "", protocol
+	}
+	return parts[0], parts[1]
+}
+
 // Close closes the broker socket and all created RTC connections.
-func (l *listener) Close() error {
+func (l *Listener) Close() error {
 	l.log.Info(context.Background(), "listener closed")
 
 	l.connClosersMut.Lock()
@@ -461,6 +872,7 @@ func (l *listener) Close() error {
 	default:
 	}
 	close(l.closed)
+	l.setBrokerState(BrokerStateClosed, nil)
 
 	for _, connCloser := range l.connClosers {
 		// We can ignore the error here... it doesn't
@@ -472,6 +884,6 @@ func (l *listener) Close() error {
 
 // Since this listener is bound to the WebSocket, we could
 // return that resolved Addr, but until we need it we won't.
-func (l *listener) Addr() net.Addr {
+func (l *Listener) Addr() net.Addr {
 	return nil
 }
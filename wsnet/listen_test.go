@@ -2,6 +2,8 @@ package wsnet
 
 import (
 	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -48,4 +50,131 @@ func TestListen(t *testing.T) {
 		time.Sleep(connectionRetryInterval * 5)
 		<-connCh
 	})
+
+	t.Run("Reconnect Keeps Peers", func(t *testing.T) {
+		log := slogtest.Make(t, nil)
+
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer tcpListener.Close()
+		go func() {
+			for {
+				conn, err := tcpListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log: &log,
+		}, nil)
+		require.NoError(t, err)
+		conn, err := dialer.DialContext(context.Background(), "tcp", tcpListener.Addr().String())
+		require.NoError(t, err)
+
+		// Drop the connection to the broker.
+		err = l.ws.Close(websocket.StatusGoingAway, "")
+		require.NoError(t, err)
+
+		// The existing peer connection should keep working.
+		msg := []byte("hello")
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		rec := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, rec)
+		require.NoError(t, err)
+		require.Equal(t, msg, rec)
+
+		// New dialers should be able to connect once the listener has
+		// reconnected.
+		require.Eventually(t, func() bool {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			dialer, err := DialWebsocket(ctx, connectAddr, &DialOptions{
+				Log: &log,
+			}, nil)
+			if err != nil {
+				return false
+			}
+			_ = dialer.Close()
+			return true
+		}, 10*time.Second, connectionRetryInterval)
+	})
+}
+
+func TestListenerStatus(t *testing.T) {
+	log := slogtest.Make(t, nil)
+	connectAddr, listenAddr := createDumbBroker(t)
+	l, err := Listen(context.Background(), log, listenAddr, "")
+	require.NoError(t, err)
+
+	status := l.Status()
+	require.True(t, status.Ready())
+	require.Equal(t, BrokerStateConnected, status.BrokerState)
+	require.False(t, status.BrokerConnectedAt.IsZero())
+	require.True(t, status.LastNegotiation.IsZero())
+	require.Equal(t, 0, status.Peers)
+
+	dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+		Log: &log,
+	}, nil)
+	require.NoError(t, err)
+	defer dialer.Close()
+	require.NoError(t, dialer.Ping(context.Background()))
+
+	// The listener may see the connection after the dialer does.
+	require.Eventually(t, func() bool {
+		return l.Status().CandidateTypes["host"] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	status = l.Status()
+	require.False(t, status.LastNegotiation.IsZero())
+	require.Equal(t, 1, status.Peers)
+	// Only the control channel is open.
+	require.Equal(t, 1, status.DataChannels)
+
+	require.NoError(t, l.Close())
+	status = l.Status()
+	require.False(t, status.Ready())
+	require.Equal(t, BrokerStateClosed, status.BrokerState)
+}
+
+func TestConnectionRetryDelay(t *testing.T) {
+	for attempt := 1; attempt < 100; attempt++ {
+		delay := connectionRetryDelay(attempt)
+		require.LessOrEqual(t, int64(delay), int64(maxConnectionRetryInterval))
+		require.GreaterOrEqual(t, int64(delay), int64(connectionRetryInterval/2))
+	}
+	require.LessOrEqual(t, int64(connectionRetryDelay(1)), int64(connectionRetryInterval))
+	require.GreaterOrEqual(t, int64(connectionRetryDelay(3)), int64(connectionRetryInterval*2))
+}
+
+func TestListenOptionsConnFailed(t *testing.T) {
+	var denied, failed []ConnStats
+	options := &ListenOptions{
+		OnConnDenied: func(stats ConnStats) {
+			denied = append(denied, stats)
+		},
+		OnDialFailed: func(stats ConnStats) {
+			failed = append(failed, stats)
+		},
+	}
+	options.connFailed(ConnStats{Address: "localhost:22", ErrorCode: CodePermissionErr})
+	options.connFailed(ConnStats{Address: "localhost:100", ErrorCode: CodeDialErr})
+	options.connFailed(ConnStats{Address: "bad", ErrorCode: CodeBadAddressErr})
+	require.Len(t, denied, 1)
+	require.Equal(t, "localhost:22", denied[0].Address)
+	require.Len(t, failed, 2)
+
+	// Hooks are optional.
+	(&ListenOptions{}).connFailed(ConnStats{ErrorCode: CodePermissionErr})
 }
@@ -0,0 +1,349 @@
+package wsnet
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/pion/webrtc/v3"
+
+	"cdr.dev/slog"
+)
+
+// muxChannelProtocol is the label and protocol of the data channel that
+// carries multiplexed streams. Listeners that don't support multiplexing
+// reject the protocol as an invalid address, so dialers fall back to a data
+// channel per connection.
+const muxChannelProtocol = "mux"
+
+// muxConfig returns the yamux configuration for multiplexed streams.
+func muxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	return config
+}
+
+// negotiateMux opens the multiplexed data channel. An error is returned if the
+// listener doesn't support it.
+func (d *Dialer) negotiateMux(ctx context.Context) error {
+	dc, err := d.rtc.CreateDataChannel(muxChannelProtocol, &webrtc.DataChannelInit{
+		Ordered:  boolPtr(true),
+		Protocol: stringPtr(muxChannelProtocol),
+	})
+	if err != nil {
+		return fmt.Errorf("create data channel: %w", err)
+	}
+
+	d.connClosersMut.Lock()
+	d.connClosers = append(d.connClosers, dc)
+	d.connClosersMut.Unlock()
+
+	err = waitForDataChannelOpen(ctx, dc)
+	if err != nil {
+		return fmt.Errorf("wait for open: %w", err)
+	}
+	rw, err := dc.Detach()
+	if err != nil {
+		return fmt.Errorf("detach: %w", err)
+	}
+	err = d.readDialResponse(ctx, rw, nil)
+	if err != nil {
+		_ = dc.Close()
+		return err
+	}
+
+	c := &dataChannelConn{
+		dc: dc,
+		rw: rw,
+	}
+	c.init()
+	session, err := yamux.Client(&messageConn{dataChannelConn: c}, muxConfig())
+	if err != nil {
+		_ = c.Close()
+		return fmt.Errorf("create multiplex: %w", err)
+	}
+	d.mux = session
+	return nil
+}
+
+// dialMux dials the network and address over a new multiplexed stream.
+func (d *Dialer) dialMux(ctx context.Context, network, address string) (net.Conn, error) {
+	stream, err := d.mux.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("open stream: %w", err)
+	}
+	ctx = slog.With(ctx, slog.F("stream_id", stream.StreamID()))
+
+	err = writeFrame(stream, []byte(fmt.Sprintf("%s:%s", network, address)))
+	if err != nil {
+		_ = stream.Close()
+		return nil, fmt.Errorf("write stream address: %w", err)
+	}
+	err = d.readDialResponse(ctx, &frameReader{r: stream}, nil)
+	if err != nil {
+		_ = stream.Close()
+		d.stats.dialFailed(network, address, err)
+		return nil, err
+	}
+
+	c := &muxConn{
+		Stream: stream,
+		addr: &net.UnixAddr{
+			Name: address,
+			Net:  network,
+		},
+	}
+	d.stats.track(c)
+
+	d.log.Debug(ctx, "dial stream ready")
+	return c, nil
+}
+
+// serveMux accepts streams on the multiplexed data channel and proxies each
+// one to the address it requests.
+func (l *Listener) serveMux(ctx context.Context, msg BrokerMessage, conn io.ReadWriteCloser, connClosers *[]io.Closer, connClosersMut *sync.Mutex) {
+	session, err := yamux.Server(conn, muxConfig())
+	if err != nil {
+		l.log.Debug(ctx, "failed to create multiplex", slog.Error(err))
+		_ = conn.Close()
+		return
+	}
+	defer session.Close()
+	connClosersMut.Lock()
+	*connClosers = append(*connClosers, session)
+	connClosersMut.Unlock()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			l.log.Debug(ctx, "stopped accepting streams", slog.Error(err))
+			return
+		}
+		go l.handleStream(slog.With(ctx, slog.F("stream_id", stream.StreamID())), msg, stream)
+	}
+}
+
+// handleStream dials the address requested by a multiplexed stream and
+// proxies it.
+func (l *Listener) handleStream(ctx context.Context, msg BrokerMessage, stream *yamux.Stream) {
+	defer stream.Close()
+
+	// The dialer sends the address as soon as the stream is opened.
+	_ = stream.SetReadDeadline(time.Now().Add(time.Second * 5))
+	protocol := make([]byte, maxMessageLength)
+	n, err := (&frameReader{r: stream}).Read(protocol)
+	if err != nil {
+		l.log.Debug(ctx, "failed to read stream address", slog.Error(err))
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	ctx = slog.With(ctx, slog.F("stream_proto", string(protocol[:n])))
+
+	var res DialChannelResponse
+	if l.isDraining() {
+		res.Code = CodeGoingAwayErr
+		res.Err = errListenerDraining.Error()
+		network, addr := splitProtocol(string(protocol[:n]))
+		l.stats.failed(network, addr, res.Code)
+		_ = l.writeStreamResponse(ctx, stream, res)
+		return
+	}
+	network, addr, err := msg.getAddress(string(protocol[:n]))
+	if err != nil {
+		res.Code = CodeBadAddressErr
+		res.Err = err.Error()
+		var policyErr notPermittedByPolicyErr
+		if errors.As(err, &policyErr) {
+			res.Code = CodePermissionErr
+		}
+		network, addr := splitProtocol(string(protocol[:n]))
+		l.stats.failed(network, addr, res.Code)
+		_ = l.writeStreamResponse(ctx, stream, res)
+		return
+	}
+
+	l.log.Debug(ctx, "dialing remote address", slog.F("network", network), slog.F("addr", addr))
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		l.log.Debug(ctx, "failed to dial remote address")
+		res.Code = CodeDialErr
+		res.Err = err.Error()
+		if op, ok := err.(*net.OpError); ok {
+			res.Net = op.Net
+			res.Op = op.Op
+		}
+		l.stats.failed(network, addr, res.Code)
+		_ = l.writeStreamResponse(ctx, stream, res)
+		return
+	}
+	defer nc.Close()
+
+	err = l.writeStreamResponse(ctx, stream, res)
+	if err != nil {
+		return
+	}
+
+	co := &muxConn{
+		Stream: stream,
+		addr: &net.UnixAddr{
+			Name: addr,
+			Net:  network,
+		},
+	}
+	l.stats.track(co)
+	defer co.Close()
+	go func() {
+		defer co.Close()
+		_, _ = io.Copy(co, nc)
+	}()
+	_, _ = io.Copy(nc, co)
+}
+
+func (l *Listener) writeStreamResponse(ctx context.Context, stream io.Writer, res DialChannelResponse) error {
+	l.log.Debug(ctx, "sending stream init message", slog.F("msg", res))
+	data, err := json.Marshal(&res)
+	if err != nil {
+		return err
+	}
+	return writeFrame(stream, data)
+}
+
+// writeFrame writes data prefixed by its length, so it can be read by a
+// frameReader without consuming anything that follows it.
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxMessageLength {
+		return fmt.Errorf("frame larger than maximum message size: %d", maxMessageLength)
+	}
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// frameReader reads a single frame written by writeFrame on each Read.
+type frameReader struct {
+	r io.Reader
+}
+
+func (f *frameReader) Read(b []byte) (int, error) {
+	var header [2]byte
+	_, err := io.ReadFull(f.r, header[:])
+	if err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	if length > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(f.r, b[:length])
+}
+
+// messageConn adapts a data channel connection, which preserves message
+// boundaries, to the byte stream that yamux expects. Reads are served from
+// whole messages and writes are split into messages of maxMessageLength.
+type messageConn struct {
+	*dataChannelConn
+
+	buf     []byte
+	pending []byte
+}
+
+func (c *messageConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, maxMessageLength)
+		}
+		n, err := c.dataChannelConn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.buf[:n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *messageConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxMessageLength {
+			chunk = chunk[:maxMessageLength]
+		}
+		n, err := c.dataChannelConn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// muxConn is a multiplexed stream that records its traffic.
+type muxConn struct {
+	// Accessed atomically, so these must stay 64-bit aligned.
+	bytesRead    uint64
+	bytesWritten uint64
+	openedAt     time.Time
+	tracker      *statsTracker
+
+	*yamux.Stream
+	addr      *net.UnixAddr
+	closeOnce sync.Once
+}
+
+func (c *muxConn) Read(b []byte) (int, error) {
+	n, err := c.Stream.Read(b)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	return n, err
+}
+
+func (c *muxConn) Write(b []byte) (int, error) {
+	n, err := c.Stream.Write(b)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	return n, err
+}
+
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.tracker != nil {
+			c.tracker.untrack(c)
+		}
+	})
+	return c.Stream.Close()
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *muxConn) setTracker(tracker *statsTracker) {
+	c.openedAt = time.Now()
+	c.tracker = tracker
+}
+
+// stats returns the traffic statistics of the stream.
+func (c *muxConn) stats() ConnStats {
+	return ConnStats{
+		Network:      c.addr.Net,
+		Address:      c.addr.Name,
+		BytesRead:    atomic.LoadUint64(&c.bytesRead),
+		BytesWritten: atomic.LoadUint64(&c.bytesWritten),
+		OpenedAt:     c.openedAt,
+	}
+}
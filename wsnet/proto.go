@@ -1,15 +1,47 @@
 package wsnet
 
 import (
+	"context"
 	"fmt"
 	"math/bits"
 	"net"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
 
+const (
+	// listenProtocolPrefix is prepended to the protocol of a data channel to
+	// request that the listener binds the address inside the workspace instead
+	// of dialing it. Listeners that don't support binding reject the protocol
+	// as an invalid address.
+	listenProtocolPrefix = "listen:"
+	// reverseChannelLabel is the label of data channels opened by the listener
+	// for connections accepted on a bound address. The protocol is the ID of
+	// the listen data channel, followed by the network and remote address of
+	// the accepted connection.
+	reverseChannelLabel = "reverse"
+
+	// unixNetwork is the network of unix stream sockets, which are addressed
+	// by path instead of host and port.
+	unixNetwork = "unix"
+)
+
+// PolicyAction is the action taken when a DialPolicy matches.
+type PolicyAction string
+
+// PolicyAction enums.
+const (
+	// PolicyAllow permits matching connections. An empty action is treated
+	// as PolicyAllow.
+	PolicyAllow PolicyAction = "allow"
+	// PolicyDeny rejects matching connections.
+	PolicyDeny PolicyAction = "deny"
+)
+
 // DialPolicy a single network + address + port combinations that a connection
 // is permitted to use.
 type DialPolicy struct {
@@ -18,20 +50,71 @@ type DialPolicy struct {
 	// Host is the IP or hostname of the address. It should not contain the
 	// port.If empty, it applies to all hosts. "localhost", [::1], and any IPv4
 	// address under "127.0.0.0/8" can be used interchangeably.
+	//
+	// Host may also be a CIDR block such as "10.0.0.0/8", which matches IP
+	// addresses in the block, or a wildcard such as "*.svc.cluster.local",
+	// which matches any subdomain of "svc.cluster.local" but not the domain
+	// itself. When a policy has an IP or CIDR block, hostnames are resolved
+	// and every IP they resolve to must be permitted. The connection is made
+	// to the IP that was checked.
+	//
+	// For the "unix" network, Host is the path of the socket and may contain
+	// wildcards as supported by path.Match. Paths must be absolute, and
+	// they're cleaned before they're matched. Sockets have no port, so policies
+	// with a port never match them.
 	Host string `json:"address"`
 	// If port is 0, it applies to all ports.
 	Port uint16 `json:"port"`
+	// PortEnd makes the policy apply to all ports from Port to PortEnd
+	// inclusive. It's ignored if zero.
+	PortEnd uint16 `json:"port_end,omitempty"`
+	// Action is taken when the policy matches. If empty, it's PolicyAllow.
+	Action PolicyAction `json:"action,omitempty"`
+}
+
+// Validate checks that a DialPolicy can match connections as intended. A
+// policy with a typo could otherwise permit addresses it was meant to deny.
+func (p DialPolicy) Validate() error {
+	switch p.Action {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("unknown action %q", p.Action)
+	}
+	if p.PortEnd != 0 && p.PortEnd < p.Port {
+		return fmt.Errorf("port_end %d is less than port %d", p.PortEnd, p.Port)
+	}
+	if p.Network == unixNetwork {
+		if _, err := path.Match(p.Host, ""); err != nil {
+			return fmt.Errorf("invalid socket path pattern %q: %w", p.Host, err)
+		}
+		return nil
+	}
+	if strings.Contains(p.Host, "/") {
+		if _, _, err := net.ParseCIDR(p.Host); err != nil {
+			return fmt.Errorf("invalid CIDR block %q: %w", p.Host, err)
+		}
+	}
+	return nil
 }
 
 // permits checks if a DialPolicy permits a specific network + host + port
-// combination. The host must be put through normalizeHost first.
-func (p DialPolicy) permits(network, host string, port uint16) bool {
+// combination.
+func (p DialPolicy) permits(network string, host dialHost, port uint16) bool {
+	return p.Action != PolicyDeny && p.matches(network, host, port)
+}
+
+// matches checks if a DialPolicy applies to a specific network + host + port
+// combination, regardless of its action.
+func (p DialPolicy) matches(network string, host dialHost, port uint16) bool {
 	if p.Network != "" && p.Network != network {
 		return false
 	}
-	if p.Host != "" && canonicalizeHost(p.Host) != host {
+	if p.Host != "" && !p.matchesHost(network, host) {
 		return false
 	}
+	if p.PortEnd != 0 {
+		return p.Port <= port && port <= p.PortEnd
+	}
 	if p.Port != 0 && p.Port != port {
 		return false
 	}
@@ -39,6 +122,84 @@ func (p DialPolicy) permits(network, host string, port uint16) bool {
 	return true
 }
 
+func (p DialPolicy) matchesHost(network string, host dialHost) bool {
+	if network == unixNetwork {
+		ok, err := path.Match(p.Host, host.name)
+		return err == nil && ok
+	}
+
+	if strings.HasPrefix(p.Host, "*.") {
+		suffix := strings.ToLower(strings.TrimSuffix(p.Host[1:], "."))
+		return len(host.name) > len(suffix) && strings.HasSuffix(host.name, suffix)
+	}
+
+	if strings.Contains(p.Host, "/") {
+		_, block, err := net.ParseCIDR(p.Host)
+		if err != nil {
+			return false
+		}
+		if host.ip != nil && block.Contains(host.ip) {
+			return true
+		}
+		// All representations of localhost are interchangeable.
+		if host.name == "localhost" || (host.ip != nil && host.ip.IsLoopback()) {
+			return block.Contains(net.IPv4(127, 0, 0, 1)) || block.Contains(net.IPv6loopback)
+		}
+		return false
+	}
+
+	rule := newDialHost(p.Host)
+	switch {
+	case rule.name == "localhost":
+		return host.name == "localhost" || (host.ip != nil && host.ip.IsLoopback())
+	case rule.ip != nil:
+		// Equal also matches IPv4 addresses in their IPv4-mapped IPv6 form.
+		return host.ip != nil && rule.ip.Equal(host.ip)
+	default:
+		return rule.name == host.name
+	}
+}
+
+// matchesIPs returns whether the policy matches IPs, so hostnames must be
+// resolved to be checked against it.
+func (p DialPolicy) matchesIPs() bool {
+	if p.Network == unixNetwork || p.Host == "" || strings.HasPrefix(p.Host, "*.") {
+		return false
+	}
+	if strings.Contains(p.Host, "/") {
+		return true
+	}
+	rule := newDialHost(p.Host)
+	return rule.ip != nil || rule.name == "localhost"
+}
+
+// dialHost is a host checked against policies.
+type dialHost struct {
+	// name is the hostname in lowercase without a trailing dot, "localhost"
+	// for loopback IPs, or the path of a unix socket. It's empty for other
+	// IPs.
+	name string
+	// ip is the IP of the host, or the IP a hostname resolved to. It's nil
+	// for hostnames that weren't resolved.
+	ip net.IP
+}
+
+// newDialHost parses the host of an address. All representations of
+// "localhost" are named "localhost".
+func newDialHost(host string) dialHost {
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return dialHost{name: strings.ToLower(strings.TrimSuffix(host, "."))}
+	}
+	if ip.IsLoopback() {
+		return dialHost{name: "localhost", ip: ip}
+	}
+	return dialHost{ip: ip}
+}
+
 // BrokerMessage is used for brokering a dialer and listener.
 //
 // Dialers initiate an exchange by providing an Offer,
@@ -52,10 +213,26 @@ type BrokerMessage struct {
 	Offer        *webrtc.SessionDescription `json:"offer"`
 	Servers      []webrtc.ICEServer         `json:"servers"`
 	TURNProxyURL string                     `json:"turn_proxy_url"`
+	// Session identifies the peer connection across negotiations. Dialers
+	// that can restart ICE send it with every offer.
+	Session string `json:"session,omitempty"`
+	// Restart is set on offers that restart ICE for the peer connection of
+	// an existing session instead of creating a new one.
+	Restart bool `json:"restart,omitempty"`
+	// Fallback is sent instead of an offer to carry multiplexed streams over
+	// the broker connection when a peer connection can't be established. The
+	// listener echoes it back once it's ready to accept streams.
+	Fallback bool `json:"fallback,omitempty"`
 
-	// Policies denote which addresses the client can dial. If empty or nil, all
-	// addresses are permitted.
+	// Policies denote which addresses the client can dial or bind. If empty or
+	// nil, all addresses are permitted.
 	Policies []DialPolicy `json:"ports"`
+	// localPolicies are the listener's own policies, which must also permit
+	// an address. They're set by the listener and never sent.
+	localPolicies []DialPolicy
+	// lookupIP resolves hostnames for policies with IPs. It's lookupIP if
+	// nil.
+	lookupIP func(host string) ([]net.IP, error)
 
 	// Listener -> Dialer
 	Error  string                     `json:"error"`
@@ -73,17 +250,15 @@ func (msg BrokerMessage) getAddress(protocol string) (netwk, addr string, err er
 	if len(parts) != 2 {
 		return "", "", fmt.Errorf("invalid dial address: %v", protocol)
 	}
+	if parts[0] == unixNetwork {
+		return msg.getUnixAddress(protocol, parts[1])
+	}
 	host, port, err := net.SplitHostPort(parts[1])
 	if err != nil {
 		return "", "", fmt.Errorf("invalid dial address: %v", protocol)
 	}
 
-	var (
-		network    = parts[0]
-		normalHost = canonicalizeHost(host)
-		// Still return the original host value, not the canonical value.
-		fullAddr = net.JoinHostPort(host, port)
-	)
+	network := parts[0]
 	if network == "" {
 		return "", "", fmt.Errorf("invalid dial address %q network: %v", protocol, network)
 	}
@@ -95,34 +270,134 @@ func (msg BrokerMessage) getAddress(protocol string) (netwk, addr string, err er
 	if err != nil || portParsed < 0 || bits.Len(uint(portParsed)) > 16 {
 		return "", "", fmt.Errorf("invalid dial address %q port: %v", protocol, port)
 	}
-	if len(msg.Policies) == 0 {
-		return network, fullAddr, nil
+
+	// Still return the original host value, not the canonical value, unless
+	// it had to be resolved.
+	var (
+		target   = newDialHost(host)
+		targets  = []dialHost{target}
+		dialAddr = host
+	)
+	if target.ip == nil && target.name != "localhost" && msg.matchesIPs(network, uint16(portParsed)) {
+		ips, err := msg.resolve(network, target.name)
+		if err != nil {
+			return "", "", err
+		}
+		targets = targets[:0]
+		for _, ip := range ips {
+			targets = append(targets, dialHost{name: target.name, ip: ip})
+		}
+		// The IP that's dialed must be one that was checked, so DNS can't
+		// answer differently in between.
+		dialAddr = ips[0].String()
 	}
+	for _, t := range targets {
+		if !msg.permits(network, t, uint16(portParsed)) {
+			return "", "", notPermittedByPolicyErr{protocol: protocol}
+		}
+	}
+
+	return network, net.JoinHostPort(dialAddr, port), nil
+}
 
-	portParsedU16 := uint16(portParsed)
-	for _, p := range msg.Policies {
-		if p.permits(network, normalHost, portParsedU16) {
-			return network, fullAddr, nil
+// matchesIPs returns whether any policy that applies to the network and port
+// matches IPs.
+func (msg BrokerMessage) matchesIPs(network string, port uint16) bool {
+	for _, policies := range [][]DialPolicy{msg.Policies, msg.localPolicies} {
+		for _, p := range policies {
+			anyHost := p
+			anyHost.Host = ""
+			if p.matchesIPs() && anyHost.matches(network, dialHost{}, port) {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	return "", "", fmt.Errorf("connections are not permitted to %q by policy", protocol)
+// resolve returns the IPs of a hostname that the network can dial.
+func (msg BrokerMessage) resolve(network, host string) ([]net.IP, error) {
+	lookup := msg.lookupIP
+	if lookup == nil {
+		lookup = lookupIP
+	}
+	all, err := lookup(host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %q: %w", host, err)
+	}
+	var ips []net.IP
+	for _, ip := range all {
+		switch {
+		case strings.HasSuffix(network, "4") && ip.To4() == nil:
+		case strings.HasSuffix(network, "6") && ip.To4() != nil:
+		default:
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("resolve %q: no addresses for network %q", host, network)
+	}
+	return ips, nil
 }
 
-// canonicalizeHost converts all representations of "localhost" to "localhost".
-func canonicalizeHost(addr string) string {
-	addr = strings.TrimPrefix(addr, "[")
-	addr = strings.TrimSuffix(addr, "]")
+// lookupTimeout is how long resolving a hostname for policies may take.
+const lookupTimeout = 10 * time.Second
 
-	ip := net.ParseIP(addr)
-	if ip == nil {
-		return addr
+func lookupIP(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
 	}
+	return ips, nil
+}
 
-	if ip.IsLoopback() {
-		return "localhost"
+// getUnixAddress verifies that the BrokerMessage permits connecting to the
+// unix socket path provided. The path must be absolute, and it's cleaned so
+// policies can't be bypassed by spelling it differently.
+func (msg BrokerMessage) getUnixAddress(protocol, socketPath string) (netwk, addr string, err error) {
+	if !path.IsAbs(socketPath) {
+		return "", "", fmt.Errorf("invalid dial address %q path: %v must be absolute", protocol, socketPath)
+	}
+	socketPath = path.Clean(socketPath)
+	if !msg.permits(unixNetwork, dialHost{name: socketPath}, 0) {
+		return "", "", notPermittedByPolicyErr{protocol: protocol}
+	}
+	return unixNetwork, socketPath, nil
+}
+
+// permits checks that both the broker's policies and the listener's local
+// policies permit an address. Empty policies permit every address.
+func (msg BrokerMessage) permits(network string, host dialHost, port uint16) bool {
+	if len(msg.Policies) != 0 && !permitted(msg.Policies, network, host, port) {
+		return false
 	}
-	return addr
+	if len(msg.localPolicies) != 0 && !permitted(msg.localPolicies, network, host, port) {
+		return false
+	}
+	return true
+}
+
+// permitted evaluates the policies in order and returns the action of the
+// first one that matches. If none match, the address is only permitted when
+// every policy is a deny rule.
+func permitted(policies []DialPolicy, network string, host dialHost, port uint16) bool {
+	for _, p := range policies {
+		if p.matches(network, host, port) {
+			return p.Action != PolicyDeny
+		}
+	}
+	for _, p := range policies {
+		if p.Action != PolicyDeny {
+			return false
+		}
+	}
+	return true
 }
 
 type notPermittedByPolicyErr struct {
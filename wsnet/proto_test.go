@@ -1,12 +1,23 @@
 package wsnet
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"testing"
 
 	"cdr.dev/slog/sloggers/slogtest/assert"
 )
 
+// lookupExample resolves example.com without DNS.
+func lookupExample(host string) ([]net.IP, error) {
+	if host != "example.com" {
+		return nil, errors.New("no such host")
+	}
+	return []net.IP{net.ParseIP("93.184.216.34")}, nil
+}
+
 func Test_BrokerMessage(t *testing.T) {
 	t.Run("getAddress", func(t *testing.T) {
 		t.Run("OK", func(t *testing.T) {
@@ -73,6 +84,14 @@ func Test_BrokerMessage(t *testing.T) {
 					protocol:    fmt.Sprintf("tcp:localhost:%v", uint(1)<<16),
 					errContains: "port",
 				},
+				{
+					protocol:    "unix:",
+					errContains: "path",
+				},
+				{
+					protocol:    "unix:var/run/docker.sock",
+					errContains: "absolute",
+				},
 			}
 
 			var msg BrokerMessage
@@ -183,6 +202,79 @@ func Test_BrokerMessage(t *testing.T) {
 					policy:  dialPolicy("tcp", "localhost", 0),
 					ok:      true,
 				},
+				{
+					network: "tcp",
+					host:    "localhost",
+					port:    8500,
+					policy:  DialPolicy{Network: "tcp", Port: 8000, PortEnd: 9000},
+					ok:      true,
+				},
+				{
+					network: "tcp",
+					host:    "localhost",
+					port:    9001,
+					policy:  DialPolicy{Network: "tcp", Port: 8000, PortEnd: 9000},
+					ok:      false,
+				},
+				// CIDR checks.
+				{
+					network: "tcp",
+					host:    "10.1.2.3",
+					port:    1234,
+					policy:  dialPolicy("tcp", "10.0.0.0/8", 0),
+					ok:      true,
+				},
+				{
+					network: "tcp",
+					host:    "11.1.2.3",
+					port:    1234,
+					policy:  dialPolicy("tcp", "10.0.0.0/8", 0),
+					ok:      false,
+				},
+				{
+					network: "tcp",
+					host:    "[::1]",
+					port:    1234,
+					policy:  dialPolicy("tcp", "127.0.0.0/8", 0),
+					ok:      true,
+				},
+				{
+					network: "tcp",
+					host:    "[2001:db8::1]",
+					port:    1234,
+					policy:  dialPolicy("tcp", "0.0.0.0/0", 0),
+					ok:      false,
+				},
+				// Wildcard checks.
+				{
+					network: "tcp",
+					host:    "api.default.svc.cluster.local",
+					port:    443,
+					policy:  dialPolicy("tcp", "*.svc.cluster.local", 443),
+					ok:      true,
+				},
+				{
+					network: "tcp",
+					host:    "svc.cluster.local",
+					port:    443,
+					policy:  dialPolicy("tcp", "*.svc.cluster.local", 443),
+					ok:      false,
+				},
+				{
+					network: "tcp",
+					host:    "evilsvc.cluster.local",
+					port:    443,
+					policy:  dialPolicy("tcp", "*.svc.cluster.local", 443),
+					ok:      false,
+				},
+				// Deny checks.
+				{
+					network: "tcp",
+					host:    "localhost",
+					port:    1234,
+					policy:  DialPolicy{Network: "tcp", Host: "localhost", Action: PolicyDeny},
+					ok:      false,
+				},
 			}
 
 			for i, c := range cases {
@@ -190,6 +282,7 @@ func Test_BrokerMessage(t *testing.T) {
 					amsg = fmt.Sprintf("case %v '%+v': ", i, c)
 					msg  = BrokerMessage{
 						Policies: []DialPolicy{c.policy},
+						lookupIP: lookupExample,
 					}
 				)
 
@@ -204,7 +297,7 @@ func Test_BrokerMessage(t *testing.T) {
 				}
 
 				// Test DialPolicy.
-				assert.Equal(t, amsg+"policy matches", c.ok, c.policy.permits(c.network, canonicalizeHost(c.host), c.port))
+				assert.Equal(t, amsg+"policy matches", c.ok, c.policy.permits(c.network, newDialHost(c.host), c.port))
 
 				// Test BrokerMessage.
 				protocol := formatAddress(c.network, fmt.Sprintf("%v:%v", c.host, c.port))
@@ -214,11 +307,345 @@ func Test_BrokerMessage(t *testing.T) {
 				} else {
 					assert.Error(t, amsg+"successfully got invalid address", err)
 					assert.ErrorContains(t, amsg+"err contains 'not permitted'", err, "not permitted")
+					assert.True(t, amsg+"err is a policy error", errors.As(err, &notPermittedByPolicyErr{}))
 					assert.Equal(t, amsg+"empty network", "", gotNetwork)
 					assert.Equal(t, amsg+"empty address", "", gotAddr)
 				}
 			}
 		})
+
+		t.Run("Unix", func(t *testing.T) {
+			cases := []struct {
+				policies []DialPolicy
+				ok       bool
+			}{
+				{
+					policies: nil,
+					ok:       true,
+				},
+				{
+					policies: []DialPolicy{dialPolicy("unix", "/var/run/docker.sock", 0)},
+					ok:       true,
+				},
+				{
+					policies: []DialPolicy{dialPolicy("unix", "/var/run/*.sock", 0)},
+					ok:       true,
+				},
+				{
+					policies: []DialPolicy{dialPolicy("", "", 0)},
+					ok:       true,
+				},
+				{
+					policies: []DialPolicy{dialPolicy("unix", "/run/podman/podman.sock", 0)},
+					ok:       false,
+				},
+				{
+					// Sockets don't have ports.
+					policies: []DialPolicy{dialPolicy("", "", 22)},
+					ok:       false,
+				},
+				{
+					policies: []DialPolicy{dialPolicy("tcp", "", 0)},
+					ok:       false,
+				},
+				{
+					policies: []DialPolicy{{Network: "unix", Host: "/var/run/docker.sock", Action: PolicyDeny}},
+					ok:       false,
+				},
+			}
+
+			for i, c := range cases {
+				amsg := fmt.Sprintf("case %v '%+v': ", i, c.policies)
+				msg := BrokerMessage{Policies: c.policies}
+				gotNetwork, gotAddr, err := msg.getAddress("unix:/var/run/docker.sock")
+				if c.ok {
+					assert.Success(t, amsg, err)
+					assert.Equal(t, amsg+"network", "unix", gotNetwork)
+					assert.Equal(t, amsg+"path", "/var/run/docker.sock", gotAddr)
+				} else {
+					assert.True(t, amsg+"err is a policy error", errors.As(err, &notPermittedByPolicyErr{}))
+				}
+			}
+		})
+
+		t.Run("OrderedPolicies", func(t *testing.T) {
+			cases := []struct {
+				policies []DialPolicy
+				protocol string
+				ok       bool
+			}{
+				{
+					// The first matching policy wins.
+					policies: []DialPolicy{
+						{Host: "10.0.0.1", Action: PolicyDeny},
+						{Host: "10.0.0.0/8"},
+					},
+					protocol: "tcp:10.0.0.1:80",
+					ok:       false,
+				},
+				{
+					policies: []DialPolicy{
+						{Host: "10.0.0.1", Action: PolicyDeny},
+						{Host: "10.0.0.0/8"},
+					},
+					protocol: "tcp:10.0.0.2:80",
+					ok:       true,
+				},
+				{
+					policies: []DialPolicy{
+						{Host: "10.0.0.0/8"},
+						{Host: "10.0.0.1", Action: PolicyDeny},
+					},
+					protocol: "tcp:10.0.0.1:80",
+					ok:       true,
+				},
+				{
+					// Unmatched addresses are denied if there are allow rules.
+					policies: []DialPolicy{
+						{Host: "10.0.0.1", Action: PolicyDeny},
+						{Host: "10.0.0.0/8"},
+					},
+					protocol: "tcp:example.com:80",
+					ok:       false,
+				},
+				{
+					// Unmatched addresses are permitted if there are only deny
+					// rules.
+					policies: []DialPolicy{
+						{Host: "169.254.169.254", Action: PolicyDeny},
+					},
+					protocol: "tcp:example.com:80",
+					ok:       true,
+				},
+			}
+
+			for i, c := range cases {
+				amsg := fmt.Sprintf("case %v %q: ", i, c.protocol)
+				msg := BrokerMessage{Policies: c.policies, lookupIP: lookupExample}
+				_, _, err := msg.getAddress(c.protocol)
+				if c.ok {
+					assert.Success(t, amsg, err)
+				} else {
+					assert.True(t, amsg+"err is a policy error", errors.As(err, &notPermittedByPolicyErr{}))
+				}
+			}
+		})
+
+		t.Run("LocalPolicies", func(t *testing.T) {
+			cases := []struct {
+				policies      []DialPolicy
+				localPolicies []DialPolicy
+				protocol      string
+				ok            bool
+			}{
+				{
+					// Local deny rules apply when the broker permits
+					// everything.
+					localPolicies: []DialPolicy{
+						{Host: "169.254.169.254", Action: PolicyDeny},
+					},
+					protocol: "tcp:169.254.169.254:80",
+					ok:       false,
+				},
+				{
+					localPolicies: []DialPolicy{
+						{Host: "169.254.169.254", Action: PolicyDeny},
+					},
+					protocol: "tcp:localhost:80",
+					ok:       true,
+				},
+				{
+					// Local rules can't permit what the broker denies.
+					policies:      []DialPolicy{dialPolicy("tcp", "localhost", 80)},
+					localPolicies: []DialPolicy{dialPolicy("tcp", "localhost", 0)},
+					protocol:      "tcp:localhost:22",
+					ok:            false,
+				},
+				{
+					// The broker can't permit what local rules deny.
+					policies:      []DialPolicy{dialPolicy("tcp", "localhost", 0)},
+					localPolicies: []DialPolicy{dialPolicy("tcp", "localhost", 80)},
+					protocol:      "tcp:localhost:22",
+					ok:            false,
+				},
+				{
+					policies:      []DialPolicy{dialPolicy("tcp", "localhost", 0)},
+					localPolicies: []DialPolicy{dialPolicy("tcp", "localhost", 80)},
+					protocol:      "tcp:localhost:80",
+					ok:            true,
+				},
+				{
+					localPolicies: []DialPolicy{{Network: "unix", Host: "/var/run/docker.sock", Action: PolicyDeny}},
+					protocol:      "unix:/var/run/docker.sock",
+					ok:            false,
+				},
+				{
+					// Socket paths are cleaned before they're checked.
+					localPolicies: []DialPolicy{{Network: "unix", Host: "/var/run/docker.sock", Action: PolicyDeny}},
+					protocol:      "unix:/var/run//docker.sock",
+					ok:            false,
+				},
+				{
+					localPolicies: []DialPolicy{{Network: "unix", Host: "/var/run/docker.sock", Action: PolicyDeny}},
+					protocol:      "unix:/var/run/./docker.sock",
+					ok:            false,
+				},
+				{
+					localPolicies: []DialPolicy{{Network: "unix", Host: "/var/run/docker.sock", Action: PolicyDeny}},
+					protocol:      "unix:/tmp/../var/run/docker.sock",
+					ok:            false,
+				},
+			}
+
+			for i, c := range cases {
+				amsg := fmt.Sprintf("case %v %q: ", i, c.protocol)
+				msg := BrokerMessage{Policies: c.policies, localPolicies: c.localPolicies}
+				_, _, err := msg.getAddress(c.protocol)
+				if c.ok {
+					assert.Success(t, amsg, err)
+				} else {
+					assert.True(t, amsg+"err is a policy error", errors.As(err, &notPermittedByPolicyErr{}))
+				}
+			}
+		})
+
+		t.Run("ResolvedHosts", func(t *testing.T) {
+			hosts := map[string][]net.IP{
+				"metadata.google.internal": {net.ParseIP("169.254.169.254")},
+				"169-254-169-254.nip.io":   {net.ParseIP("169.254.169.254")},
+				"127-0-0-1.nip.io":         {net.ParseIP("127.0.0.1")},
+				"example.com":              {net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::")},
+				"mixed.example.com":        {net.ParseIP("10.0.0.1"), net.ParseIP("169.254.169.254")},
+			}
+			lookup := func(host string) ([]net.IP, error) {
+				ips, ok := hosts[host]
+				if !ok {
+					return nil, errors.New("no such host")
+				}
+				return ips, nil
+			}
+			metadataDeny := []DialPolicy{{Host: "169.254.169.254", Action: PolicyDeny}}
+
+			cases := []struct {
+				policies []DialPolicy
+				protocol string
+				ok       bool
+				// addr is the address dialed if it's permitted.
+				addr string
+			}{
+				{
+					// IPv4-mapped IPv6 addresses are the same IP.
+					policies: metadataDeny,
+					protocol: "tcp:[::ffff:169.254.169.254]:80",
+				},
+				{
+					policies: metadataDeny,
+					protocol: "tcp:metadata.google.internal:80",
+				},
+				{
+					// Trailing dots don't change the hostname.
+					policies: metadataDeny,
+					protocol: "tcp:169-254-169-254.nip.io.:80",
+				},
+				{
+					// Every IP a hostname resolves to must be permitted.
+					policies: metadataDeny,
+					protocol: "tcp:mixed.example.com:80",
+				},
+				{
+					policies: []DialPolicy{{Host: "169.254.0.0/16", Action: PolicyDeny}},
+					protocol: "tcp:metadata.google.internal:80",
+				},
+				{
+					policies: []DialPolicy{{Host: "localhost", Action: PolicyDeny}},
+					protocol: "tcp:127-0-0-1.nip.io:80",
+				},
+				{
+					// The IP that was checked is dialed.
+					policies: metadataDeny,
+					protocol: "tcp:example.com:80",
+					ok:       true,
+					addr:     "93.184.216.34:80",
+				},
+				{
+					policies: metadataDeny,
+					protocol: "tcp6:example.com:80",
+					ok:       true,
+					addr:     "[2606:2800:220:1::]:80",
+				},
+				{
+					// Only IPs of the network are checked and dialed.
+					policies: []DialPolicy{{Host: "93.184.216.0/24"}},
+					protocol: "tcp4:example.com:80",
+					ok:       true,
+					addr:     "93.184.216.34:80",
+				},
+				{
+					// Hostnames aren't resolved for policies without IPs.
+					policies: []DialPolicy{{Host: "*.internal", Action: PolicyDeny}},
+					protocol: "tcp:unknown.example.com:80",
+					ok:       true,
+					addr:     "unknown.example.com:80",
+				},
+				{
+					policies: []DialPolicy{{Host: "*.internal", Action: PolicyDeny}},
+					protocol: "tcp:metadata.google.internal.:80",
+				},
+			}
+
+			for i, c := range cases {
+				amsg := fmt.Sprintf("case %v %q: ", i, c.protocol)
+				msg := BrokerMessage{localPolicies: c.policies, lookupIP: lookup}
+				_, addr, err := msg.getAddress(c.protocol)
+				if c.ok {
+					assert.Success(t, amsg, err)
+					assert.Equal(t, amsg+"address", c.addr, addr)
+				} else {
+					assert.True(t, amsg+"err is a policy error", errors.As(err, &notPermittedByPolicyErr{}))
+				}
+			}
+
+			msg := BrokerMessage{localPolicies: metadataDeny, lookupIP: lookup}
+			_, _, err := msg.getAddress("tcp:unknown.example.com:80")
+			assert.ErrorContains(t, "unresolved hostnames aren't permitted", err, "resolve")
+		})
+
+		t.Run("Validate", func(t *testing.T) {
+			cases := []struct {
+				policy DialPolicy
+				ok     bool
+			}{
+				{policy: dialPolicy("tcp", "localhost", 80), ok: true},
+				{policy: DialPolicy{Host: "169.254.0.0/16", Action: PolicyDeny}, ok: true},
+				{policy: DialPolicy{Port: 8000, PortEnd: 9000}, ok: true},
+				{policy: DialPolicy{Network: "unix", Host: "/var/run/*.sock"}, ok: true},
+				{policy: DialPolicy{Action: "reject"}, ok: false},
+				{policy: DialPolicy{Host: "169.254.0.0/33"}, ok: false},
+				{policy: DialPolicy{Port: 9000, PortEnd: 8000}, ok: false},
+				{policy: DialPolicy{Network: "unix", Host: "/var/run/[.sock"}, ok: false},
+			}
+			for i, c := range cases {
+				amsg := fmt.Sprintf("case %v '%+v': ", i, c.policy)
+				err := c.policy.Validate()
+				if c.ok {
+					assert.Success(t, amsg, err)
+				} else {
+					assert.Error(t, amsg, err)
+				}
+			}
+		})
+
+		t.Run("PolicyJSON", func(t *testing.T) {
+			// Policies without the new fields must decode as before.
+			var policies []DialPolicy
+			err := json.Unmarshal([]byte(`[{"network":"tcp","address":"localhost","port":80}]`), &policies)
+			assert.Success(t, "unmarshal policies", err)
+			assert.Equal(t, "policies", []DialPolicy{dialPolicy("tcp", "localhost", 80)}, policies)
+
+			raw, err := json.Marshal(policies)
+			assert.Success(t, "marshal policies", err)
+			assert.Equal(t, "policies json", `[{"network":"tcp","address":"localhost","port":80}]`, string(raw))
+		})
 	})
 }
 
@@ -0,0 +1,150 @@
+package wsnet
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// websocketClient returns the HTTP client to open a WebSocket to the URL
+// provided with. If proxyFunc returns a proxy for the URL, the connection is
+// tunneled through it. HTTP proxies are always sent a CONNECT request, even
+// for unencrypted WebSockets, because most won't forward upgrade requests.
+//
+// If proxyFunc is nil, the proxy is taken from the HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY environment variables.
+func websocketClient(rawURL string, proxyFunc func(*http.Request) (*url.URL, error)) (*http.Client, error) {
+	if proxyFunc == nil {
+		proxyFunc = http.ProxyFromEnvironment
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	// Proxies are chosen by the scheme the WebSocket handshake is sent with.
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	proxyURL, err := proxyFunc(&http.Request{URL: u})
+	if err != nil {
+		return nil, fmt.Errorf("get proxy: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The proxy is dialed by DialContext so CONNECT is always used.
+	transport.Proxy = nil
+	if proxyURL != nil {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialProxy(ctx, proxyURL, addr)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// dialProxy opens a connection to addr through the proxy provided. HTTP and
+// HTTPS proxies are sent a CONNECT request, authenticated with the username
+// and password of the proxy URL if it has them. SOCKS5 proxies are also
+// supported.
+func dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+	case "socks5":
+		dialer, err := proxy.FromURL(proxyURL, &net.Dialer{})
+		if err != nil {
+			return nil, fmt.Errorf("create socks5 dialer: %w", err)
+		}
+		if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+			return contextDialer.DialContext(ctx, "tcp", addr)
+		}
+		return dialer.Dial("tcp", addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy: %w", err)
+	}
+	// The deadline bounds the CONNECT exchange if the proxy stops responding.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: proxyURL.Hostname(),
+		})
+		err = tlsConn.Handshake()
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("proxy tls handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("write proxy connect: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("read proxy connect response: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect to %s: %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if reader.Buffered() > 0 {
+		// The proxy sent data from the destination with the response.
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads data that was buffered while reading the CONNECT
+// response before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,137 @@
+package wsnet
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+// createConnectProxy starts an HTTP proxy that only supports CONNECT and
+// requires basic authentication. It returns the proxy URL with credentials
+// and a counter of the tunnels opened through it.
+func createConnectProxy(t *testing.T) (*url.URL, *int64) {
+	var tunnels int64
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	proxyURL := &url.URL{
+		Scheme: "http",
+		User:   url.UserPassword("user", "pass"),
+		Host:   listener.Addr().String(),
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			user, pass, ok := (&http.Request{Header: http.Header{
+				"Authorization": r.Header["Proxy-Authorization"],
+			}}).BasicAuth()
+			if !ok || user != "user" || pass != "pass" {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			conn, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer conn.Close()
+			client, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			_, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&tunnels, 1)
+			go func() {
+				_, _ = io.Copy(conn, client)
+			}()
+			_, _ = io.Copy(client, conn)
+		}),
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return proxyURL, &tunnels
+}
+
+func TestProxy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Authenticated CONNECT", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+		proxyURL, tunnels := createConnectProxy(t)
+		connectAddr, listenAddr := createDumbBroker(t)
+
+		l, err := ListenWithOptions(context.Background(), log, listenAddr, "", &ListenOptions{
+			Proxy: http.ProxyURL(proxyURL),
+		})
+		require.NoError(t, err)
+		defer l.Close()
+		require.Equal(t, int64(1), atomic.LoadInt64(tunnels))
+
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:   &log,
+			Proxy: http.ProxyURL(proxyURL),
+		}, nil)
+		require.NoError(t, err)
+		defer dialer.Close()
+		require.NoError(t, dialer.Ping(context.Background()))
+		require.Equal(t, int64(2), atomic.LoadInt64(tunnels))
+	})
+
+	t.Run("Bad Credentials", func(t *testing.T) {
+		t.Parallel()
+		log := slogtest.Make(t, nil)
+		proxyURL, _ := createConnectProxy(t)
+		proxyURL.User = url.UserPassword("user", "wrong")
+		connectAddr, _ := createDumbBroker(t)
+
+		_, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:   &log,
+			Proxy: http.ProxyURL(proxyURL),
+		}, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "407")
+	})
+
+	t.Run("Scheme", func(t *testing.T) {
+		t.Parallel()
+		var schemes []string
+		proxyFunc := func(r *http.Request) (*url.URL, error) {
+			schemes = append(schemes, r.URL.Scheme)
+			return nil, nil
+		}
+		_, err := websocketClient("ws://example.com", proxyFunc)
+		require.NoError(t, err)
+		_, err = websocketClient("wss://example.com", proxyFunc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"http", "https"}, schemes)
+	})
+
+	t.Run("Unsupported Scheme", func(t *testing.T) {
+		t.Parallel()
+		_, err := dialProxy(context.Background(), &url.URL{Scheme: "ftp", Host: "localhost:21"}, "example.com:443")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,285 @@
+package wsnet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"cdr.dev/slog"
+)
+
+// DialerState is the state of a Dialer's connection to the listener.
+type DialerState string
+
+// States reported to DialOptions.OnStateChange.
+const (
+	// DialerStateConnecting is the state until negotiation completes.
+	DialerStateConnecting DialerState = "connecting"
+	// DialerStateConnected is reported when the connection is established,
+	// and again when it's reestablished by an ICE restart.
+	DialerStateConnected DialerState = "connected"
+	// DialerStateDisconnected is reported when the connection is lost.
+	DialerStateDisconnected DialerState = "disconnected"
+	// DialerStateRestarting is reported while ICE is restarted. Connections
+	// stay open, but no data flows until the restart completes.
+	DialerStateRestarting DialerState = "restarting"
+	// DialerStateClosed is reported when the peer connection closes, either
+	// by Close or because it couldn't be restarted. It's the final state.
+	DialerStateClosed DialerState = "closed"
+)
+
+var (
+	// restartTimeout is how long a Dialer tries to restart ICE for before
+	// closing the connection.
+	restartTimeout = 30 * time.Second
+	// networkChangeInterval is how often local interface addresses are
+	// checked for changes.
+	networkChangeInterval = 2 * time.Second
+	// interfaceAddrs returns the addresses of local interfaces. It's replaced
+	// in tests to simulate network changes.
+	interfaceAddrs = net.InterfaceAddrs
+)
+
+// errFromPeer is wrapped by errors the listener sent over the broker.
+var errFromPeer = errors.New("error from peer")
+
+// newSession returns a random identifier for a peer connection, which the
+// dialer sends with restart offers so the listener can find the connection to
+// restart.
+func newSession() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// State returns the state of the connection to the listener.
+func (d *Dialer) State() DialerState {
+	d.stateMut.Lock()
+	defer d.stateMut.Unlock()
+	return d.state
+}
+
+// setState records a state transition and reports it to the OnStateChange
+// callback. Transitions out of DialerStateClosed are ignored.
+func (d *Dialer) setState(state DialerState) {
+	d.stateMut.Lock()
+	if d.state == state || d.state == DialerStateClosed {
+		d.stateMut.Unlock()
+		return
+	}
+	d.state = state
+	if state == DialerStateConnected && d.restarted != nil {
+		close(d.restarted)
+		d.restarted = nil
+	}
+	d.stateMut.Unlock()
+
+	d.log.Debug(context.Background(), "dialer state change", slog.F("state", state))
+	if d.onStateChange != nil {
+		// Callbacks are serialized so they're received in order.
+		d.callbackMut.Lock()
+		defer d.callbackMut.Unlock()
+		d.onStateChange(state)
+	}
+}
+
+// handleStateChange is called when the state of the peer connection changes
+// after it's first connected.
+func (d *Dialer) handleStateChange(pcs webrtc.PeerConnectionState) {
+	ctx := context.Background()
+	switch pcs {
+	case webrtc.PeerConnectionStateConnected:
+		d.log.Debug(ctx, "connected")
+		d.setState(DialerStateConnected)
+		return
+	case webrtc.PeerConnectionStateNew, webrtc.PeerConnectionStateConnecting:
+		// The connection is only connecting again during an ICE restart.
+		return
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		if d.broker != nil {
+			if atomic.LoadInt32(&d.restarting) == 0 {
+				d.setState(DialerStateDisconnected)
+			}
+			go d.restart(fmt.Sprintf("connection %s", pcs))
+			return
+		}
+		d.setState(DialerStateDisconnected)
+	}
+
+	// Close connections opened when RTC was alive.
+	d.log.Warn(ctx, "closing connections due to connection state change", slog.F("pcs", pcs.String()))
+	d.connClosersMut.Lock()
+	for _, connCloser := range d.connClosers {
+		_ = connCloser.Close()
+	}
+	d.connClosers = make([]io.Closer, 0)
+	d.connClosersMut.Unlock()
+
+	if pcs == webrtc.PeerConnectionStateClosed {
+		d.setState(DialerStateClosed)
+		d.closeOnce.Do(func() {
+			close(d.closed)
+		})
+	}
+}
+
+// restart renegotiates ICE over a new broker connection, which keeps the peer
+// connection and its data channels open while the network path changes. The
+// peer connection is closed if it can't be restarted within restartTimeout.
+func (d *Dialer) restart(reason string) {
+	if !atomic.CompareAndSwapInt32(&d.restarting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&d.restarting, 0)
+	select {
+	case <-d.closed:
+		return
+	default:
+	}
+
+	ctx := slog.With(context.Background(), slog.F("reason", reason))
+	d.log.Info(ctx, "restarting ice")
+	d.setState(DialerStateRestarting)
+	deadline := time.Now().Add(restartTimeout)
+	for attempt := 1; ; attempt++ {
+		restartCtx, cancel := context.WithDeadline(ctx, deadline)
+		err := d.renegotiate(restartCtx)
+		cancel()
+		if err == nil {
+			d.log.Info(ctx, "restarted ice", slog.F("attempts", attempt))
+			return
+		}
+		d.log.Warn(ctx, "restarting ice failed", slog.F("attempt", attempt), slog.Error(err))
+		// The listener refuses to restart connections it doesn't know.
+		if errors.Is(err, errFromPeer) {
+			break
+		}
+
+		delay := connectionRetryDelay(attempt)
+		if time.Until(deadline) < delay {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-d.closed:
+			return
+		}
+	}
+
+	d.log.Warn(ctx, "closing connection that couldn't be restarted")
+	_ = d.rtc.Close()
+}
+
+// renegotiate sends an ICE restart offer over a new broker connection and
+// waits for the connection to be reestablished.
+func (d *Dialer) renegotiate(ctx context.Context) error {
+	conn, err := d.broker(ctx)
+	if err != nil {
+		return fmt.Errorf("dial broker: %w", err)
+	}
+	defer conn.Close()
+
+	restarted := make(chan struct{})
+	d.stateMut.Lock()
+	d.restarted = restarted
+	d.stateMut.Unlock()
+
+	flushCandidates := proxyICECandidates(d.rtc, conn)
+	offer, err := d.rtc.CreateOffer(&webrtc.OfferOptions{
+		ICERestart: true,
+	})
+	if err != nil {
+		return fmt.Errorf("create offer: %w", err)
+	}
+	err = d.rtc.SetLocalDescription(offer)
+	if err != nil {
+		return fmt.Errorf("set local offer: %w", err)
+	}
+
+	bmsg := d.offer
+	bmsg.Offer = &offer
+	bmsg.Restart = true
+	d.log.Debug(ctx, "sending restart offer message", slog.F("msg", bmsg))
+	offerMessage, err := json.Marshal(&bmsg)
+	if err != nil {
+		return fmt.Errorf("marshal offer message: %w", err)
+	}
+	_, err = conn.Write(offerMessage)
+	if err != nil {
+		return fmt.Errorf("write offer: %w", err)
+	}
+	flushCandidates()
+
+	errCh := make(chan error, 1)
+	go func() {
+		err := d.readBrokerMessages(ctx, conn)
+		if err == nil {
+			err = errors.New("broker closed the connection")
+		}
+		errCh <- err
+	}()
+
+	select {
+	case <-restarted:
+		return nil
+	case err := <-errCh:
+		return err
+	case <-d.closed:
+		return webrtc.ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watchNetwork restarts ICE when the addresses of local interfaces change,
+// like when moving between networks or connecting to a VPN. The connection
+// may survive the change, but restarting finds the best path for the new
+// network before the old one times out.
+func (d *Dialer) watchNetwork(interval time.Duration, interfaceAddrs func() ([]net.Addr, error)) {
+	addrs := localAddresses(interfaceAddrs)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.closed:
+			return
+		}
+
+		current := localAddresses(interfaceAddrs)
+		if current == addrs {
+			continue
+		}
+		addrs = current
+		go d.restart("local network changed")
+	}
+}
+
+// localAddresses returns the addresses of local interfaces in a comparable
+// form.
+func localAddresses(interfaceAddrs func() ([]net.Addr, error)) string {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.String())
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
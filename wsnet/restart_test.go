@@ -0,0 +1,191 @@
+package wsnet
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+// stateRecorder records the states reported to DialOptions.OnStateChange.
+type stateRecorder struct {
+	mut    sync.Mutex
+	states []DialerState
+	ch     chan DialerState
+}
+
+func newStateRecorder() *stateRecorder {
+	return &stateRecorder{
+		ch: make(chan DialerState, 16),
+	}
+}
+
+func (r *stateRecorder) record(state DialerState) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.states = append(r.states, state)
+	r.ch <- state
+}
+
+// wait waits for the state provided to be reported.
+func (r *stateRecorder) wait(t *testing.T, state DialerState) {
+	t.Helper()
+	timeout := time.After(restartTimeout)
+	for {
+		select {
+		case s := <-r.ch:
+			if s == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %q", state)
+		}
+	}
+}
+
+func TestDialerRestart(t *testing.T) {
+	echo := func(t *testing.T) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = listener.Close()
+		})
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+	requireEcho := func(t *testing.T, conn net.Conn) {
+		msg := []byte("hello")
+		_, err := conn.Write(msg)
+		require.NoError(t, err)
+		rec := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, rec)
+		require.NoError(t, err)
+		require.Equal(t, msg, rec)
+	}
+
+	t.Run("Keeps Connections", func(t *testing.T) {
+		log := slogtest.Make(t, nil)
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		states := newStateRecorder()
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:           &log,
+			OnStateChange: states.record,
+		}, nil)
+		require.NoError(t, err)
+		defer dialer.Close()
+		states.wait(t, DialerStateConnected)
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", echo(t))
+		require.NoError(t, err)
+		defer conn.Close()
+		requireEcho(t, conn)
+
+		dialer.restart("test")
+		assert.Equal(t, DialerStateConnected, dialer.State())
+		requireEcho(t, conn)
+		require.NoError(t, dialer.Ping(context.Background()))
+
+		states.mut.Lock()
+		defer states.mut.Unlock()
+		assert.Equal(t, []DialerState{
+			DialerStateConnected,
+			DialerStateRestarting,
+			DialerStateConnected,
+		}, states.states)
+	})
+
+	t.Run("Unknown Session", func(t *testing.T) {
+		log := slogtest.Make(t, nil)
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		states := newStateRecorder()
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:           &log,
+			OnStateChange: states.record,
+		}, nil)
+		require.NoError(t, err)
+
+		// A listener that restarted doesn't know the session, so the dialer
+		// gives up instead of retrying.
+		ln := l
+		ln.sessionsMut.Lock()
+		ln.sessions = map[string]*webrtc.PeerConnection{}
+		ln.sessionsMut.Unlock()
+
+		dialer.restart("test")
+		states.wait(t, DialerStateClosed)
+		assert.Equal(t, DialerStateClosed, dialer.State())
+		assert.Error(t, dialer.Ping(context.Background()))
+	})
+
+	t.Run("Network Change", func(t *testing.T) {
+		// These tests aren't parallel, so the package variables can be
+		// replaced.
+		var (
+			addrsMut sync.Mutex
+			addrs    = []net.Addr{&net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(8, 32)}}
+		)
+		oldInterval, oldInterfaceAddrs := networkChangeInterval, interfaceAddrs
+		networkChangeInterval = 10 * time.Millisecond
+		interfaceAddrs = func() ([]net.Addr, error) {
+			addrsMut.Lock()
+			defer addrsMut.Unlock()
+			return addrs, nil
+		}
+		defer func() {
+			networkChangeInterval, interfaceAddrs = oldInterval, oldInterfaceAddrs
+		}()
+
+		log := slogtest.Make(t, nil)
+		connectAddr, listenAddr := createDumbBroker(t)
+		l, err := Listen(context.Background(), log, listenAddr, "")
+		require.NoError(t, err)
+		defer l.Close()
+
+		states := newStateRecorder()
+		dialer, err := DialWebsocket(context.Background(), connectAddr, &DialOptions{
+			Log:           &log,
+			OnStateChange: states.record,
+		}, nil)
+		require.NoError(t, err)
+		defer dialer.Close()
+		states.wait(t, DialerStateConnected)
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", echo(t))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		addrsMut.Lock()
+		addrs = []net.Addr{&net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(24, 32)}}
+		addrsMut.Unlock()
+		states.wait(t, DialerStateRestarting)
+		states.wait(t, DialerStateConnected)
+		requireEcho(t, conn)
+	})
+}
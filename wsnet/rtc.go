@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -64,7 +65,7 @@ func dialICEURL(server webrtc.ICEServer, rawURL string, options *DialICEOptions)
 	var (
 		tcpConn        net.Conn
 		udpConn        net.PacketConn
-		turnServerAddr = fmt.Sprintf("%s:%d", url.Host, url.Port)
+		turnServerAddr = net.JoinHostPort(url.Host, strconv.Itoa(url.Port))
 	)
 	switch {
 	case url.Scheme == ice.SchemeTypeTURN || url.Scheme == ice.SchemeTypeSTUN:
@@ -288,3 +289,7 @@ func stringPtr(s string) *string {
 func boolPtr(b bool) *bool {
 	return &b
 }
+
+func uint16Ptr(i uint16) *uint16 {
+	return &i
+}
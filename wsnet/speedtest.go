@@ -0,0 +1,472 @@
+package wsnet
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v3"
+
+	"cdr.dev/slog"
+)
+
+const (
+	// speedTestProtocolPrefix prefixes the protocol of data channels that
+	// measure the connection instead of proxying it. Listeners that don't
+	// support speed tests reject the protocol as an invalid address.
+	speedTestProtocolPrefix = "speedtest:"
+
+	speedTestUpload   = "upload"
+	speedTestDownload = "download"
+	// speedTestEcho channels are unreliable and echo every message, so lost
+	// probes are never retransmitted.
+	speedTestEcho = "echo"
+
+	// maxSpeedTestDuration limits how long a listener sends data for if the
+	// dialer never asks it to stop.
+	maxSpeedTestDuration = time.Minute
+	// probeSize is the size of the messages sent to measure loss.
+	probeSize = 64
+	// probeTimeout is how long to wait for probes after the last one is sent.
+	probeTimeout = time.Second
+)
+
+// speedTestResult is sent by the listener as a string message at the end of
+// an upload or download, which separates it from the binary data.
+type speedTestResult struct {
+	Bytes    uint64
+	Duration time.Duration
+}
+
+// Throughput is the result of sending data over a connection for a while.
+type Throughput struct {
+	Bytes    uint64
+	Duration time.Duration
+}
+
+// BitsPerSecond returns the rate the data was received at.
+func (t Throughput) BitsPerSecond() float64 {
+	if t.Duration <= 0 {
+		return 0
+	}
+	return float64(t.Bytes*8) / t.Duration.Seconds()
+}
+
+// Loss is the result of echoing probes over an unreliable data channel.
+type Loss struct {
+	Sent     int
+	Received int
+	// RTT is the mean round trip time of received probes.
+	RTT time.Duration
+	// Jitter is the mean difference between the round trip times of
+	// consecutive received probes.
+	Jitter time.Duration
+}
+
+// Ratio returns the fraction of probes that were lost.
+func (l Loss) Ratio() float64 {
+	if l.Sent == 0 {
+		return 0
+	}
+	return float64(l.Sent-l.Received) / float64(l.Sent)
+}
+
+// openSpeedTest opens a speed test data channel and detaches it.
+func (d *Dialer) openSpeedTest(ctx context.Context, mode string, init *webrtc.DataChannelInit) (*webrtc.DataChannel, datachannel.ReadWriteCloser, error) {
+	if d.rtc == nil {
+		return nil, nil, fmt.Errorf("speed test: %w", errWebsocketTransport)
+	}
+	init.Protocol = stringPtr(speedTestProtocolPrefix + mode)
+	dc, err := d.rtc.CreateDataChannel("speedtest", init)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create data channel: %w", err)
+	}
+
+	d.connClosersMut.Lock()
+	d.connClosers = append(d.connClosers, dc)
+	d.connClosersMut.Unlock()
+
+	err = waitForDataChannelOpen(ctx, dc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wait for open: %w", err)
+	}
+	rw, err := dc.Detach()
+	if err != nil {
+		return nil, nil, fmt.Errorf("detach: %w", err)
+	}
+	return dc, rw, nil
+}
+
+// Upload sends data to the listener for the duration provided and returns the
+// rate the listener received it at.
+func (d *Dialer) Upload(ctx context.Context, duration time.Duration) (Throughput, error) {
+	dc, rw, err := d.openSpeedTest(ctx, speedTestUpload, &webrtc.DataChannelInit{
+		Ordered: boolPtr(true),
+	})
+	if err != nil {
+		return Throughput{}, err
+	}
+	defer dc.Close()
+	err = d.readDialResponse(ctx, rw, nil)
+	if err != nil {
+		return Throughput{}, err
+	}
+
+	c := &dataChannelConn{
+		dc: dc,
+		rw: rw,
+	}
+	c.init()
+	data := make([]byte, maxMessageLength)
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		_, err = c.Write(data)
+		if err != nil {
+			return Throughput{}, fmt.Errorf("write: %w", err)
+		}
+	}
+	_, err = rw.WriteDataChannel([]byte("done"), true)
+	if err != nil {
+		return Throughput{}, fmt.Errorf("write done: %w", err)
+	}
+
+	var res speedTestResult
+	err = readSpeedTestResult(ctx, rw, &res, nil)
+	if err != nil {
+		return Throughput{}, err
+	}
+	return Throughput(res), nil
+}
+
+// Download receives data from the listener for the duration provided and
+// returns the rate it was received at.
+func (d *Dialer) Download(ctx context.Context, duration time.Duration) (Throughput, error) {
+	dc, rw, err := d.openSpeedTest(ctx, speedTestDownload, &webrtc.DataChannelInit{
+		Ordered: boolPtr(true),
+	})
+	if err != nil {
+		return Throughput{}, err
+	}
+	defer dc.Close()
+	err = d.readDialResponse(ctx, rw, nil)
+	if err != nil {
+		return Throughput{}, err
+	}
+
+	stop := time.AfterFunc(duration, func() {
+		_, _ = rw.WriteDataChannel([]byte("done"), true)
+	})
+	defer stop.Stop()
+
+	var (
+		res   Throughput
+		start time.Time
+	)
+	err = readSpeedTestResult(ctx, rw, &speedTestResult{}, func(n int) {
+		if start.IsZero() {
+			start = time.Now()
+		}
+		res.Bytes += uint64(n)
+	})
+	if err != nil {
+		return Throughput{}, err
+	}
+	if !start.IsZero() {
+		res.Duration = time.Since(start)
+	}
+	return res, nil
+}
+
+// readSpeedTestResult reads binary messages, passing their length to onData,
+// until the listener sends its result.
+func readSpeedTestResult(ctx context.Context, rw datachannel.ReadWriteCloser, res *speedTestResult, onData func(n int)) error {
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maxMessageLength)
+		for {
+			n, isString, err := rw.ReadDataChannel(buf)
+			if err != nil {
+				errCh <- fmt.Errorf("read result: %w", err)
+				return
+			}
+			if !isString {
+				if onData != nil {
+					onData(n)
+				}
+				continue
+			}
+			err = json.Unmarshal(buf[:n], res)
+			if err != nil {
+				err = fmt.Errorf("read result: %w", err)
+			}
+			errCh <- err
+			return
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		// Unblocks the read.
+		_ = rw.Close()
+		return ctx.Err()
+	}
+}
+
+// Loss sends count probes to the listener at the interval provided over an
+// unreliable data channel and measures how many are echoed back.
+func (d *Dialer) Loss(ctx context.Context, count int, interval time.Duration) (Loss, error) {
+	dc, rw, err := d.openSpeedTest(ctx, speedTestEcho, &webrtc.DataChannelInit{
+		Ordered:        boolPtr(false),
+		MaxRetransmits: uint16Ptr(0),
+	})
+	if err != nil {
+		return Loss{}, err
+	}
+	defer dc.Close()
+
+	var (
+		mut      sync.Mutex
+		sentAt   = make([]time.Time, count)
+		rtts     = make([]time.Duration, count)
+		received int
+		// done is closed when every probe has been echoed or the listener
+		// refused the channel.
+		done    = make(chan struct{})
+		readErr error
+	)
+	go func() {
+		defer close(done)
+		buf := make([]byte, maxMessageLength)
+		for {
+			n, _, err := rw.ReadDataChannel(buf)
+			if err != nil {
+				return
+			}
+			// Echo channels skip the dial response because it could be lost,
+			// so a listener that doesn't support them replies with an error
+			// instead of echoing.
+			if n != probeSize {
+				var res DialChannelResponse
+				err = json.Unmarshal(buf[:n], &res)
+				mut.Lock()
+				readErr = &DialError{Code: res.Code, Err: errors.New(res.Err)}
+				if err != nil {
+					readErr = fmt.Errorf("unexpected message from listener: %w", err)
+				}
+				mut.Unlock()
+				return
+			}
+
+			seq := binary.BigEndian.Uint64(buf)
+			mut.Lock()
+			if seq < uint64(count) && !sentAt[seq].IsZero() && rtts[seq] == 0 {
+				rtts[seq] = time.Since(sentAt[seq])
+				received++
+			}
+			all := received == count
+			mut.Unlock()
+			if all {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	probe := make([]byte, probeSize)
+	sent := 0
+send:
+	for ; sent < count; sent++ {
+		binary.BigEndian.PutUint64(probe, uint64(sent))
+		mut.Lock()
+		sentAt[sent] = time.Now()
+		mut.Unlock()
+		_, err = rw.WriteDataChannel(probe, false)
+		if err != nil {
+			return Loss{}, fmt.Errorf("write probe: %w", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			break send
+		case <-ctx.Done():
+			return Loss{}, ctx.Err()
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(probeTimeout):
+	case <-ctx.Done():
+		return Loss{}, ctx.Err()
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	if readErr != nil {
+		return Loss{}, readErr
+	}
+	if sent < count {
+		sent++
+	}
+	return lossFromRTTs(sent, rtts), nil
+}
+
+// lossFromRTTs summarizes the round trip times of probes in the order they
+// were sent. Lost probes have a round trip time of zero.
+func lossFromRTTs(sent int, rtts []time.Duration) Loss {
+	loss := Loss{
+		Sent: sent,
+	}
+	var (
+		total     time.Duration
+		variation time.Duration
+		previous  time.Duration
+	)
+	for _, rtt := range rtts {
+		if rtt == 0 {
+			continue
+		}
+		if loss.Received > 0 {
+			diff := rtt - previous
+			if diff < 0 {
+				diff = -diff
+			}
+			variation += diff
+		}
+		total += rtt
+		previous = rtt
+		loss.Received++
+	}
+	if loss.Received > 0 {
+		loss.RTT = total / time.Duration(loss.Received)
+	}
+	if loss.Received > 1 {
+		loss.Jitter = variation / time.Duration(loss.Received-1)
+	}
+	return loss
+}
+
+// handleSpeedTest measures the connection with the dialer.
+func (l *Listener) handleSpeedTest(ctx context.Context, dc *webrtc.DataChannel, rw datachannel.ReadWriteCloser) {
+	defer dc.Close()
+	mode := strings.TrimPrefix(dc.Protocol(), speedTestProtocolPrefix)
+
+	if mode == speedTestEcho {
+		buf := make([]byte, maxMessageLength)
+		for {
+			n, isString, err := rw.ReadDataChannel(buf)
+			if err != nil {
+				return
+			}
+			_, err = rw.WriteDataChannel(buf[:n], isString)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	var res DialChannelResponse
+	if mode != speedTestUpload && mode != speedTestDownload {
+		res.Code = CodeBadAddressErr
+		res.Err = fmt.Sprintf("unknown speed test: %s", mode)
+	}
+	data, err := json.Marshal(&res)
+	if err != nil {
+		return
+	}
+	_, err = rw.Write(data)
+	if err != nil || res.Err != "" {
+		return
+	}
+
+	var result speedTestResult
+	switch mode {
+	case speedTestUpload:
+		result, err = receiveSpeedTest(rw)
+	case speedTestDownload:
+		result, err = sendSpeedTest(dc, rw)
+	}
+	if err != nil {
+		l.log.Debug(ctx, "speed test failed", slog.Error(err))
+		return
+	}
+	data, err = json.Marshal(&result)
+	if err != nil {
+		return
+	}
+	_, _ = rw.WriteDataChannel(data, true)
+}
+
+// receiveSpeedTest counts the bytes received until the dialer is done sending.
+func receiveSpeedTest(rw datachannel.ReadWriteCloser) (speedTestResult, error) {
+	var (
+		res   speedTestResult
+		start time.Time
+		buf   = make([]byte, maxMessageLength)
+	)
+	for {
+		n, isString, err := rw.ReadDataChannel(buf)
+		if err != nil {
+			return res, err
+		}
+		if isString {
+			break
+		}
+		if start.IsZero() {
+			start = time.Now()
+		}
+		res.Bytes += uint64(n)
+	}
+	if !start.IsZero() {
+		res.Duration = time.Since(start)
+	}
+	return res, nil
+}
+
+// sendSpeedTest sends data until the dialer asks it to stop.
+func sendSpeedTest(dc *webrtc.DataChannel, rw datachannel.ReadWriteCloser) (speedTestResult, error) {
+	stop := make(chan struct{})
+	go func() {
+		defer close(stop)
+		_, _ = rw.Read(make([]byte, maxMessageLength))
+	}()
+
+	c := &dataChannelConn{
+		dc: dc,
+		rw: rw,
+	}
+	c.init()
+	var (
+		res   speedTestResult
+		start = time.Now()
+		data  = make([]byte, maxMessageLength)
+		timer = time.NewTimer(maxSpeedTestDuration)
+	)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			res.Duration = time.Since(start)
+			return res, nil
+		case <-timer.C:
+			res.Duration = time.Since(start)
+			return res, nil
+		default:
+		}
+		n, err := c.Write(data)
+		res.Bytes += uint64(n)
+		if err != nil {
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package wsnet
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnStats are traffic statistics for a single connection over a data
+// channel. Bytes are counted from the perspective of the side reporting them,
+// so bytes read by a Dialer are bytes written by the listener.
+type ConnStats struct {
+	Network string
+	Address string
+
+	BytesRead    uint64
+	BytesWritten uint64
+
+	OpenedAt time.Time
+	// ClosedAt is zero while the connection is open.
+	ClosedAt time.Time
+
+	// ErrorCode is one of the DialChannelResponse codes if the connection
+	// failed to open. Failed connections never transfer any bytes.
+	ErrorCode string
+}
+
+// Duration returns how long the connection has been open for.
+func (s ConnStats) Duration() time.Duration {
+	if s.ClosedAt.IsZero() {
+		return time.Since(s.OpenedAt)
+	}
+	return s.ClosedAt.Sub(s.OpenedAt)
+}
+
+// Stats are aggregate traffic statistics for a Dialer.
+type Stats struct {
+	// Conns are the connections that are currently open.
+	Conns []ConnStats
+
+	// The following totals include connections that have been closed.
+	ConnsOpened  uint64
+	ConnsClosed  uint64
+	BytesRead    uint64
+	BytesWritten uint64
+	// DialErrors counts the connections the listener refused or failed to
+	// open by DialChannelResponse code.
+	DialErrors map[string]uint64
+}
+
+// trackedConn is a connection that records its own traffic.
+type trackedConn interface {
+	// setTracker marks the connection as opened, so it's untracked by the
+	// tracker when closed.
+	setTracker(t *statsTracker)
+	stats() ConnStats
+}
+
+// statsTracker records traffic for the connections of a Dialer or a
+// listener's peer connection.
+type statsTracker struct {
+	mut          sync.Mutex
+	open         map[trackedConn]struct{}
+	opened       uint64
+	closed       uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	dialErrors   map[string]uint64
+
+	// The following are called without the lock held, and may be nil.
+	onOpened func(ConnStats)
+	onClosed func(ConnStats)
+	onFailed func(ConnStats)
+}
+
+func newStatsTracker(onOpened, onClosed, onFailed func(ConnStats)) *statsTracker {
+	return &statsTracker{
+		open:       make(map[trackedConn]struct{}),
+		dialErrors: make(map[string]uint64),
+		onOpened:   onOpened,
+		onClosed:   onClosed,
+		onFailed:   onFailed,
+	}
+}
+
+// track starts recording traffic for a connection.
+func (t *statsTracker) track(c trackedConn) {
+	c.setTracker(t)
+
+	t.mut.Lock()
+	t.open[c] = struct{}{}
+	t.opened++
+	t.mut.Unlock()
+
+	if t.onOpened != nil {
+		t.onOpened(c.stats())
+	}
+}
+
+// untrack adds the traffic of a closed connection to the totals.
+func (t *statsTracker) untrack(c trackedConn) {
+	stats := c.stats()
+	stats.ClosedAt = time.Now()
+
+	t.mut.Lock()
+	delete(t.open, c)
+	t.closed++
+	t.bytesRead += stats.BytesRead
+	t.bytesWritten += stats.BytesWritten
+	t.mut.Unlock()
+
+	if t.onClosed != nil {
+		t.onClosed(stats)
+	}
+}
+
+// dialFailed records a connection that failed to open. Errors that weren't
+// returned by the listener are ignored.
+func (t *statsTracker) dialFailed(network, address string, err error) {
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) {
+		return
+	}
+	t.failed(network, address, dialErr.Code)
+}
+
+// failed records a connection that failed to open with a code.
+func (t *statsTracker) failed(network, address, code string) {
+	now := time.Now()
+
+	t.mut.Lock()
+	t.dialErrors[code]++
+	t.mut.Unlock()
+
+	if t.onFailed != nil {
+		t.onFailed(ConnStats{
+			Network:   network,
+			Address:   address,
+			OpenedAt:  now,
+			ClosedAt:  now,
+			ErrorCode: code,
+		})
+	}
+}
+
+// openConns returns the number of connections that are open.
+func (t *statsTracker) openConns() int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return len(t.open)
+}
+
+// snapshot returns the current statistics.
+func (t *statsTracker) snapshot() Stats {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	stats := Stats{
+		Conns:        make([]ConnStats, 0, len(t.open)),
+		ConnsOpened:  t.opened,
+		ConnsClosed:  t.closed,
+		BytesRead:    t.bytesRead,
+		BytesWritten: t.bytesWritten,
+		DialErrors:   make(map[string]uint64, len(t.dialErrors)),
+	}
+	for c := range t.open {
+		s := c.stats()
+		stats.Conns = append(stats.Conns, s)
+		stats.BytesRead += s.BytesRead
+		stats.BytesWritten += s.BytesWritten
+	}
+	for code, count := range t.dialErrors {
+		stats.DialErrors[code] = count
+	}
+	sort.Slice(stats.Conns, func(i, j int) bool {
+		return stats.Conns[i].OpenedAt.Before(stats.Conns[j].OpenedAt)
+	})
+	return stats
+}
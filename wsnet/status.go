@@ -0,0 +1,132 @@
+package wsnet
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// BrokerState is the state of a Listener's connection to the broker.
+type BrokerState string
+
+// BrokerState enums.
+const (
+	// BrokerStateConnected is the state while the listener can accept new
+	// peer connections.
+	BrokerStateConnected BrokerState = "connected"
+	// BrokerStateReconnecting is the state after the connection to the broker
+	// is lost. Peer connections that were already negotiated keep serving.
+	BrokerStateReconnecting BrokerState = "reconnecting"
+	// BrokerStateClosed is the state after the listener is closed.
+	BrokerStateClosed BrokerState = "closed"
+)
+
+// ListenerStatus is a snapshot of the state of a Listener.
+type ListenerStatus struct {
+	BrokerState BrokerState `json:"broker_state"`
+	// Draining is set once the listener starts shutting down.
+	Draining bool `json:"draining"`
+	// BrokerError is why the connection to the broker was lost. It's empty
+	// while connected.
+	BrokerError string `json:"broker_error,omitempty"`
+	// BrokerConnectedAt is when the listener last connected to the broker.
+	BrokerConnectedAt time.Time `json:"broker_connected_at"`
+	// LastNegotiation is when a peer connection was last negotiated or
+	// restarted. It's zero if none have been.
+	LastNegotiation time.Time `json:"last_negotiation"`
+
+	// Peers is the number of peer connections that haven't failed or closed,
+	// plus dialers using the websocket fallback.
+	Peers int `json:"peers"`
+	// DataChannels is the number of open data channels across all peers,
+	// including their control channels.
+	DataChannels int `json:"data_channels"`
+	// CandidateTypes counts the connected peers by the type of the local
+	// ICE candidate in use, such as "host", "srflx" or "relay". Dialers using
+	// the websocket fallback are counted as "websocket".
+	CandidateTypes map[string]int `json:"candidate_types"`
+}
+
+// Ready returns whether the listener can accept new peer connections.
+func (s ListenerStatus) Ready() bool {
+	return s.BrokerState == BrokerStateConnected && !s.Draining
+}
+
+// Status returns the state of the listener and its peer connections.
+func (l *Listener) Status() ListenerStatus {
+	l.statusMut.Lock()
+	status := ListenerStatus{
+		BrokerState:       l.brokerState,
+		BrokerError:       l.brokerError,
+		BrokerConnectedAt: l.brokerConnectedAt,
+		LastNegotiation:   l.lastNegotiation,
+		Draining:          l.isDraining(),
+		CandidateTypes:    make(map[string]int),
+	}
+	peers := make([]*webrtc.PeerConnection, 0, len(l.peers))
+	for peer := range l.peers {
+		peers = append(peers, peer)
+	}
+	fallbacks := l.fallbacks
+	l.statusMut.Unlock()
+
+	if fallbacks > 0 {
+		status.Peers += fallbacks
+		status.CandidateTypes[string(TransportWebsocket)] = fallbacks
+	}
+	for _, peer := range peers {
+		switch peer.ConnectionState() {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			continue
+		}
+		status.Peers++
+		stats, ok := peer.GetStats().GetConnectionStats(peer)
+		if ok {
+			status.DataChannels += int(stats.DataChannelsAccepted+stats.DataChannelsRequested) - int(stats.DataChannelsClosed)
+		}
+		if peer.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+		pair, err := peer.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+		if err != nil || pair == nil {
+			continue
+		}
+		status.CandidateTypes[pair.Local.Typ.String()]++
+	}
+	return status
+}
+
+// setBrokerState records a change to the connection to the broker.
+func (l *Listener) setBrokerState(state BrokerState, err error) {
+	l.statusMut.Lock()
+	defer l.statusMut.Unlock()
+	l.brokerState = state
+	l.brokerError = ""
+	if err != nil {
+		l.brokerError = err.Error()
+	}
+	if state == BrokerStateConnected {
+		l.brokerConnectedAt = time.Now()
+	}
+}
+
+// negotiated records that a peer connection was negotiated or restarted.
+func (l *Listener) negotiated() {
+	l.statusMut.Lock()
+	defer l.statusMut.Unlock()
+	l.lastNegotiation = time.Now()
+}
+
+// trackPeer counts a peer connection until it closes.
+func (l *Listener) trackPeer(peer *webrtc.PeerConnection) {
+	l.statusMut.Lock()
+	defer l.statusMut.Unlock()
+	l.peers[peer] = struct{}{}
+}
+
+// untrackPeer stops counting a closed peer connection.
+func (l *Listener) untrackPeer(peer *webrtc.PeerConnection) {
+	l.statusMut.Lock()
+	defer l.statusMut.Unlock()
+	delete(l.peers, peer)
+}
@@ -75,7 +75,9 @@ func createDumbBroker(t testing.TB) (connectAddr string, listenAddr string) {
 		}
 		oc, err := sess.Open()
 		if err != nil {
-			t.Error(err)
+			// The listener may have disconnected, which dialers restarting
+			// ICE can race with.
+			return
 		}
 		go func() {
 			_, _ = io.Copy(nc, oc)
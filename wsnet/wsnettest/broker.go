@@ -0,0 +1,236 @@
+package wsnettest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"nhooyr.io/websocket"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// Faults are failures injected into the negotiation between a dialer and a
+// listener by a Broker.
+type Faults struct {
+	// DropCandidate is called for every ICE candidate sent in either
+	// direction. The candidate is not delivered if it returns true.
+	DropCandidate func(candidate string) bool
+	// AnswerDelay delays the delivery of the listener's answer to the dialer.
+	AnswerDelay time.Duration
+}
+
+// Broker is an in-process broker that pairs dialers on ConnectURL with the
+// listener most recently connected on ListenURL, like a Coder deployment
+// does for a single workspace.
+type Broker struct {
+	// ConnectURL is the broker address for wsnet.DialWebsocket.
+	ConnectURL string
+	// ListenURL is the broker address for wsnet.Listen.
+	ListenURL string
+
+	listener net.Listener
+	server   *http.Server
+
+	mut       sync.Mutex
+	session   *yamux.Session
+	listeners []*websocket.Conn
+	dialers   []*websocket.Conn
+	faults    Faults
+	policies  []wsnet.DialPolicy
+}
+
+// NewBroker starts a broker on localhost. It's closed when the test ends.
+func NewBroker(t testing.TB) *Broker {
+	t.Helper()
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &Broker{
+		ConnectURL: fmt.Sprintf("ws://%s/connect", listener.Addr()),
+		ListenURL:  fmt.Sprintf("ws://%s/listen", listener.Addr()),
+		listener:   listener,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/listen", b.serveListen)
+	mux.HandleFunc("/connect", b.serveConnect)
+	b.server = &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		_ = b.server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+	return b
+}
+
+// SetFaults replaces the faults injected into negotiations that happen after
+// it returns.
+func (b *Broker) SetFaults(faults Faults) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.faults = faults
+}
+
+// SetPolicies sets the policies sent to the listener with each offer.
+func (b *Broker) SetPolicies(policies []wsnet.DialPolicy) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.policies = policies
+}
+
+// DisconnectListeners drops the broker connection of every listener. Listeners
+// reconnect on their own.
+func (b *Broker) DisconnectListeners() {
+	b.mut.Lock()
+	conns := b.listeners
+	b.listeners = nil
+	b.session = nil
+	b.mut.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close(websocket.StatusGoingAway, "disconnected by test")
+	}
+}
+
+// DisconnectDialers drops the broker connection of every dialer that is still
+// negotiating.
+func (b *Broker) DisconnectDialers() {
+	b.mut.Lock()
+	conns := b.dialers
+	b.dialers = nil
+	b.mut.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close(websocket.StatusGoingAway, "disconnected by test")
+	}
+}
+
+// WaitForListener waits until a listener is connected to the broker, which
+// is needed before dialing. Listeners reconnect after DisconnectListeners
+// with a backoff of about a second.
+func (b *Broker) WaitForListener(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		b.mut.Lock()
+		connected := b.session != nil && !b.session.IsClosed()
+		b.mut.Unlock()
+		if connected {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops the broker and drops every connection to it.
+func (b *Broker) Close() error {
+	b.DisconnectListeners()
+	b.DisconnectDialers()
+	return b.server.Close()
+}
+
+func (b *Broker) serveListen(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	nc := websocket.NetConn(context.Background(), conn, websocket.MessageBinary)
+	session, err := yamux.Client(nc, nil)
+	if err != nil {
+		_ = conn.Close(websocket.StatusInternalError, err.Error())
+		return
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.session = session
+	b.listeners = append(b.listeners, conn)
+}
+
+func (b *Broker) serveConnect(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	nc := websocket.NetConn(context.Background(), conn, websocket.MessageBinary)
+	defer nc.Close()
+
+	b.mut.Lock()
+	session := b.session
+	faults := b.faults
+	policies := b.policies
+	b.dialers = append(b.dialers, conn)
+	b.mut.Unlock()
+
+	if session == nil {
+		// Discard inbound to emulate a pubsub where we don't know if anyone
+		// is listening on the other side.
+		_, _ = io.Copy(io.Discard, nc)
+		return
+	}
+	// The stream is left open when the dialer disconnects because listeners
+	// abandon peer connections that are still connecting when negotiation
+	// ends. It's closed with the listener's session.
+	stream, err := session.Open()
+	if err != nil {
+		return
+	}
+
+	go func() {
+		defer nc.Close()
+		relay(stream, nc, func(msg *wsnet.BrokerMessage) bool {
+			if msg.Answer != nil && faults.AnswerDelay > 0 {
+				time.Sleep(faults.AnswerDelay)
+			}
+			return dropCandidate(faults, msg)
+		})
+	}()
+	relay(nc, stream, func(msg *wsnet.BrokerMessage) bool {
+		if msg.Offer != nil && policies != nil {
+			msg.Policies = policies
+		}
+		return dropCandidate(faults, msg)
+	})
+}
+
+func dropCandidate(faults Faults, msg *wsnet.BrokerMessage) bool {
+	return msg.Candidate != "" && faults.DropCandidate != nil && faults.DropCandidate(msg.Candidate)
+}
+
+// relay copies broker messages from src to dst until either fails. Messages
+// are dropped if the filter returns true.
+func relay(src io.Reader, dst io.Writer, filter func(msg *wsnet.BrokerMessage) bool) {
+	decoder := json.NewDecoder(src)
+	encoder := json.NewEncoder(dst)
+	for {
+		var msg wsnet.BrokerMessage
+		err := decoder.Decode(&msg)
+		if err != nil {
+			return
+		}
+		if filter(&msg) {
+			continue
+		}
+		err = encoder.Encode(&msg)
+		if err != nil {
+			return
+		}
+	}
+}
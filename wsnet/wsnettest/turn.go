@@ -0,0 +1,169 @@
+package wsnettest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// turnUsername and turnPassword authenticate with a TURNServer.
+	turnUsername = "wsnettest"
+	turnPassword = "wsnettest"
+)
+
+// TURNServer is an in-process TURN server that relays through localhost.
+type TURNServer struct {
+	// Addr is the address the server listens on.
+	Addr   string
+	scheme ice.SchemeType
+	close  func()
+}
+
+// NewTURNServer starts a TURN server on localhost. "turn" servers listen on
+// UDP and "turns" servers listen on TCP with a self-signed certificate. It's
+// closed when the test ends.
+func NewTURNServer(t testing.TB, scheme ice.SchemeType) *TURNServer {
+	t.Helper()
+
+	var (
+		listeners   []turn.ListenerConfig
+		pcListeners []turn.PacketConnConfig
+		relay       = &turn.RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "127.0.0.1",
+		}
+		listenAddr net.Addr
+	)
+	url, err := ice.ParseURL(fmt.Sprintf("%s:localhost", scheme))
+	if err != nil {
+		t.Fatalf("parse turn url: %v", err)
+	}
+
+	switch url.Proto {
+	case ice.ProtoTypeTCP:
+		var tcpListener net.Listener
+		if url.IsSecure() {
+			tcpListener, err = tls.Listen("tcp4", "127.0.0.1:0", generateTLSConfig(t))
+		} else {
+			tcpListener, err = net.Listen("tcp4", "127.0.0.1:0")
+		}
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		listenAddr = tcpListener.Addr()
+		listeners = []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relay,
+		}}
+	case ice.ProtoTypeUDP:
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		listenAddr = udpListener.LocalAddr()
+		pcListeners = []turn.PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: relay,
+		}}
+	}
+
+	lf := logging.NewDefaultLoggerFactory()
+	lf.DefaultLogLevel = logging.LogLevelDisabled
+	srv, err := turn.NewServer(turn.ServerConfig{
+		PacketConnConfigs: pcListeners,
+		ListenerConfigs:   listeners,
+		Realm:             "coder",
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return turn.GenerateAuthKey(username, realm, turnPassword), true
+		},
+		LoggerFactory: lf,
+	})
+	if err != nil {
+		t.Fatalf("create turn server: %v", err)
+	}
+	s := &TURNServer{
+		Addr:   listenAddr.String(),
+		scheme: scheme,
+		close: func() {
+			for _, l := range listeners {
+				_ = l.Listener.Close()
+			}
+			for _, l := range pcListeners {
+				_ = l.PacketConn.Close()
+			}
+			_ = srv.Close()
+		},
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+// ICEServer returns the ICE server to pass to wsnet.DialOptions.
+func (s *TURNServer) ICEServer() webrtc.ICEServer {
+	return webrtc.ICEServer{
+		URLs:           []string{fmt.Sprintf("%s:%s", s.scheme, s.Addr)},
+		Username:       turnUsername,
+		Credential:     turnPassword,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+}
+
+// Close stops the server, which breaks connections relayed through it.
+func (s *TURNServer) Close() error {
+	s.close()
+	return nil
+}
+
+func generateTLSConfig(t testing.TB) *tls.Config {
+	t.Helper()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Organization: []string{"Acme Co"},
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour * 24 * 180),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	certBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		t.Fatalf("convert to key pair: %v", err)
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+}
@@ -0,0 +1,89 @@
+// Package wsnettest provides an in-process broker, TURN server and helpers
+// for testing code built on wsnet without a Coder deployment.
+package wsnettest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+
+	"cdr.dev/coder-cli/wsnet"
+)
+
+// Options configure the connection made by Dial.
+type Options struct {
+	// Broker negotiates the connection. If nil, a new broker is started.
+	Broker *Broker
+	// Faults are injected into the broker before dialing. They replace any
+	// faults already set on the broker.
+	Faults Faults
+	// TURN starts a TURN server and makes it the dialer's only ICE server,
+	// which restricts the connection to candidates relayed through it.
+	TURN bool
+
+	DialOptions   *wsnet.DialOptions
+	ListenOptions *wsnet.ListenOptions
+}
+
+// Dial starts a listener and returns a Dialer connected to it through a
+// broker. Both are closed when the test ends, but the listener can be closed
+// earlier to simulate the workspace going away.
+func Dial(t testing.TB, options *Options) (*wsnet.Dialer, io.Closer) {
+	t.Helper()
+
+	if options == nil {
+		options = &Options{}
+	}
+	broker := options.Broker
+	if broker == nil {
+		broker = NewBroker(t)
+	}
+	dialOptions := wsnet.DialOptions{}
+	if options.DialOptions != nil {
+		dialOptions = *options.DialOptions
+	}
+
+	if options.TURN {
+		turn := NewTURNServer(t, ice.SchemeTypeTURN)
+		dialOptions.ICEServers = []webrtc.ICEServer{turn.ICEServer()}
+	}
+	broker.SetFaults(options.Faults)
+
+	listener := Listen(t, broker, options.ListenOptions)
+	dialer, err := wsnet.DialWebsocket(context.Background(), broker.ConnectURL, &dialOptions, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = dialer.Close()
+	})
+	return dialer, listener
+}
+
+// Listen connects a listener to the broker. It's closed when the test ends.
+// Use it with wsnet.DialWebsocket to test negotiation failures.
+func Listen(t testing.TB, broker *Broker, options *wsnet.ListenOptions) *wsnet.Listener {
+	t.Helper()
+
+	// Logs are discarded because peer connections log after tests complete.
+	listener, err := wsnet.ListenWithOptions(context.Background(), slog.Make(), broker.ListenURL, "", options)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = broker.WaitForListener(ctx)
+	if err != nil {
+		t.Fatalf("wait for listener: %v", err)
+	}
+	return listener
+}
@@ -0,0 +1,174 @@
+package wsnettest_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/coder-cli/wsnet"
+	"cdr.dev/coder-cli/wsnet/wsnettest"
+)
+
+// echo starts a TCP server that echoes everything it reads.
+func echo(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// requireEcho writes a message on a new connection to addr and requires it
+// to be echoed back.
+func requireEcho(t *testing.T, dialer *wsnet.Dialer, addr string) {
+	conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := []byte("hello")
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+	rec := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, rec)
+	require.NoError(t, err)
+	require.Equal(t, msg, rec)
+}
+
+func TestDial(t *testing.T) {
+	t.Run("Proxy", func(t *testing.T) {
+		t.Parallel()
+
+		dialer, _ := wsnettest.Dial(t, nil)
+		requireEcho(t, dialer, echo(t))
+	})
+
+	t.Run("TURN", func(t *testing.T) {
+		t.Parallel()
+
+		dialer, _ := wsnettest.Dial(t, &wsnettest.Options{
+			TURN: true,
+		})
+		requireEcho(t, dialer, echo(t))
+
+		pair, err := dialer.Candidates()
+		require.NoError(t, err)
+		assert.Equal(t, webrtc.ICECandidateTypeRelay, pair.Local.Typ)
+	})
+
+	t.Run("Policies", func(t *testing.T) {
+		t.Parallel()
+
+		broker := wsnettest.NewBroker(t)
+		broker.SetPolicies([]wsnet.DialPolicy{{
+			Network: "tcp",
+			Port:    1,
+		}})
+		dialer, _ := wsnettest.Dial(t, &wsnettest.Options{
+			Broker: broker,
+		})
+
+		_, err := dialer.DialContext(context.Background(), "tcp", echo(t))
+		dialErr := &wsnet.DialError{}
+		require.ErrorAs(t, err, &dialErr)
+		assert.Equal(t, wsnet.CodePermissionErr, dialErr.Code)
+	})
+}
+
+func TestFaults(t *testing.T) {
+	t.Run("DropCandidates", func(t *testing.T) {
+		t.Parallel()
+
+		broker := wsnettest.NewBroker(t)
+		broker.SetFaults(wsnettest.Faults{
+			DropCandidate: func(string) bool {
+				return true
+			},
+		})
+		wsnettest.Listen(t, broker, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		dialer, err := wsnet.DialWebsocket(ctx, broker.ConnectURL, nil, nil)
+		require.Error(t, err)
+		if dialer != nil {
+			_ = dialer.Close()
+		}
+	})
+
+	t.Run("AnswerDelay", func(t *testing.T) {
+		t.Parallel()
+
+		delay := 500 * time.Millisecond
+		start := time.Now()
+		dialer, _ := wsnettest.Dial(t, &wsnettest.Options{
+			Faults: wsnettest.Faults{
+				AnswerDelay: delay,
+			},
+		})
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(delay))
+		requireEcho(t, dialer, echo(t))
+	})
+
+	t.Run("DisconnectListeners", func(t *testing.T) {
+		t.Parallel()
+
+		addr := echo(t)
+		broker := wsnettest.NewBroker(t)
+		dialer, _ := wsnettest.Dial(t, &wsnettest.Options{
+			Broker: broker,
+		})
+		broker.DisconnectListeners()
+
+		// Negotiated connections keep working while the listener is away.
+		requireEcho(t, dialer, addr)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, broker.WaitForListener(ctx))
+		dialer, err := wsnet.DialWebsocket(ctx, broker.ConnectURL, nil, nil)
+		require.NoError(t, err)
+		defer dialer.Close()
+		requireEcho(t, dialer, addr)
+	})
+
+	t.Run("DisconnectDialers", func(t *testing.T) {
+		t.Parallel()
+
+		broker := wsnettest.NewBroker(t)
+		broker.SetFaults(wsnettest.Faults{
+			AnswerDelay: time.Second,
+		})
+		wsnettest.Listen(t, broker, nil)
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			broker.DisconnectDialers()
+		}()
+		// The answer never arrives, so the dialer gives up waiting for the
+		// connection to open.
+		dialer, err := wsnet.DialWebsocket(context.Background(), broker.ConnectURL, nil, nil)
+		require.Error(t, err)
+		if dialer != nil {
+			_ = dialer.Close()
+		}
+	})
+}